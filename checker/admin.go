@@ -0,0 +1,70 @@
+package checker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	opsee "github.com/opsee/basic/service"
+	"golang.org/x/net/context"
+)
+
+// AdminHandler serves the checker's HTTP admin endpoints:
+//
+//	GET /schedule     the schedule of every check, in the order they will run
+//	GET /checks       the scheduled checks, as from ListChecks, filtered by the
+//	                  target_type, id (repeatable) and status query parameters
+//	GET /maintenance  the maintenance windows that haven't ended
+//
+// The endpoints are unauthenticated, so the handler should only be served on
+// a loopback address.
+func (c *Checker) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/schedule", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.Scheduler.Schedule())
+	})
+	mux.HandleFunc("/checks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		resp, err := c.ListChecks(context.Background(), &opsee.ListChecksRequest{
+			TargetType: query.Get("target_type"),
+			CheckIds:   query["id"],
+			Status:     query.Get("status"),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, resp.Checks)
+	})
+	mux.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if c.Maintenance == nil {
+			writeJSON(w, []*opsee.MaintenanceWindow{})
+			return
+		}
+		writeJSON(w, c.Maintenance.List())
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.WithError(err).Error("Couldn't marshal admin response.")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
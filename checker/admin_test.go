@@ -0,0 +1,70 @@
+package checker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	opsee "github.com/opsee/basic/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminSchedule(t *testing.T) {
+	resolver := newTestResolver()
+	checker := NewChecker(resolver)
+	checker.Scheduler = NewScheduler(resolver)
+	checker.Scheduler.CreateCheck(TestCommonStubs{}.Check())
+
+	ts := httptest.NewServer(checker.AdminHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	schedule := []*ScheduleEntry{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&schedule))
+	if assert.Len(t, schedule, 1) {
+		assert.Equal(t, "stub-check-id", schedule[0].CheckId)
+		assert.False(t, schedule[0].NextRun.IsZero())
+	}
+
+	resp, err = http.Post(ts.URL+"/schedule", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestAdminChecks(t *testing.T) {
+	checker := newListTestChecker()
+
+	ts := httptest.NewServer(checker.AdminHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/checks?target_type=instance&status=failing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	checks := []*opsee.ScheduledCheck{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&checks))
+	if assert.Len(t, checks, 1) {
+		assert.Equal(t, "failing", checks[0].Check.Id)
+		assert.NotNil(t, checks[0].LastResult)
+	}
+
+	resp, err = http.Get(ts.URL + "/checks?status=flapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,321 @@
+package checker
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/opsee/basic/schema"
+)
+
+// Assertions are evaluated against the JSON form of a check response's reply,
+// the same document that Slate is given. The keys are:
+//
+//   code        the HTTP status code
+//   header      the header named by Value, values joined with ", "
+//   body        the response body
+//   json        the value at the path in Value of the body parsed as JSON,
+//               e.g. "data.items[0].name"
+//   cloudwatch  every datapoint of the metric named by Value
+//   metric      the same as cloudwatch, for the metrics of any reply
+//
+// Any other key names a field of the reply, e.g. "days_until_expiry" for TLS
+// checks or "rcode" for DNS checks. Fields of nested objects may be reached
+// with the path syntax of the json key, e.g. "chain[1].days_until_expiry", or
+// "redirects[0].url" for the first redirect followed by an HTTP check.
+
+const (
+	AssertionKeyCode       = "code"
+	AssertionKeyHeader     = "header"
+	AssertionKeyBody       = "body"
+	AssertionKeyJSON       = "json"
+	AssertionKeyCloudWatch = "cloudwatch"
+	AssertionKeyMetric     = "metric"
+)
+
+// AssertionRelationships maps each supported relationship to whether it
+// requires an operand.
+var AssertionRelationships = map[string]bool{
+	"equal":       true,
+	"notEqual":    true,
+	"empty":       false,
+	"notEmpty":    false,
+	"contain":     true,
+	"notContain":  true,
+	"regExp":      true,
+	"lessThan":    true,
+	"greaterThan": true,
+}
+
+// EvaluateAssertions evaluates each assertion against a reply, which is the
+// JSON that would be sent to Slate. The reply passes if every assertion does.
+// The result of each assertion records the value it was compared with and,
+// if it failed, why. For metric assertions the actual value is the first
+// datapoint that failed, or the last one.
+func EvaluateAssertions(assertions []*schema.Assertion, reply json.RawMessage) (bool, []*schema.AssertionResult, error) {
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(reply, &doc); err != nil {
+		return false, nil, fmt.Errorf("Couldn't decode check response reply: %s", err)
+	}
+
+	passing := true
+	results := make([]*schema.AssertionResult, 0, len(assertions))
+	for _, assertion := range assertions {
+		result := evaluateAssertion(assertion, doc)
+		if !result.Passing {
+			passing = false
+		}
+		results = append(results, result)
+	}
+
+	return passing, results, nil
+}
+
+func evaluateAssertion(assertion *schema.Assertion, doc map[string]interface{}) *schema.AssertionResult {
+	result := &schema.AssertionResult{
+		Key:          assertion.Key,
+		Value:        assertion.Value,
+		Relationship: assertion.Relationship,
+		Operand:      assertion.Operand,
+	}
+
+	if assertion.Key == AssertionKeyCloudWatch || assertion.Key == AssertionKeyMetric {
+		values, err := metricValues(doc, assertion.Value)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		for _, v := range values {
+			result.Actual = v
+			result.Passing, err = compare(assertion.Relationship, v, assertion.Operand)
+			if err != nil {
+				result.Error = err.Error()
+			}
+			if !result.Passing {
+				break
+			}
+		}
+		if !result.Passing && result.Error == "" {
+			result.Error = failureMessage(assertion, result.Actual)
+		}
+		return result
+	}
+
+	actual, err := assertionActual(assertion, doc)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Actual = actual
+	result.Passing, err = compare(assertion.Relationship, actual, assertion.Operand)
+	if err != nil {
+		result.Error = err.Error()
+	} else if !result.Passing {
+		result.Error = failureMessage(assertion, actual)
+	}
+
+	return result
+}
+
+// failureMessage describes a failed assertion, e.g.
+// `code was "502", expected equal "200"`.
+func failureMessage(assertion *schema.Assertion, actual string) string {
+	subject := assertion.Key
+	if assertion.Value != "" {
+		subject = fmt.Sprintf("%s %s", assertion.Key, assertion.Value)
+	}
+
+	if AssertionRelationships[assertion.Relationship] {
+		return fmt.Sprintf("%s was %q, expected %s %q", subject, actual, assertion.Relationship, assertion.Operand)
+	}
+	return fmt.Sprintf("%s was %q, expected %s", subject, actual, assertion.Relationship)
+}
+
+// assertionActual returns the value in a reply that an assertion refers to.
+// Missing values are the empty string, so that they may be asserted empty.
+func assertionActual(assertion *schema.Assertion, doc map[string]interface{}) (string, error) {
+	switch assertion.Key {
+	case "":
+		return "", fmt.Errorf("Assertion has no key")
+
+	case AssertionKeyHeader:
+		headers, _ := doc["headers"].([]interface{})
+		values := []string{}
+		for _, h := range headers {
+			header, _ := h.(map[string]interface{})
+			name, _ := header["name"].(string)
+			if !strings.EqualFold(name, assertion.Value) {
+				continue
+			}
+			vs, _ := header["values"].([]interface{})
+			for _, v := range vs {
+				values = append(values, stringValue(v))
+			}
+		}
+		return strings.Join(values, ", "), nil
+
+	case AssertionKeyJSON:
+		body, _ := doc["body"].(string)
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+			return "", fmt.Errorf("Response body is not JSON: %s", err)
+		}
+		v, err := lookupPath(parsed, assertion.Value)
+		if err != nil {
+			return "", err
+		}
+		return stringValue(v), nil
+
+	default:
+		// code and body are fields of the reply like any other.
+		v, err := lookupPath(doc, assertion.Key)
+		if err != nil {
+			return "", err
+		}
+		return stringValue(v), nil
+	}
+}
+
+// metricValues returns every datapoint in a reply for the named metric.
+func metricValues(doc map[string]interface{}, name string) ([]string, error) {
+	metrics, _ := doc["metrics"].([]interface{})
+	values := []string{}
+	for _, m := range metrics {
+		metric, _ := m.(map[string]interface{})
+		if n, _ := metric["name"].(string); n != name {
+			continue
+		}
+		// A zero value is omitted from the JSON of a Metric.
+		value, ok := metric["value"]
+		if !ok {
+			value = float64(0)
+		}
+		values = append(values, stringValue(value))
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("No datapoints for metric: %s", name)
+	}
+
+	return values, nil
+}
+
+// lookupPath follows a path of the form "a.b[2].c" through decoded JSON. A
+// leading "$" or "$." is ignored. Missing object keys yield nil.
+func lookupPath(v interface{}, path string) (interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return v, nil
+	}
+
+	for _, segment := range strings.Split(path, ".") {
+		name := segment
+		indexes := []int{}
+		if i := strings.Index(segment, "["); i >= 0 {
+			name = segment[:i]
+			for rest := segment[i:]; rest != ""; {
+				end := strings.Index(rest, "]")
+				if rest[0] != '[' || end < 0 {
+					return nil, fmt.Errorf("Invalid path: %s", path)
+				}
+				idx, err := strconv.Atoi(rest[1:end])
+				if err != nil {
+					return nil, fmt.Errorf("Invalid index in path: %s", path)
+				}
+				indexes = append(indexes, idx)
+				rest = rest[end+1:]
+			}
+		}
+
+		if name != "" {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not an object in path: %s", name, path)
+			}
+			v = obj[name]
+		}
+
+		for _, idx := range indexes {
+			arr, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not an array in path: %s", segment, path)
+			}
+			if idx < 0 || idx >= len(arr) {
+				return nil, fmt.Errorf("Index %d out of range in path: %s", idx, path)
+			}
+			v = arr[idx]
+		}
+	}
+
+	return v, nil
+}
+
+// stringValue formats decoded JSON for comparison.
+func stringValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	default:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+}
+
+// compare applies a relationship to an actual value and an operand. Equality
+// is numeric when both sides are numbers, so that "200" equals "200.0".
+func compare(relationship, actual, operand string) (bool, error) {
+	switch relationship {
+	case "equal":
+		return equalValues(actual, operand), nil
+	case "notEqual":
+		return !equalValues(actual, operand), nil
+	case "empty":
+		return actual == "", nil
+	case "notEmpty":
+		return actual != "", nil
+	case "contain":
+		return strings.Contains(actual, operand), nil
+	case "notContain":
+		return !strings.Contains(actual, operand), nil
+	case "regExp":
+		re, err := regexp.Compile(operand)
+		if err != nil {
+			return false, fmt.Errorf("Invalid regular expression: %s", err)
+		}
+		return re.MatchString(actual), nil
+	case "lessThan", "greaterThan":
+		a, err := strconv.ParseFloat(actual, 64)
+		if err != nil {
+			return false, fmt.Errorf("Actual value is not a number: %q", actual)
+		}
+		o, err := strconv.ParseFloat(operand, 64)
+		if err != nil {
+			return false, fmt.Errorf("Operand is not a number: %q", operand)
+		}
+		if relationship == "lessThan" {
+			return a < o, nil
+		}
+		return a > o, nil
+	default:
+		return false, fmt.Errorf("Unknown relationship: %s", relationship)
+	}
+}
+
+func equalValues(actual, operand string) bool {
+	a, aErr := strconv.ParseFloat(actual, 64)
+	o, oErr := strconv.ParseFloat(operand, 64)
+	if aErr == nil && oErr == nil {
+		return a == o
+	}
+	return actual == operand
+}
@@ -0,0 +1,240 @@
+package checker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/opsee/basic/schema"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func evaluate(t *testing.T, reply interface{}, assertions ...*schema.Assertion) (bool, []*schema.AssertionResult) {
+	jsonBytes, err := json.Marshal(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passing, results, err := EvaluateAssertions(assertions, jsonBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return passing, results
+}
+
+// The local engine must agree with Slate on Slate's own test cases.
+func TestAssertionsAgreeWithSlateTests(t *testing.T) {
+	for i, test := range SlateTests {
+		passing, _ := evaluate(t, test.response, test.check.Assertions...)
+		assert.Equal(t, test.expected, passing, "SlateTests[%d]", i)
+	}
+}
+
+func TestAssertionsHTTPResponse(t *testing.T) {
+	reply := &schema.HttpResponse{
+		Code: 200,
+		Body: `{"status": "ok", "items": [{"name": "a", "count": 3}], "ready": true}`,
+		Headers: []*schema.Header{
+			&schema.Header{Name: "Content-Type", Values: []string{"application/json"}},
+		},
+		Metrics: []*schema.Metric{
+			&schema.Metric{Name: "request_latency", Value: 12.5},
+		},
+	}
+
+	tests := []struct {
+		assertion *schema.Assertion
+		passing   bool
+		actual    string
+	}{
+		{&schema.Assertion{Key: "code", Relationship: "equal", Operand: "200.0"}, true, "200"},
+		{&schema.Assertion{Key: "code", Relationship: "lessThan", Operand: "300"}, true, "200"},
+		{&schema.Assertion{Key: "code", Relationship: "notEqual", Operand: "200"}, false, "200"},
+		{&schema.Assertion{Key: "header", Value: "content-type", Relationship: "contain", Operand: "json"}, true, "application/json"},
+		{&schema.Assertion{Key: "header", Value: "X-Missing", Relationship: "empty"}, true, ""},
+		{&schema.Assertion{Key: "body", Relationship: "regExp", Operand: `"status":\s*"ok"`}, true, reply.Body},
+		{&schema.Assertion{Key: "body", Relationship: "notContain", Operand: "error"}, true, reply.Body},
+		{&schema.Assertion{Key: "json", Value: "status", Relationship: "equal", Operand: "ok"}, true, "ok"},
+		{&schema.Assertion{Key: "json", Value: "$.items[0].count", Relationship: "greaterThan", Operand: "2"}, true, "3"},
+		{&schema.Assertion{Key: "json", Value: "ready", Relationship: "equal", Operand: "true"}, true, "true"},
+		{&schema.Assertion{Key: "json", Value: "missing", Relationship: "notEmpty"}, false, ""},
+		{&schema.Assertion{Key: "metric", Value: "request_latency", Relationship: "lessThan", Operand: "100"}, true, "12.5"},
+	}
+
+	for i, test := range tests {
+		passing, results := evaluate(t, reply, test.assertion)
+		assert.Equal(t, test.passing, passing, "test %d", i)
+		assert.Equal(t, test.actual, results[0].Actual, "test %d", i)
+		assert.Equal(t, test.passing, results[0].Error == "", "test %d", i)
+	}
+}
+
+func TestAssertionsDescribeFailures(t *testing.T) {
+	reply := &schema.HttpResponse{Code: 502}
+
+	passing, results := evaluate(t, reply,
+		&schema.Assertion{Key: "code", Relationship: "equal", Operand: "200"},
+		&schema.Assertion{Key: "header", Value: "Location", Relationship: "notEmpty"},
+		&schema.Assertion{Key: "code", Relationship: "greaterThan", Operand: "0"},
+	)
+	assert.False(t, passing)
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, "502", results[0].Actual)
+		assert.False(t, results[0].Passing)
+		assert.Equal(t, `code was "502", expected equal "200"`, results[0].Error)
+		assert.Equal(t, `header Location was "", expected notEmpty`, results[1].Error)
+		assert.True(t, results[2].Passing)
+		assert.Empty(t, results[2].Error)
+	}
+}
+
+func TestAssertionResultsSurviveResultEncoding(t *testing.T) {
+	_, results := evaluate(t, &schema.HttpResponse{Code: 502},
+		&schema.Assertion{Key: "code", Relationship: "equal", Operand: "200"},
+		&schema.Assertion{Key: "code", Relationship: "notEmpty"},
+	)
+	result := &schema.CheckResult{
+		CheckId: "check-id",
+		Responses: []*schema.CheckResponse{
+			&schema.CheckResponse{
+				Target:           &schema.Target{Id: "id"},
+				Reply:            &schema.CheckResponse_HttpResponse{HttpResponse: &schema.HttpResponse{Code: 502}},
+				AssertionResults: results,
+			},
+		},
+	}
+
+	msg, err := proto.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &schema.CheckResult{}
+	if err := proto.Unmarshal(msg, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, result.Equal(decoded))
+	assert.Equal(t, results, decoded.Responses[0].AssertionResults)
+}
+
+func TestAssertionsReportErrors(t *testing.T) {
+	reply := &schema.HttpResponse{Code: 200, Body: "not json"}
+
+	tests := []*schema.Assertion{
+		&schema.Assertion{Key: "json", Value: "status", Relationship: "equal", Operand: "ok"},
+		&schema.Assertion{Key: "body", Relationship: "lessThan", Operand: "3"},
+		&schema.Assertion{Key: "code", Relationship: "regExp", Operand: "("},
+		&schema.Assertion{Key: "code", Relationship: "approximately", Operand: "200"},
+		&schema.Assertion{Key: "cloudwatch", Value: "CPUUtilization", Relationship: "lessThan", Operand: "1"},
+	}
+
+	for i, assertion := range tests {
+		passing, results := evaluate(t, reply, assertion)
+		assert.False(t, passing, "test %d", i)
+		assert.NotEmpty(t, results[0].Error, "test %d", i)
+	}
+}
+
+func TestAssertionsTLSReply(t *testing.T) {
+	reply := &schema.TlsResponse{
+		DaysUntilExpiry: 12.5,
+		Chain: []*schema.TlsCertificate{
+			&schema.TlsCertificate{DaysUntilExpiry: 12.5},
+			&schema.TlsCertificate{DaysUntilExpiry: 300},
+		},
+		Verified: true,
+	}
+
+	passing, _ := evaluate(t, reply,
+		&schema.Assertion{Key: "days_until_expiry", Relationship: "greaterThan", Operand: "7"},
+		&schema.Assertion{Key: "chain[1].days_until_expiry", Relationship: "greaterThan", Operand: "30"},
+		&schema.Assertion{Key: "verified", Relationship: "equal", Operand: "true"},
+	)
+	assert.True(t, passing)
+
+	passing, _ = evaluate(t, reply,
+		&schema.Assertion{Key: "days_until_expiry", Relationship: "greaterThan", Operand: "30"},
+	)
+	assert.False(t, passing)
+}
+
+func TestRunnerEvaluatesAssertionsWithoutSlate(t *testing.T) {
+	l := tcpTestServer(t, "+OK ready\r\n")
+	defer l.Close()
+
+	check := TestCommonStubs{}.Check()
+	check.Spec = &schema.Check_TcpCheck{TcpCheck: &schema.TcpCheck{}}
+	check.Assertions = []*schema.Assertion{
+		&schema.Assertion{Key: "body", Relationship: "contain", Operand: "+OK"},
+	}
+
+	runner := NewRunner(&schema.HttpCheck{})
+	runner.slateClient = nil
+	responses, err := runner.RunCheck(context.Background(), check, []*schema.Target{
+		&schema.Target{Id: "id", Type: "instance", Address: l.Addr().String()},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, responses, 1) {
+		assert.Empty(t, responses[0].Error)
+		assert.True(t, responses[0].Passing)
+		if assert.Len(t, responses[0].AssertionResults, 1) {
+			assert.Equal(t, "+OK ready\r\n", responses[0].AssertionResults[0].Actual)
+		}
+	}
+}
+
+func TestRunnerShadowsSlateWithUnredactedReply(t *testing.T) {
+	requests := make(chan *SlateRequest, 2)
+	release := make(chan struct{})
+	slate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sr := &SlateRequest{}
+		json.NewDecoder(r.Body).Decode(sr)
+		requests <- sr
+		<-release
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer slate.Close()
+	defer close(release)
+
+	check := TestCommonStubs{}.Check()
+	check.Assertions = []*schema.Assertion{
+		&schema.Assertion{Key: "body", Relationship: "contain", Operand: "@"},
+	}
+	task := func() *Task {
+		return &Task{
+			Target: &schema.Target{Id: "id"},
+			Response: &Response{Response: &schema.CheckResponse_HttpResponse{
+				HttpResponse: &schema.HttpResponse{Body: "owner: dave@example.com"},
+			}},
+		}
+	}
+
+	runner := NewRunner(&schema.HttpCheck{})
+	runner.slateClient = NewSlateClient(slate.URL)
+	runner.slateShadows = make(chan struct{}, 1)
+	runner.redactor = testRedactor(t, RedactionConfig{BodyPatterns: []string{"email"}})
+
+	response := runner.checkResponse(check, task())
+	assert.Equal(t, "owner: [redacted]", response.GetHttpResponse().Body)
+	select {
+	case sr := <-requests:
+		assert.Contains(t, string(sr.Response), "dave@example.com")
+	case <-time.After(5 * time.Second):
+		t.Fatal("slate was not consulted")
+	}
+
+	// The first comparison is still waiting on slate, so this one is skipped.
+	skipped := metrics.GetOrRegisterCounter("slate_skipped", runner.registry)
+	before := skipped.Count()
+	runner.checkResponse(check, task())
+	assert.Equal(t, before+1, skipped.Count())
+	select {
+	case <-requests:
+		t.Fatal("slate was consulted beyond MaxSlateShadows")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
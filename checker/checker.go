@@ -7,7 +7,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
-	"reflect"
+	"os"
 	"sync"
 	"time"
 
@@ -20,6 +20,7 @@ import (
 	"github.com/opsee/bastion/auth"
 	"github.com/opsee/bastion/config"
 	"github.com/opsee/bastion/heart"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/satori/go.uuid"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -89,10 +90,14 @@ type Interval time.Duration
 // RemoteRunner allows you to control a Runner process via NSQ and behaves similarly to the Runner.
 
 type RemoteRunner struct {
+	// Results receives the results of scheduled checks for subscribers.
+	Results    *ResultBroker
 	consumer   *nsq.Consumer
+	partials   *nsq.Consumer
 	producer   *nsq.Producer
 	config     *NSQRunnerConfig
 	requestMap map[string]chan *schema.CheckResult // TODO(greg): I really want NBHM for Golang. :(
+	streamMap  map[string]chan *schema.CheckResult
 	sync.RWMutex
 }
 
@@ -114,42 +119,26 @@ func NewRemoteRunner(cfg *NSQRunnerConfig) (*RemoteRunner, error) {
 	log.WithFields(log.Fields{"queue": cfg.ProducerQueueName}).Debug("Creating RemoteRunner producer")
 
 	r := &RemoteRunner{
+		Results:    NewResultBroker(),
 		requestMap: make(map[string]chan *schema.CheckResult),
+		streamMap:  make(map[string]chan *schema.CheckResult),
 		consumer:   consumer,
 		producer:   producer,
 		config:     cfg,
 	}
-	consumer.AddConcurrentHandlers(nsq.HandlerFunc(func(m *nsq.Message) error {
-		chk := &schema.CheckResult{}
-		err := proto.Unmarshal(m.Body, chk)
+	handler := nsq.HandlerFunc(func(m *nsq.Message) error {
+		// Runners may batch results in an envelope.
+		results, err := UnmarshalResults(m.Body)
 		if err != nil {
 			return err
 		}
 
-		log.WithFields(log.Fields{"channel": cfg.ConsumerChannelName, "queue": cfg.ConsumerQueueName}).Debugf("Consumed check id %s", chk.CheckId)
-
-		var respChan chan *schema.CheckResult
-
-		r.withLock(func() {
-			respChan = r.requestMap[chk.CheckId]
-			log.Debugf("found response channel for check id %s", chk.CheckId)
-		})
-
-		if respChan == nil {
-			log.Debugf("response channel for check id %s is nil", chk.CheckId)
-			return nil
+		for _, chk := range results {
+			r.handleResult(chk)
 		}
-
-		// There is a 1:1 mapping of TestCheck calls to CheckResults, so we close
-		// the channel here after writing, making it safe to delete the channel
-		// once we've returned from RunCheck. We will incur a GC penalty for doing
-		// this if the result is never read, but I think we can manage. It might be
-		// nice to really understand what the cost of this approach is, but I don't
-		// think it's particularly important. -greg
-		respChan <- chk
-		close(respChan)
 		return nil
-	}), cfg.MaxHandlers)
+	})
+	consumer.AddConcurrentHandlers(handler, cfg.MaxHandlers)
 
 	err = consumer.ConnectToNSQD(cfg.ConsumerNsqdHost)
 	if err != nil {
@@ -157,9 +146,76 @@ func NewRemoteRunner(cfg *NSQRunnerConfig) (*RemoteRunner, error) {
 		return nil, err
 	}
 
+	if cfg.PartialQueueName != "" {
+		// Partial results are only of interest to streams in flight, so
+		// they aren't kept while the checker is away.
+		channel := cfg.ConsumerChannelName + "#ephemeral"
+		r.partials, err = nsq.NewConsumer(cfg.PartialQueueName, channel, nsq.NewConfig())
+		if err != nil {
+			log.WithError(err).Error("couldn't create new partial results consumer")
+			return nil, err
+		}
+		r.partials.AddConcurrentHandlers(handler, cfg.MaxHandlers)
+
+		err = r.partials.ConnectToNSQD(cfg.ConsumerNsqdHost)
+		if err != nil {
+			log.WithError(err).Error("checker's NewRemoteRunner partial results consumer failed to connect to nsqd")
+			return nil, err
+		}
+		log.WithFields(log.Fields{"channel": channel, "queue": cfg.PartialQueueName}).Debug("Created RemoteRunner partial results consumer")
+	}
+
 	return r, nil
 }
 
+func (r *RemoteRunner) handleResult(chk *schema.CheckResult) {
+	log.WithFields(log.Fields{"channel": r.config.ConsumerChannelName, "queue": r.config.ConsumerQueueName}).Debugf("Consumed check id %s", chk.CheckId)
+
+	var respChan, streamChan chan *schema.CheckResult
+
+	if chk.RunId == "" {
+		// Results without a run ID are from scheduled runs.
+		if !chk.Partial {
+			r.Results.Publish(chk)
+		}
+		return
+	}
+
+	r.withLock(func() {
+		respChan = r.requestMap[chk.RunId]
+		streamChan = r.streamMap[chk.RunId]
+		log.Debugf("found response channel for run id %s", chk.RunId)
+	})
+
+	if streamChan != nil {
+		// Stream channels have room for every result of the run and are
+		// never closed, so a result arriving after StreamCheck has returned
+		// is simply discarded.
+		select {
+		case streamChan <- chk:
+		default:
+			log.Warnf("stream channel for check id %s is full", chk.CheckId)
+		}
+		return
+	}
+
+	if chk.Partial || respChan == nil {
+		// Partial results are only of interest to a waiting StreamCheck, and
+		// nobody is waiting for the result of an abandoned test run.
+		log.Debugf("response channel for run id %s is nil", chk.RunId)
+		return
+	}
+
+	// There is a 1:1 mapping of TestCheck calls to CheckResults, so we close
+	// the channel here after writing, making it safe to delete the channel
+	// once we've returned from RunCheck. We will incur a GC penalty for doing
+	// this if the result is never read, but I think we can manage. It might be
+	// nice to really understand what the cost of this approach is, but I don't
+	// think it's particularly important. -greg
+	respChan <- chk
+	close(respChan)
+}
+
 func (r *RemoteRunner) withLock(f func()) {
 	log.Debug("Acquiring lock on RemoteRunner.")
 	r.Lock()
@@ -175,16 +231,10 @@ func (r *RemoteRunner) RunCheck(ctx context.Context, checkWithTargets *schema.Ch
 	chk := checkWithTargets.Check
 	log.Debugf("RemoteRunner Running check %s", chk.String())
 
-	var (
-		id  string
-		err error
-	)
 	if chk.Id == "" {
-		id = uuid.NewV4().String()
-		chk.Id = id
-	} else {
-		id = chk.Id
+		chk.Id = uuid.NewV4().String()
 	}
+	id := uuid.NewV4().String()
 
 	respChan := make(chan *schema.CheckResult, 1)
 
@@ -200,7 +250,9 @@ func (r *RemoteRunner) RunCheck(ctx context.Context, checkWithTargets *schema.Ch
 		})
 	}()
 
-	msg, err := proto.Marshal(checkWithTargets)
+	run := *checkWithTargets
+	run.RunId = id
+	msg, err := proto.Marshal(&run)
 	if err != nil {
 		log.WithError(err).Error("Failed to marshal checkwithtargets")
 		return nil, err
@@ -219,9 +271,110 @@ func (r *RemoteRunner) RunCheck(ctx context.Context, checkWithTargets *schema.Ch
 	}
 }
 
+// StreamCheck asynchronously executes the check like RunCheck, but calls
+// respond with each target's response as soon as the runner reports it. If
+// maxHosts is greater than zero, the runner stops once maxHosts responses
+// have arrived. If the context is done or respond returns an error, the run
+// is cancelled.
+func (r *RemoteRunner) StreamCheck(ctx context.Context, checkWithTargets *schema.CheckTargets, maxHosts int, respond func(*schema.CheckResponse) error) error {
+	chk := checkWithTargets.Check
+	if chk.Id == "" {
+		chk.Id = uuid.NewV4().String()
+	}
+	id := uuid.NewV4().String()
+
+	// The runner publishes a partial result per response and then the
+	// complete result.
+	streamChan := make(chan *schema.CheckResult, len(checkWithTargets.Targets)+2)
+
+	r.withLock(func() {
+		r.streamMap[id] = streamChan
+	})
+
+	defer func() {
+		r.withLock(func() {
+			delete(r.streamMap, id)
+		})
+	}()
+
+	run := *checkWithTargets
+	run.RunId = id
+	run.Stream = true
+	run.MaxHosts = int32(maxHosts)
+	msg, err := proto.Marshal(&run)
+	if err != nil {
+		log.WithError(err).Error("Failed to marshal checkwithtargets")
+		return err
+	}
+
+	log.Debug("Publishing request to stream check")
+	if err := r.producer.Publish(r.config.ProducerQueueName, msg); err != nil {
+		return err
+	}
+
+	// Partial results may be consumed out of order, and after the complete
+	// result, so responses are tracked by target and the complete result
+	// fills in any that haven't arrived yet.
+	sent := map[string]bool{}
+	send := func(response *schema.CheckResponse) error {
+		key := response.Target.String()
+		if sent[key] || (maxHosts > 0 && len(sent) >= maxHosts) {
+			return nil
+		}
+		sent[key] = true
+		return respond(response)
+	}
+
+	for {
+		select {
+		case result := <-streamChan:
+			for _, response := range result.Responses {
+				if err := send(response); err != nil {
+					r.cancelRun(id)
+					return err
+				}
+			}
+			if !result.Partial || (maxHosts > 0 && len(sent) >= maxHosts) {
+				return nil
+			}
+		case <-ctx.Done():
+			log.WithError(ctx.Err()).Info("Cancelling streaming check.")
+			r.cancelRun(id)
+			return ctx.Err()
+		}
+	}
+}
+
+// cancelRun asks the runners to cancel a streaming run. Cancellations are
+// published on their own topic, which every runner consumes, so that they
+// reach the runner running the check, and never reach runners that don't
+// know about them.
+func (r *RemoteRunner) cancelRun(id string) {
+	if r.config.CancelQueueName == "" {
+		return
+	}
+
+	msg, err := proto.Marshal(&schema.CheckTargets{
+		RunId:  id,
+		Cancel: true,
+	})
+	if err != nil {
+		log.WithError(err).Error("Failed to marshal cancellation")
+		return
+	}
+
+	if err := r.producer.Publish(r.config.CancelQueueName, msg); err != nil {
+		log.WithError(err).Error("Failed to publish cancellation")
+	}
+}
+
 // Stop blocks until the NSQ consumer and producer are stopped.
 
 func (r *RemoteRunner) Stop() {
+	if r.partials != nil {
+		r.partials.Stop()
+		<-r.partials.StopChan
+	}
 	r.consumer.Stop()
 	<-r.consumer.StopChan
 	r.producer.Stop()
@@ -234,77 +387,120 @@ func (r *RemoteRunner) Stop() {
 //    - Inform the scheduler that things need to happen
 
 type Checker struct {
-	Port       int
-	Scheduler  *Scheduler
-	grpcServer *grpc.Server
-	Runner     *RemoteRunner
-	resolver   Resolver
+	Port      int
+	Scheduler *Scheduler
+	Runner    *RemoteRunner
+	// ReconcileInterval is how often scheduled checks are reconciled with
+	// the backend, and ReconcileJitter the most that is randomly added to it.
+	ReconcileInterval time.Duration
+	ReconcileJitter   time.Duration
+	// SnapshotPath is where the scheduled checks are persisted, so that they
+	// can be scheduled on startup before the backend is reachable. Empty to
+	// disable.
+	SnapshotPath string
+	// Maintenance holds the maintenance windows managed through the
+	// checker's RPCs. It is shared with the Scheduler.
+	Maintenance *MaintenanceStore
+	// Secrets holds the secrets managed through the checker's RPCs. They
+	// are substituted into checks by the runner.
+	Secrets *SecretStore
+	// States, if set, supplies the state and last result of checks listed
+	// by ListChecks.
+	States        *StateTracker
+	grpcServer    *grpc.Server
+	resolver      Resolver
+	registry      metrics.Registry
+	reconcileStop chan struct{}
+	snapshotLock  sync.Mutex
 }
 
 // NewChecker sets up the GRPC server for a Checker.
 
 func NewChecker(r Resolver) *Checker {
 	return &Checker{
-		grpcServer: grpc.NewServer(),
-		resolver:   r,
+		ReconcileInterval: DefaultReconcileInterval,
+		ReconcileJitter:   DefaultReconcileJitter,
+		grpcServer:        grpc.NewServer(),
+		resolver:          r,
+		registry:          metrics.NewPrefixedChildRegistry(metricsRegistry, "checker."),
+		reconcileStop:     make(chan struct{}),
 	}
 }
 
-func (c *Checker) invoke(ctx context.Context, cmd string, req *opsee.CheckResourceRequest) (*opsee.ResourceResponse, error) {
-	responses := make([]*opsee.CheckResourceResponse, len(req.Checks))
-	response := &opsee.ResourceResponse{
-		Responses: responses,
-	}
-	for i, check := range req.Checks {
-		in := []reflect.Value{reflect.ValueOf(check)}
-		out := reflect.ValueOf(c.Scheduler).MethodByName(cmd).Call(in)
-		checkResponse, ok := out[0].Interface().(*schema.Check)
-		if !ok {
-			err, ok := out[1].Interface().(error)
-			if ok {
-				if err != nil {
-					responses[i] = &opsee.CheckResourceResponse{
-						Error: err.Error(),
-					}
-				}
-			}
-		} else {
-			responses[i] = &opsee.CheckResourceResponse{
+// A checkOperation applies a request to a single check.
+type checkOperation func(check *schema.Check) *opsee.CheckResourceResponse
+
+// schedulerOperation adapts a Scheduler method to a checkOperation.
+func schedulerOperation(f func(*schema.Check) (*schema.Check, error)) checkOperation {
+	return func(check *schema.Check) *opsee.CheckResourceResponse {
+		result, err := f(check)
+		if err != nil {
+			return &opsee.CheckResourceResponse{
 				Id:    check.Id,
-				Check: checkResponse,
+				Error: err.Error(),
 			}
 		}
+		return &opsee.CheckResourceResponse{
+			Id:    check.Id,
+			Check: result,
+		}
+	}
+}
+
+// invoke applies op to each check in a request, returning a response for
+// each.
+func (c *Checker) invoke(req *opsee.CheckResourceRequest, op checkOperation) *opsee.ResourceResponse {
+	responses := make([]*opsee.CheckResourceResponse, len(req.Checks))
+	for i, check := range req.Checks {
+		responses[i] = op(check)
+	}
+	return &opsee.ResourceResponse{
+		Responses: responses,
 	}
-	return response, nil
 }
 
 // CreateCheck creates a check within a request context. It will return an error if there is any difficulty
 // creating the check.
 
 func (c *Checker) CreateCheck(ctx context.Context, req *opsee.CheckResourceRequest) (*opsee.ResourceResponse, error) {
-	return c.invoke(ctx, "CreateCheck", req)
+	defer c.saveSnapshot()
+	return c.invoke(req, schedulerOperation(c.Scheduler.CreateCheck)), nil
 }
 
 // RetrieveCheck retrieves an existing check within a request context. It will return an error if the check
 // does not exist.
 
 func (c *Checker) RetrieveCheck(ctx context.Context, req *opsee.CheckResourceRequest) (*opsee.ResourceResponse, error) {
-	return c.invoke(ctx, "RetrieveCheck", req)
+	return c.invoke(req, schedulerOperation(c.Scheduler.RetrieveCheck)), nil
 }
 
-// UpdateCheck deletes and then recreates a check within a request context. It will return an error if there is
-// a problem deleting or creating a check.
+// UpdateCheck atomically replaces checks within a request context. Each
+// response lists the fields that changed. If a new definition is invalid, its
+// response has an error and the check's existing definition, which is still
+// scheduled.
 
 func (c *Checker) UpdateCheck(ctx context.Context, req *opsee.CheckResourceRequest) (*opsee.ResourceResponse, error) {
-	c.invoke(ctx, "DeleteCheck", req)
-	return c.invoke(ctx, "CreateCheck", req)
+	defer c.saveSnapshot()
+	return c.invoke(req, func(check *schema.Check) *opsee.CheckResourceResponse {
+		result, changed, err := c.Scheduler.UpdateCheck(check)
+		resp := &opsee.CheckResourceResponse{
+			Id:      check.Id,
+			Check:   result,
+			Changed: changed,
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		return resp
+	}), nil
 }
 
 // DeleteCheck deletes a check within a request context. It will return an error if there is a problem
 // deleting the check.
 
 func (c *Checker) DeleteCheck(ctx context.Context, req *opsee.CheckResourceRequest) (*opsee.ResourceResponse, error) {
-	return c.invoke(ctx, "DeleteCheck", req)
+	defer c.saveSnapshot()
+	return c.invoke(req, schedulerOperation(c.Scheduler.DeleteCheck)), nil
 }
 
 // TestCheck will synchronously* execute a check.
@@ -370,6 +566,35 @@ func (c *Checker) TestCheck(ctx context.Context, req *opsee.TestCheckRequest) (*
 	return testCheckResponse, nil
 }
 
+// StreamTestCheck runs a check like TestCheck, but sends each target's
+// response as soon as it arrives, one per TestCheckResponse, instead of
+// waiting for every target. It stops after MaxHosts responses. Cancelling the
+// stream cancels the run.
+func (c *Checker) StreamTestCheck(req *opsee.TestCheckRequest, stream opsee.Checker_StreamTestCheckServer) error {
+	log.WithFields(log.Fields{"service": "checker", "event": "StreamTestCheck"}).Infof("Handling request: %v", req)
+
+	if req.Deadline == nil {
+		err := fmt.Errorf("Deadline required but missing in request. %v", req)
+		log.WithFields(log.Fields{"service": "checker", "event": "StreamTestCheck", "error": err.Error()}).Error("Missing deadline in request!")
+		return err
+	}
+
+	dlval, err := req.Deadline.Value()
+	dl, _ := dlval.(time.Time)
+
+	ctx, cancel := context.WithDeadline(stream.Context(), dl)
+	defer cancel()
+
+	checkWithTargets, err := NewCheckTargets(c.resolver, req.Check)
+	if err != nil {
+		return err
+	}
+
+	return c.Runner.StreamCheck(ctx, checkWithTargets, int(req.MaxHosts), func(response *schema.CheckResponse) error {
+		return stream.Send(&opsee.TestCheckResponse{Responses: []*schema.CheckResponse{response}})
+	})
+}
+
 // GetExistingChecks will query the backend to retrieve all of the checks for
 // this customer's bastion. It authenticates before retrieving the
 // configuration.
@@ -400,7 +625,10 @@ func (c *Checker) GetExistingChecks(tries int) ([]*schema.Check, error) {
 	}
 
 	if token, err := cache.GetToken(request); err != nil || token == nil {
-		log.WithFields(log.Fields{"service": "checker", "Error": err.Error()}).Fatal("Error initializing BastionAuth")
+		if err == nil {
+			err = fmt.Errorf("No token returned from %s", request.AuthEndpoint)
+		}
+		log.WithFields(log.Fields{"service": "checker", "Error": err.Error()}).Error("Error initializing BastionAuth")
 		return nil, err
 	} else {
 		theauth, header := token.AuthHeader()
@@ -464,19 +692,6 @@ func (c *Checker) GetExistingChecks(tries int) ([]*schema.Check, error) {
 	return checks.Checks, nil
 }
 
-func (c *Checker) synchronizeChecks() error {
-	log.Debug("Synchronizing checks with Opsee.")
-	// Now Get existing checks from bartnet
-	existingChecks, err := c.GetExistingChecks(NumCheckSyncRetries)
-	if err != nil {
-		return err
-	}
-	for _, check := range existingChecks {
-		c.Scheduler.CreateCheck(check)
-	}
-	return nil
-}
-
 // Start all of the checker loops, grpc server, etc.
 func (c *Checker) Start() error {
 	listen, err := net.Listen("tcp", fmt.Sprintf(":%d", c.Port))
@@ -490,11 +705,13 @@ func (c *Checker) Start() error {
 		return err
 	}
 
-	log.Debug("Getting existing checks")
-	err = c.synchronizeChecks()
-	if err != nil {
-		log.WithError(err).Fatal("Couldn't retrieve existing checks from server.")
-	}
+	// Schedule the checks we had before we were restarted, so that they run
+	// even if the backend isn't reachable yet.
+	c.loadSnapshot()
+
+	// Synchronize checks with the backend in the background, retrying until
+	// it's reachable, and then keep them reconciled.
+	go c.reconcileLoop()
 
 	// Now start and register the GRPC server and allow users to create/edit/etc checks
 	go c.grpcServer.Serve(listen)
@@ -503,8 +720,54 @@ func (c *Checker) Start() error {
 	return nil
 }
 
+// saveSnapshot persists the scheduled checks to SnapshotPath.
+func (c *Checker) saveSnapshot() {
+	if c.SnapshotPath == "" {
+		return
+	}
+
+	// Serialize writes, so that an older set of checks never replaces a newer
+	// one.
+	c.snapshotLock.Lock()
+	defer c.snapshotLock.Unlock()
+
+	if err := WriteCheckSnapshot(c.SnapshotPath, c.Scheduler.Checks()); err != nil {
+		log.WithError(err).WithField("path", c.SnapshotPath).Error("Couldn't write check snapshot.")
+		metrics.GetOrRegisterCounter("snapshot_errors", c.registry).Inc(1)
+	}
+}
+
+// loadSnapshot schedules the checks persisted in SnapshotPath.
+func (c *Checker) loadSnapshot() {
+	if c.SnapshotPath == "" {
+		return
+	}
+
+	snapshot, err := ReadCheckSnapshot(c.SnapshotPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.WithField("path", c.SnapshotPath).Info("No check snapshot found.")
+		} else {
+			log.WithError(err).WithField("path", c.SnapshotPath).Error("Couldn't read check snapshot.")
+		}
+		return
+	}
+
+	loaded := 0
+	for _, check := range snapshot.Checks {
+		if _, err := c.Scheduler.RestoreCheck(check); err != nil {
+			log.WithError(err).WithField("check_id", check.Id).Error("Couldn't schedule check from snapshot.")
+			continue
+		}
+		loaded++
+	}
+
+	log.WithFields(log.Fields{"path": c.SnapshotPath, "checks": loaded}).Info("Loaded check snapshot.")
+}
+
 // Stop all of the checker loops, grpc server, etc.
 func (c *Checker) Stop() {
+	close(c.reconcileStop)
 	c.Runner.Stop()
 	c.grpcServer.Stop()
 	c.Scheduler.Stop()
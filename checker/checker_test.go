@@ -5,6 +5,7 @@ package checker
 // worth testing.
 
 import (
+	"io"
 	"strings"
 	"testing"
 	"time"
@@ -249,6 +250,34 @@ func (s *CheckerTestSuite) TestCheckAdheresToMaxHosts() {
 	assert.Len(s.T(), response.GetResponses(), 1)
 }
 
+func (s *CheckerTestSuite) TestStreamTestCheckAdheresToMaxHosts() {
+	target := &schema.Target{
+		Type: "sg",
+		Id:   "sg3",
+		Name: "sg3",
+	}
+	request, err := s.buildTestCheckRequest(s.Common.HTTPCheck(), target)
+	request.MaxHosts = 2
+	assert.NoError(s.T(), err)
+
+	stream, err := s.CheckerClient.Client.StreamTestCheck(s.Context, request)
+	assert.NoError(s.T(), err)
+
+	responses := []*schema.CheckResponse{}
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(s.T(), err) {
+			return
+		}
+		assert.Len(s.T(), response.GetResponses(), 1)
+		responses = append(responses, response.GetResponses()...)
+	}
+	assert.Len(s.T(), responses, 2)
+}
+
 func (s *CheckerTestSuite) TestCheckSupportsInstances() {
 	target := &schema.Target{
 		Type: "instance",
@@ -291,3 +320,46 @@ func TestCheckerTestSuite(t *testing.T) {
 	setupTestEnv()
 	suite.Run(t, new(CheckerTestSuite))
 }
+
+func TestRemoteRunnerRoutesPartialResults(t *testing.T) {
+	runner := &RemoteRunner{
+		Results:    NewResultBroker(),
+		requestMap: make(map[string]chan *schema.CheckResult),
+		streamMap:  make(map[string]chan *schema.CheckResult),
+		config:     &NSQRunnerConfig{},
+	}
+	sub := runner.Results.Subscribe(&opsee.SubscribeResultsRequest{})
+	defer runner.Results.Unsubscribe(sub)
+
+	streamChan := make(chan *schema.CheckResult, 1)
+	runner.streamMap["run-1"] = streamChan
+
+	partial := &schema.CheckResult{CheckId: "streaming", RunId: "run-1", Partial: true}
+	runner.handleResult(partial)
+	assert.Equal(t, partial, <-streamChan)
+
+	// Results beyond the stream channel's capacity are discarded rather than
+	// blocking the consumer.
+	runner.handleResult(partial)
+	runner.handleResult(&schema.CheckResult{CheckId: "streaming", RunId: "run-1"})
+	assert.Len(t, streamChan, 1)
+
+	// Results of test runs nobody is waiting for, and partial results of
+	// scheduled runs, aren't published to subscribers.
+	runner.handleResult(&schema.CheckResult{CheckId: "abandoned", RunId: "run-2", Partial: true})
+	runner.handleResult(&schema.CheckResult{CheckId: "abandoned", RunId: "run-2"})
+	runner.handleResult(&schema.CheckResult{CheckId: "scheduled", Partial: true})
+	scheduled := &schema.CheckResult{CheckId: "scheduled"}
+	runner.handleResult(scheduled)
+	assert.Equal(t, scheduled, <-sub.Results())
+	assert.Len(t, sub.Results(), 0)
+
+	// Concurrent runs of the same check are told apart by their run IDs.
+	respChan := make(chan *schema.CheckResult, 1)
+	runner.requestMap["run-3"] = respChan
+	runner.streamMap["run-4"] = make(chan *schema.CheckResult, 1)
+	result := &schema.CheckResult{CheckId: "streaming", RunId: "run-3"}
+	runner.handleResult(result)
+	assert.Equal(t, result, <-respChan)
+	assert.Len(t, runner.streamMap["run-4"], 0)
+}
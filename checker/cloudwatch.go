@@ -276,7 +276,7 @@ func (this *CloudWatchWorker) Work(ctx context.Context, task *Task) *Task {
 		select {
 		case response := <-request.Do(ctx):
 			if response.Error != nil {
-				log.WithError(response.Error).Errorf("error processing request: %s", *task)
+				log.WithError(response.Error).WithFields(task.logFields()).Error("error processing request")
 			}
 			task.Response = response
 		case <-ctx.Done():
@@ -286,10 +286,10 @@ func (this *CloudWatchWorker) Work(ctx context.Context, task *Task) *Task {
 		}
 	} else {
 		task.Response = &Response{
-			Error: fmt.Errorf("Unable to process request: %s", task.Request),
+			Error: fmt.Errorf("Unable to process request: %T", task.Request),
 		}
 	}
 
-	log.Debug("response: ", task.Response)
+	log.WithFields(task.logFields()).Debug("Finished request.")
 	return task
 }
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"testing"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -302,3 +303,15 @@ func setupTestEnv() {
 
 	testEnvReady = true
 }
+
+// checkReply fails the test if resp is an error, and otherwise wraps its
+// reply in a CheckResponse so tests can use the reply getters.
+func checkReply(t *testing.T, resp *Response) *schema.CheckResponse {
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	if resp.Response == nil {
+		t.Fatal("response has no reply")
+	}
+	return &schema.CheckResponse{Reply: resp.Response}
+}
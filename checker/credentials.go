@@ -0,0 +1,128 @@
+package checker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+
+	"github.com/opsee/basic/schema"
+)
+
+// DefaultCertsDir is where the runner looks for the TLS credentials that
+// checks refer to.
+const DefaultCertsDir = "/etc/opsee/certs"
+
+var credentialNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// A CertStore holds the client certificates and CA bundles that checks
+// refer to by name, so that private keys stay on the bastion and never
+// travel in a check over NSQ. The directory is laid out like pkgdata/certs:
+//
+//	<name>/<name>-cert.pem  the client certificate "name"
+//	<name>/<name>-key.pem   its private key
+//	<name>-cert.pem         the CA bundle "name"
+//
+// Files are read each time they're needed, so credentials may be rotated
+// without restarting the runner.
+type CertStore struct {
+	Dir string
+}
+
+// NewCertStore returns a store of the credentials in dir.
+func NewCertStore(dir string) *CertStore {
+	return &CertStore{Dir: dir}
+}
+
+// ValidCredentialName reports whether name may be used to refer to a client
+// certificate or CA bundle.
+func ValidCredentialName(name string) bool {
+	return credentialNameRegexp.MatchString(name) && name != "." && name != ".."
+}
+
+// ClientCertificate loads the named client certificate and its key.
+func (s *CertStore) ClientCertificate(name string) (tls.Certificate, error) {
+	if !ValidCredentialName(name) {
+		return tls.Certificate{}, fmt.Errorf("Invalid client certificate name: %q", name)
+	}
+
+	certFile := filepath.Join(s.Dir, name, name+"-cert.pem")
+	keyFile := filepath.Join(s.Dir, name, name+"-key.pem")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Error loading client certificate %s: %s", name, err)
+	}
+
+	return cert, nil
+}
+
+// CABundle loads the named CA bundle into a certificate pool.
+func (s *CertStore) CABundle(name string) (*x509.CertPool, error) {
+	if !ValidCredentialName(name) {
+		return nil, fmt.Errorf("Invalid CA bundle name: %q", name)
+	}
+
+	pem, err := ioutil.ReadFile(filepath.Join(s.Dir, name+"-cert.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("Error loading CA bundle %s: %s", name, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA bundle %s contains no certificates", name)
+	}
+
+	return pool, nil
+}
+
+// specCredentials returns the names of the client certificate and CA bundle
+// a check spec refers to.
+func specCredentials(spec interface{}) (string, string) {
+	switch s := spec.(type) {
+	case *schema.HttpCheck:
+		return s.ClientCertificate, s.CaBundle
+	case *schema.TcpCheck:
+		return s.ClientCertificate, s.CaBundle
+	case *schema.TlsCheck:
+		return s.ClientCertificate, s.CaBundle
+	case *schema.GrpcCheck:
+		return s.ClientCertificate, s.CaBundle
+	}
+
+	return "", ""
+}
+
+// Credentials loads the client certificate and CA bundle a check refers to.
+// Either name may be empty, in which case no certificate, or a nil pool, is
+// returned for it.
+func (s *CertStore) Credentials(clientCertificate, caBundle string) ([]tls.Certificate, *x509.CertPool, error) {
+	if clientCertificate == "" && caBundle == "" {
+		return nil, nil, nil
+	}
+
+	if s == nil {
+		return nil, nil, fmt.Errorf("No TLS credentials are configured on this bastion")
+	}
+
+	var certs []tls.Certificate
+	if clientCertificate != "" {
+		cert, err := s.ClientCertificate(clientCertificate)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = []tls.Certificate{cert}
+	}
+
+	var pool *x509.CertPool
+	if caBundle != "" {
+		var err error
+		pool, err = s.CABundle(caBundle)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return certs, pool, nil
+}
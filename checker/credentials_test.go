@@ -0,0 +1,304 @@
+package checker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/opsee/basic/schema"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// testCertificate issues a certificate for template, signed by parent, or
+// self-signed if parent is nil. It is valid for an hour either side of now
+// unless template sets its own validity.
+func testCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if template.NotAfter.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testCredentials writes a CA bundle "root" and client certificates "client"
+// and "other" to a new CertStore, and returns it with the TLS config of a
+// server that requires a client certificate.
+func testCredentials(t *testing.T) (*CertStore, *tls.Config, func()) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, caKey := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	server, serverKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	client, clientKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	other, otherKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      pkix.Name{CommonName: "other"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	writePEM(t, filepath.Join(dir, "root-cert.pem"), "CERTIFICATE", ca.Raw)
+	writePEM(t, filepath.Join(dir, "client", "client-cert.pem"), "CERTIFICATE", client.Raw)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "client", "client-key.pem"), "EC PRIVATE KEY", keyDER)
+	writePEM(t, filepath.Join(dir, "other", "other-cert.pem"), "CERTIFICATE", other.Raw)
+	keyDER, err = x509.MarshalECPrivateKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "other", "other-key.pem"), "EC PRIVATE KEY", keyDER)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	return NewCertStore(dir), serverConfig, func() { os.RemoveAll(dir) }
+}
+
+func TestCertStoreLoadsPkgdataCerts(t *testing.T) {
+	store := NewCertStore("../pkgdata/certs")
+
+	certs, pool, err := store.Credentials("client", "root")
+	assert.NoError(t, err)
+	assert.Len(t, certs, 1)
+	assert.NotNil(t, pool)
+}
+
+func TestCertStoreErrors(t *testing.T) {
+	store := NewCertStore("../pkgdata/certs")
+
+	for _, name := range []string{"../certs/client", "client/client", "..", ".hidden"} {
+		_, err := store.ClientCertificate(name)
+		assert.Error(t, err, name)
+		_, err = store.CABundle(name)
+		assert.Error(t, err, name)
+	}
+
+	_, _, err := store.Credentials("missing", "")
+	assert.Error(t, err)
+	_, _, err = store.Credentials("", "missing")
+	assert.Error(t, err)
+
+	var noStore *CertStore
+	certs, pool, err := noStore.Credentials("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, certs)
+	assert.Nil(t, pool)
+	_, _, err = noStore.Credentials("client", "")
+	assert.Error(t, err)
+}
+
+func TestHTTPRequestClientCertificate(t *testing.T) {
+	store, serverConfig, cleanup := testCredentials(t)
+	defer cleanup()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = serverConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	certs, pool, err := store.Credentials("client", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := &HTTPRequest{Method: "GET", URL: ts.URL, Host: "example.com", Certificates: certs, RootCAs: pool}
+	if resp := httpTestResponse(t, request); resp != nil {
+		assert.EqualValues(t, 200, resp.Code)
+		assert.Equal(t, "client", resp.Body)
+	}
+
+	// Without the client certificate the handshake fails, and without the CA
+	// bundle the server isn't trusted.
+	request = &HTTPRequest{Method: "GET", URL: ts.URL, Host: "example.com", RootCAs: pool}
+	assert.Error(t, (<-request.Do(context.Background())).Error)
+	request = &HTTPRequest{Method: "GET", URL: ts.URL, Host: "example.com", Certificates: certs}
+	assert.Error(t, (<-request.Do(context.Background())).Error)
+}
+
+func TestWebSocketRequestClientCertificates(t *testing.T) {
+	store, serverConfig, cleanup := testCredentials(t)
+	defer cleanup()
+
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.WriteMessage(websocket.TextMessage, []byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = serverConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	// Checks with different client certificates run concurrently, and each
+	// must present its own.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		name := "client"
+		if i%2 == 1 {
+			name = "other"
+		}
+		certs, pool, err := store.Credentials(name, "root")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := &HTTPRequest{
+				Method:       "GET",
+				URL:          ts.URL,
+				Host:         "example.com",
+				Headers:      []*schema.Header{{Name: "Upgrade", Values: []string{"websocket"}}},
+				Certificates: certs,
+				RootCAs:      pool,
+			}
+			if resp := httpTestResponse(t, request); resp != nil {
+				assert.EqualValues(t, 101, resp.Code)
+				assert.Equal(t, name, resp.Body)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTCPRequestClientCertificate(t *testing.T) {
+	store, serverConfig, cleanup := testCredentials(t)
+	defer cleanup()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello\n"))
+	}()
+
+	certs, pool, err := store.Credentials("client", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := &TCPRequest{
+		Address:      listener.Addr().String(),
+		Host:         "example.com",
+		Expect:       "hello",
+		TLS:          true,
+		Certificates: certs,
+		RootCAs:      pool,
+	}
+	resp := <-request.Do(context.Background())
+	assert.NoError(t, resp.Error)
+}
+
+func TestRunnerLoadsCredentials(t *testing.T) {
+	store, _, cleanup := testCredentials(t)
+	defer cleanup()
+
+	spec := TestCommonStubs{}.HTTPCheck()
+	spec.Protocol = "https"
+	spec.ClientCertificate = "client"
+	spec.CaBundle = "root"
+	check := TestCommonStubs{}.PassingCheck()
+	check.Spec = &schema.Check_HttpCheck{HttpCheck: spec}
+	targets := []*schema.Target{{Type: "instance", Id: "i-1", Address: "127.0.0.1"}}
+
+	runner := NewRunner(&schema.HttpCheck{})
+	_, err := runner.taskGroup(check, targets)
+	assert.Error(t, err)
+
+	runner.certs = store
+	tg, err := runner.taskGroup(check, targets)
+	if assert.NoError(t, err) && assert.Len(t, tg, 1) {
+		request := tg[0].Request.(*HTTPRequest)
+		assert.Len(t, request.Certificates, 1)
+		assert.NotNil(t, request.RootCAs)
+	}
+
+	spec.ClientCertificate = "nobody"
+	_, err = runner.taskGroup(check, targets)
+	assert.Error(t, err)
+}
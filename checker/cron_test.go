@@ -0,0 +1,94 @@
+package checker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseCron(t *testing.T, expression, timeZone string) *CronSchedule {
+	c, err := ParseCronSchedule(expression, timeZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expression string
+		timeZone   string
+		after      time.Time
+		next       time.Time
+	}{
+		// Nightly at 02:05 UTC.
+		{"5 2 * * *", "", time.Date(2016, 3, 1, 1, 0, 0, 0, time.UTC), time.Date(2016, 3, 1, 2, 5, 0, 0, time.UTC)},
+		{"5 2 * * *", "", time.Date(2016, 3, 1, 2, 5, 0, 0, time.UTC), time.Date(2016, 3, 2, 2, 5, 0, 0, time.UTC)},
+		// Every 5 minutes during business hours.
+		{"*/5 9-17 * * MON-FRI", "America/New_York", time.Date(2016, 3, 4, 9, 2, 30, 0, ny), time.Date(2016, 3, 4, 9, 5, 0, 0, ny)},
+		{"*/5 9-17 * * MON-FRI", "America/New_York", time.Date(2016, 3, 4, 17, 55, 0, 0, ny), time.Date(2016, 3, 7, 9, 0, 0, 0, ny)},
+		// Lists, ranges with steps and names.
+		{"0 0,12 1-10/3 jan-mar *", "", time.Date(2016, 3, 10, 12, 0, 0, 0, time.UTC), time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Day of month or day of week when both are restricted.
+		{"0 0 13 * 5", "", time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2016, 5, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", "", time.Date(2016, 5, 12, 0, 0, 0, 0, time.UTC), time.Date(2016, 5, 13, 0, 0, 0, 0, time.UTC)},
+		// Sunday is 7 as well as 0.
+		{"0 0 * * 7", "", time.Date(2016, 5, 2, 0, 0, 0, 0, time.UTC), time.Date(2016, 5, 8, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", "", time.Date(2016, 5, 2, 3, 59, 0, 0, time.UTC), time.Date(2016, 5, 2, 4, 0, 0, 0, time.UTC)},
+		{"@monthly", "", time.Date(2016, 12, 2, 0, 0, 0, 0, time.UTC), time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", "", time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// 02:30 doesn't exist when clocks go forward, so 02:30 daily runs the
+		// next day.
+		{"30 2 * * *", "America/New_York", time.Date(2016, 3, 13, 0, 0, 0, 0, ny), time.Date(2016, 3, 14, 2, 30, 0, 0, ny)},
+	}
+
+	for i, test := range tests {
+		c := mustParseCron(t, test.expression, test.timeZone)
+		assert.True(t, test.next.Equal(c.Next(test.after)), "test %d: expected %s, got %s", i, test.next, c.Next(test.after))
+	}
+}
+
+func TestCronScheduleRunsEveryHourWhenClocksGoBack(t *testing.T) {
+	c := mustParseCron(t, "0 * * * *", "America/New_York")
+
+	// 01:00 happens twice on 6 November 2016.
+	start := time.Date(2016, 11, 6, 0, 30, 0, 0, c.Location)
+	runs := []time.Time{}
+	for next := c.Next(start); len(runs) < 4; next = c.Next(next) {
+		runs = append(runs, next)
+	}
+	for i := 1; i < len(runs); i++ {
+		assert.Equal(t, time.Hour, runs[i].Sub(runs[i-1]), "run %d at %s", i, runs[i])
+	}
+}
+
+func TestCronScheduleInvalid(t *testing.T) {
+	tests := []struct {
+		expression string
+		timeZone   string
+	}{
+		{"* * * *", ""},
+		{"60 * * * *", ""},
+		{"* 24 * * *", ""},
+		{"* * 0 * *", ""},
+		{"* * * 13 *", ""},
+		{"* * * * 8", ""},
+		{"5-1 * * * *", ""},
+		{"*/0 * * * *", ""},
+		{"a * * * *", ""},
+		{"0 0 30 2 *", ""},
+		{"@fortnightly", ""},
+		{"0 0 * * *", "Mars/Olympus_Mons"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseCronSchedule(test.expression, test.timeZone)
+		assert.Error(t, err, "%q in %q", test.expression, test.timeZone)
+	}
+}
@@ -1,7 +1,6 @@
 package checker
 
 import (
-	"fmt"
 	"sync"
 	"time"
 
@@ -65,13 +64,36 @@ func (d *Dispatcher) Dispatch(ctx context.Context, tg TaskGroup) chan *Task {
 	finished := make(chan *Task, len(tg))
 	defer close(finished)
 
+	d.dispatch(ctx, tg, finished)
+	return finished
+}
+
+// Stream dispatches a TaskGroup like Dispatch, but returns immediately. Each
+// Task is sent on the returned channel as soon as it finishes, and the channel
+// is closed once every Task has finished. Cancelling the context stops
+// dispatching: Tasks not yet given to a worker finish with the context's
+// error. The channel is buffered, so a reader may stop reading at any time.
+func (d *Dispatcher) Stream(ctx context.Context, tg TaskGroup) <-chan *Task {
+	finished := make(chan *Task, len(tg))
+
+	go func() {
+		d.dispatch(ctx, tg, finished)
+		close(finished)
+	}()
+
+	return finished
+}
+
+// dispatch gives each Task to a worker, sending it to finished when it's
+// done, and returns once every Task has finished.
+func (d *Dispatcher) dispatch(ctx context.Context, tg TaskGroup, finished chan<- *Task) {
 	wg := &sync.WaitGroup{}
 
 	for _, t := range tg {
 		if dl, ok := ctx.Deadline(); ok {
-			log.WithFields(log.Fields{"request": fmt.Sprintf("%#v", t.Request)}).Debugf("deadline is: %s", dl.Sub(time.Now()).String())
+			log.WithFields(t.logFields()).Debugf("deadline is: %s", dl.Sub(time.Now()).String())
 		}
-		log.WithFields(log.Fields{"request": fmt.Sprintf("%#v", t.Request)}).Debug("Dispatching request.")
+		log.WithFields(t.logFields()).Debug("Dispatching request.")
 		metrics.GetOrRegisterCounter("task_dispatched", d.metrics).Inc(1)
 
 		select {
@@ -80,7 +102,7 @@ func (d *Dispatcher) Dispatch(ctx context.Context, tg TaskGroup) chan *Task {
 				Error: ctx.Err(),
 			}
 
-			log.WithFields(log.Fields{"request": fmt.Sprintf("%#v", t.Request)}).Debug("Request cancelled.")
+			log.WithFields(t.logFields()).Debug("Request cancelled.")
 			metrics.GetOrRegisterCounter("task_cancelled", d.metrics).Inc(1)
 			finished <- t
 		case w := <-d.workerGroups[t.Type].WorkerQueue:
@@ -89,7 +111,7 @@ func (d *Dispatcher) Dispatch(ctx context.Context, tg TaskGroup) chan *Task {
 				// We rely on the worker to correctly handle context cancellation so that it
 				// immediately returns once the context is cancelled.
 				finished <- worker.Work(ctx, task)
-				log.WithFields(log.Fields{"request": fmt.Sprintf("%#v", task.Request)}).Debug("Request finished.")
+				log.WithFields(task.logFields()).Debug("Request finished.")
 				wg.Done()
 				metrics.GetOrRegisterCounter("task_executed", d.metrics).Inc(1)
 			}(w, t)
@@ -98,6 +120,4 @@ func (d *Dispatcher) Dispatch(ctx context.Context, tg TaskGroup) chan *Task {
 
 	wg.Wait()
 	log.Debug("Successfully dispatched TaskGroup. Returning.")
-
-	return finished
 }
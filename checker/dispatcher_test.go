@@ -27,6 +27,25 @@ func (w *dispatcherTestWorkerRequest) Do(ctx context.Context) <-chan *Response {
 	}
 	return r
 }
+
+// dispatcherTestBlockingRequest doesn't finish until it's released or its
+// context is done.
+type dispatcherTestBlockingRequest struct {
+	Release chan struct{}
+}
+
+func (w *dispatcherTestBlockingRequest) Do(ctx context.Context) <-chan *Response {
+	r := make(chan *Response, 1)
+	defer close(r)
+	select {
+	case <-w.Release:
+		r <- &Response{}
+	case <-ctx.Done():
+		r <- &Response{Error: ctx.Err()}
+	}
+	return r
+}
+
 func newDispatcherTestWorker(c chan Worker) Worker {
 	return &dispatcherTestWorker{
 		WorkerQueue: c,
@@ -56,6 +75,7 @@ func (s *DispatcherTestSuite) SetupTest() {
 	s.Dispatcher = NewDispatcher()
 	s.Context = context.Background()
 	Recruiters.RegisterWorker("dispatcherTestWorkerRequest", newDispatcherTestWorker)
+	Recruiters.RegisterWorker("dispatcherTestBlockingRequest", newDispatcherTestWorker)
 	s.MultiTaskTG = TaskGroup{
 		&Task{Type: "dispatcherTestWorkerRequest", Request: &dispatcherTestWorkerRequest{1}},
 		&Task{Type: "dispatcherTestWorkerRequest", Request: &dispatcherTestWorkerRequest{2}},
@@ -145,6 +165,50 @@ func (s *DispatcherTestSuite) TestDispatcherWithCancelledContext() {
 	}
 }
 
+func (s *DispatcherTestSuite) TestStreamSendsTasksAsTheyFinish() {
+	blocking := &Task{Type: "dispatcherTestBlockingRequest", Request: &dispatcherTestBlockingRequest{make(chan struct{})}}
+	tg := TaskGroup{
+		blocking,
+		&Task{Type: "dispatcherTestWorkerRequest", Request: &dispatcherTestWorkerRequest{1}},
+	}
+
+	finished := s.Dispatcher.Stream(s.Context, tg)
+
+	select {
+	case t := <-finished:
+		assert.IsType(s.T(), new(dispatcherTestWorkerRequest), t.Request)
+		assert.NoError(s.T(), t.Response.Error)
+	case <-time.After(time.Second):
+		assert.Fail(s.T(), "Dispatcher.Stream did not send the finished task.")
+		return
+	}
+
+	close(blocking.Request.(*dispatcherTestBlockingRequest).Release)
+
+	done := TaskGroup{}
+	for ft := range finished {
+		done = append(done, ft)
+	}
+	assert.Equal(s.T(), TaskGroup{blocking}, done)
+	assert.NoError(s.T(), blocking.Response.Error)
+}
+
+func (s *DispatcherTestSuite) TestStreamCancelledContext() {
+	blocking := &Task{Type: "dispatcherTestBlockingRequest", Request: &dispatcherTestBlockingRequest{make(chan struct{})}}
+	tg := TaskGroup{blocking}
+
+	ctx, cancel := context.WithCancel(s.Context)
+	finished := s.Dispatcher.Stream(ctx, tg)
+	cancel()
+
+	done := TaskGroup{}
+	for ft := range finished {
+		done = append(done, ft)
+	}
+	assert.Len(s.T(), done, 1)
+	assert.Equal(s.T(), context.Canceled, blocking.Response.Error)
+}
+
 //
 //
 //**********************************************************************************
@@ -0,0 +1,207 @@
+package checker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/miekg/dns"
+	"github.com/opsee/basic/schema"
+	"github.com/opsee/bastion/config"
+	"golang.org/x/net/context"
+)
+
+const (
+	dnsWorkerTaskType = "DNSRequest"
+
+	// DefaultDNSServer is the VPC resolver, used when neither the check nor
+	// the bastion config (DNS_SERVER) specifies a nameserver.
+	DefaultDNSServer = "169.254.169.253"
+
+	// Time to allow for a DNS query to be answered.
+	DNSQueryTimeout = 5 * time.Second
+)
+
+// DNSRecordTypes are the record types DNS checks may query, by name.
+var DNSRecordTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"CNAME": dns.TypeCNAME,
+	"MX":    dns.TypeMX,
+	"NS":    dns.TypeNS,
+	"SRV":   dns.TypeSRV,
+	"TXT":   dns.TypeTXT,
+}
+
+func init() {
+	Recruiters.RegisterWorker(dnsWorkerTaskType, NewDNSWorker)
+}
+
+// dnsRecordType returns the record type a DNS check queries, which is A
+// unless the check names another, and whether it's one of DNSRecordTypes.
+func dnsRecordType(check *schema.DnsCheck) (uint16, bool) {
+	name := strings.ToUpper(check.RecordType)
+	if name == "" {
+		name = "A"
+	}
+	t, ok := DNSRecordTypes[name]
+	return t, ok
+}
+
+// dnsServer returns the nameserver a DNS check should query.
+func dnsServer(check *schema.DnsCheck) string {
+	if check.Server != "" {
+		return check.Server
+	}
+	if server := config.GetConfig().DnsServer; server != "" {
+		return server
+	}
+	return DefaultDNSServer
+}
+
+type DNSRequest struct {
+	Server string `json:"server"`
+	Name   string `json:"name"`
+	Type   uint16 `json:"type"`
+
+	// DNS checks don't depend on target addresses, so the tasks of targets
+	// that query the same name share a request. The query is only made once,
+	// and each task is given its own copy of the reply.
+	once  sync.Once
+	reply *Response
+}
+
+func (r *DNSRequest) Do(ctx context.Context) <-chan *Response {
+	respChan := make(chan *Response, 1)
+
+	go func() {
+		defer close(respChan)
+		r.once.Do(func() {
+			r.reply = r.do(ctx)
+		})
+		respChan <- copyDNSResponse(r.reply)
+	}()
+
+	return respChan
+}
+
+func (r *DNSRequest) do(ctx context.Context) *Response {
+	server := r.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	timeout := DNSQueryTimeout
+	if dl, ok := ctx.Deadline(); ok && dl.Sub(time.Now()) < timeout {
+		timeout = dl.Sub(time.Now())
+	}
+
+	query := &dns.Msg{}
+	query.SetQuestion(dns.Fqdn(r.Name), r.Type)
+
+	// Truncated replies are retried over TCP.
+	client := &dns.Client{Net: "udp", Timeout: timeout}
+	t0 := time.Now()
+	reply, _, err := client.Exchange(query, server)
+	if err == nil && reply.Truncated {
+		client.Net = "tcp"
+		reply, _, err = client.Exchange(query, server)
+	}
+	latency := time.Since(t0)
+	if err != nil {
+		return &Response{Error: err}
+	}
+
+	dnsResponse := &schema.DnsResponse{
+		Rcode:         dnsRcodeName(reply.Rcode),
+		Answers:       make([]*schema.DnsAnswer, 0, len(reply.Answer)),
+		Authoritative: reply.Authoritative,
+		Server:        r.Server,
+		Metrics: []*schema.Metric{
+			latencyMetric("query_latency", latency),
+		},
+	}
+
+	data := make([]string, 0, len(reply.Answer))
+	for _, rr := range reply.Answer {
+		hdr := rr.Header()
+		dnsResponse.Answers = append(dnsResponse.Answers, &schema.DnsAnswer{
+			Name: hdr.Name,
+			Type: dnsTypeName(hdr.Rrtype),
+			Ttl:  hdr.Ttl,
+			Data: dnsRecordData(rr),
+		})
+		data = append(data, dnsRecordData(rr))
+	}
+	dnsResponse.Body = strings.Join(data, "\n")
+
+	return &Response{Response: &schema.CheckResponse_DnsResponse{DnsResponse: dnsResponse}}
+}
+
+// copyDNSResponse returns a copy of a DNS request's response, so that the
+// tasks sharing the request can redact their replies independently.
+func copyDNSResponse(resp *Response) *Response {
+	reply, ok := resp.Response.(*schema.CheckResponse_DnsResponse)
+	if !ok {
+		return &Response{Response: resp.Response, Error: resp.Error}
+	}
+	return &Response{
+		Response: &schema.CheckResponse_DnsResponse{DnsResponse: proto.Clone(reply.DnsResponse).(*schema.DnsResponse)},
+		Error:    resp.Error,
+	}
+}
+
+// dnsTypeName returns the mnemonic for a record type.
+func dnsTypeName(t uint16) string {
+	if name, ok := dns.TypeToString[t]; ok {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+// dnsRcodeName returns the mnemonic for a response code.
+func dnsRcodeName(rcode int) string {
+	if name, ok := dns.RcodeToString[rcode]; ok {
+		return name
+	}
+	return strconv.Itoa(rcode)
+}
+
+// dnsRecordData returns a record's data in presentation format: addresses for
+// A and AAAA, names for CNAME and NS, "preference exchange" for MX, "priority
+// weight port target" for SRV and the concatenated strings for TXT records.
+func dnsRecordData(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A.String()
+	case *dns.AAAA:
+		return rr.AAAA.String()
+	case *dns.CNAME:
+		return rr.Target
+	case *dns.NS:
+		return rr.Ns
+	case *dns.MX:
+		return fmt.Sprintf("%d %s", rr.Preference, rr.Mx)
+	case *dns.SRV:
+		return fmt.Sprintf("%d %d %d %s", rr.Priority, rr.Weight, rr.Port, rr.Target)
+	case *dns.TXT:
+		return strings.Join(rr.Txt, "")
+	}
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+func (r *DNSRequest) logFields() log.Fields {
+	return log.Fields{"server": r.Server, "name": r.Name, "type": r.Type}
+}
+
+func NewDNSWorker(queue chan Worker) Worker {
+	return newRequestWorker(queue, func(r Request) bool {
+		_, ok := r.(*DNSRequest)
+		return ok
+	})
+}
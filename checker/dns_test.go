@@ -0,0 +1,118 @@
+package checker
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/opsee/basic/schema"
+	testnet "github.com/opsee/bastion/testing/net"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestDNSRequestReturnsAnswers(t *testing.T) {
+	server := testnet.NewDNSServer(t,
+		"db.internal. 60 IN A 10.0.1.5",
+		"db.internal. 60 IN A 10.0.1.6",
+	)
+	defer server.Close()
+
+	request := &DNSRequest{Server: server.Addr, Name: "db.internal", Type: dns.TypeA}
+	resp := checkReply(t, <-request.Do(context.Background())).GetDnsResponse()
+
+	assert.Equal(t, "NOERROR", resp.Rcode)
+	assert.Len(t, resp.Answers, 2)
+	assert.Equal(t, &schema.DnsAnswer{Name: "db.internal.", Type: "A", Ttl: 60, Data: "10.0.1.5"}, resp.Answers[0])
+	assert.Equal(t, "10.0.1.5\n10.0.1.6", resp.Body)
+	assert.Equal(t, "query_latency", resp.Metrics[0].Name)
+}
+
+func TestDNSRequestFormatsRecordData(t *testing.T) {
+	server := testnet.NewDNSServer(t,
+		"mail.internal. 60 IN MX 10 mx1.internal.",
+		"_ldap._tcp.internal. 60 IN SRV 0 5 389 ldap.internal.",
+		`txt.internal. 60 IN TXT "v=spf1 " "-all"`,
+		"www.internal. 60 IN CNAME lb.internal.",
+		"v6.internal. 60 IN AAAA fd00::1",
+	)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		typ      string
+		expected string
+	}{
+		{"mail.internal", "MX", "10 mx1.internal."},
+		{"_ldap._tcp.internal", "SRV", "0 5 389 ldap.internal."},
+		{"txt.internal", "TXT", "v=spf1 -all"},
+		{"www.internal", "CNAME", "lb.internal."},
+		{"v6.internal", "AAAA", "fd00::1"},
+	}
+	for _, test := range tests {
+		request := &DNSRequest{Server: server.Addr, Name: test.name, Type: DNSRecordTypes[test.typ]}
+		resp := checkReply(t, <-request.Do(context.Background())).GetDnsResponse()
+		if assert.Len(t, resp.Answers, 1, test.name) {
+			assert.Equal(t, test.typ, resp.Answers[0].Type)
+			assert.Equal(t, test.expected, resp.Answers[0].Data)
+		}
+	}
+}
+
+func TestDNSRequestReportsRcode(t *testing.T) {
+	server := testnet.NewDNSServer(t)
+	defer server.Close()
+
+	request := &DNSRequest{Server: server.Addr, Name: "missing.internal", Type: dns.TypeCNAME}
+	resp := checkReply(t, <-request.Do(context.Background())).GetDnsResponse()
+
+	assert.Equal(t, "NXDOMAIN", resp.Rcode)
+	assert.Empty(t, resp.Answers)
+}
+
+func TestRunnerDispatchesDNSCheckOncePerName(t *testing.T) {
+	server := testnet.NewDNSServer(t, `example.internal. 60 IN TXT "hello"`)
+	defer server.Close()
+
+	check := TestCommonStubs{}.Check()
+	check.Spec = &schema.Check_DnsCheck{DnsCheck: &schema.DnsCheck{Name: "example.internal", RecordType: "txt", Server: server.Addr}}
+
+	targets, _ := newTestResolver().Resolve(context.Background(), &schema.Target{Id: "sg3"})
+	if len(targets) < 2 {
+		t.Fatalf("expected several targets, got %d", len(targets))
+	}
+	responses, err := NewRunner(&schema.HttpCheck{}).RunCheck(context.Background(), check, targets)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.Queries())
+
+	// Every target gets the answer, in a reply of its own.
+	if assert.Len(t, responses, len(targets)) {
+		replies := map[*schema.DnsResponse]bool{}
+		for _, response := range responses {
+			assert.Empty(t, response.Error)
+			reply := response.GetDnsResponse()
+			if assert.NotNil(t, reply) {
+				assert.Equal(t, "hello", reply.Body)
+				replies[reply] = true
+			}
+		}
+		assert.Len(t, replies, len(targets))
+	}
+}
+
+func TestRunnerDNSCheckDefaultsToARecords(t *testing.T) {
+	server := testnet.NewDNSServer(t, "example.internal. 60 IN A 10.0.1.5")
+	defer server.Close()
+
+	check := TestCommonStubs{}.Check()
+	check.Spec = &schema.Check_DnsCheck{DnsCheck: &schema.DnsCheck{Name: "example.internal", Server: server.Addr}}
+
+	targets := []*schema.Target{{Id: "i-1", Type: "instance"}}
+	responses, err := NewRunner(&schema.HttpCheck{}).RunCheck(context.Background(), check, targets)
+	assert.NoError(t, err)
+	if assert.Len(t, responses, 1) {
+		assert.Empty(t, responses[0].Error)
+		if reply := responses[0].GetDnsResponse(); assert.NotNil(t, reply) {
+			assert.Equal(t, "10.0.1.5", reply.Body)
+		}
+	}
+}
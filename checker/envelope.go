@@ -0,0 +1,258 @@
+package checker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/opsee/basic/schema"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// DefaultBatchWindow is the longest a result waits in a batch.
+	DefaultBatchWindow = time.Second
+
+	// DefaultBatchMaxPending is the most results kept while they can't be
+	// published.
+	DefaultBatchMaxPending = 10000
+
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+
+	// Envelopes are prefixed with a zero byte, which can never begin an
+	// encoded CheckResult because field number 0 is invalid, so that a
+	// consumer can accept both.
+	envelopeMagic byte = 0
+)
+
+// ResultBatch is the payload of a ResultEnvelope.
+type ResultBatch struct {
+	Results []*schema.CheckResult `protobuf:"bytes,1,rep,name=results" json:"results,omitempty"`
+}
+
+func (m *ResultBatch) Reset()         { *m = ResultBatch{} }
+func (m *ResultBatch) String() string { return proto.CompactTextString(m) }
+func (*ResultBatch) ProtoMessage()    {}
+
+// ResultEnvelope carries a batch of CheckResults in a single message on the
+// results topic.
+type ResultEnvelope struct {
+	// Compression is the encoding of the payload, either none or gzip.
+	Compression string `protobuf:"bytes,1,opt,name=compression,proto3" json:"compression,omitempty"`
+	// Payload is an encoded ResultBatch.
+	Payload []byte `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
+}
+
+func (m *ResultEnvelope) Reset()         { *m = ResultEnvelope{} }
+func (m *ResultEnvelope) String() string { return proto.CompactTextString(m) }
+func (*ResultEnvelope) ProtoMessage()    {}
+
+// MarshalResults encodes results in an envelope.
+func MarshalResults(results []*schema.CheckResult, compression string) ([]byte, error) {
+	payload, err := proto.Marshal(&ResultBatch{Results: results})
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression {
+	case CompressionNone:
+	case CompressionGzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		payload = buf.Bytes()
+	default:
+		return nil, fmt.Errorf("Unsupported compression: %s", compression)
+	}
+
+	msg, err := proto.Marshal(&ResultEnvelope{
+		Compression: compression,
+		Payload:     payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{envelopeMagic}, msg...), nil
+}
+
+// UnmarshalResults decodes a message from the results topic, which is either
+// a single CheckResult or an envelope.
+func UnmarshalResults(msg []byte) ([]*schema.CheckResult, error) {
+	if len(msg) == 0 || msg[0] != envelopeMagic {
+		result := &schema.CheckResult{}
+		if err := proto.Unmarshal(msg, result); err != nil {
+			return nil, err
+		}
+		return []*schema.CheckResult{result}, nil
+	}
+
+	envelope := &ResultEnvelope{}
+	if err := proto.Unmarshal(msg[1:], envelope); err != nil {
+		return nil, err
+	}
+
+	payload := envelope.Payload
+	switch envelope.Compression {
+	case CompressionNone:
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		payload, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported compression: %s", envelope.Compression)
+	}
+
+	batch := &ResultBatch{}
+	if err := proto.Unmarshal(payload, batch); err != nil {
+		return nil, err
+	}
+
+	return batch.Results, nil
+}
+
+// A ResultBatcher collects CheckResults and publishes them in envelopes of at
+// most MaxCount results, at least once per window. Results that can't be
+// published are kept, up to MaxPending of them, and retried a window later.
+type ResultBatcher struct {
+	MaxCount    int
+	MaxPending  int
+	Window      time.Duration
+	Compression string
+
+	publish  SpoolPublishFunc
+	registry metrics.Registry
+
+	lock    sync.Mutex
+	results []*schema.CheckResult
+	timer   *time.Timer
+	failing bool
+}
+
+func NewResultBatcher(maxCount int, window time.Duration, compression string, publish SpoolPublishFunc, registry metrics.Registry) *ResultBatcher {
+	if window <= 0 {
+		window = DefaultBatchWindow
+	}
+
+	return &ResultBatcher{
+		MaxCount:    maxCount,
+		MaxPending:  DefaultBatchMaxPending,
+		Window:      window,
+		Compression: compression,
+		publish:     publish,
+		registry:    registry,
+	}
+}
+
+// Add adds a result to the current batch, publishing the batch if it is
+// full. A batch that isn't filled is published when its window expires, as
+// are batches while publishing is failing.
+func (b *ResultBatcher) Add(result *schema.CheckResult) {
+	var results []*schema.CheckResult
+
+	b.lock.Lock()
+	b.results = append(b.results, result)
+	if len(b.results) >= b.MaxCount && !b.failing {
+		results = b.take()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.Window, b.Flush)
+	}
+	b.lock.Unlock()
+
+	b.publishResults(results)
+}
+
+// Flush publishes the current batch, if any.
+func (b *ResultBatcher) Flush() {
+	b.lock.Lock()
+	results := b.take()
+	b.lock.Unlock()
+
+	b.publishResults(results)
+}
+
+// take removes and returns the current batch. The lock must be held.
+func (b *ResultBatcher) take() []*schema.CheckResult {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	results := b.results
+	b.results = nil
+	return results
+}
+
+// publishResults publishes results in envelopes of at most MaxCount results.
+// The lock must not be held, so that results can be added while publishing.
+func (b *ResultBatcher) publishResults(results []*schema.CheckResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	for len(results) > 0 {
+		n := len(results)
+		if n > b.MaxCount {
+			n = b.MaxCount
+		}
+
+		msg, err := MarshalResults(results[:n], b.Compression)
+		if err != nil {
+			log.WithError(err).Error("Error marshaling result envelope")
+			metrics.GetOrRegisterCounter("batch_errors", b.registry).Inc(1)
+			results = results[n:]
+			continue
+		}
+
+		if err := b.publish(msg); err != nil {
+			log.WithError(err).Errorf("Error publishing envelope of %d results", n)
+			metrics.GetOrRegisterCounter("batch_errors", b.registry).Inc(1)
+			b.requeue(results)
+			return
+		}
+
+		metrics.GetOrRegisterCounter("batches_published", b.registry).Inc(1)
+		metrics.GetOrRegisterCounter("batched_results", b.registry).Inc(int64(n))
+		results = results[n:]
+	}
+
+	b.lock.Lock()
+	b.failing = false
+	b.lock.Unlock()
+}
+
+// requeue puts results that couldn't be published back ahead of the current
+// batch, to be retried when its window expires. The oldest results are
+// dropped if more than MaxPending are waiting.
+func (b *ResultBatcher) requeue(results []*schema.CheckResult) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failing = true
+	b.results = append(append([]*schema.CheckResult{}, results...), b.results...)
+	if dropped := len(b.results) - b.MaxPending; b.MaxPending > 0 && dropped > 0 {
+		log.Warnf("Dropping %d unpublished results", dropped)
+		metrics.GetOrRegisterCounter("batch_dropped_results", b.registry).Inc(int64(dropped))
+		b.results = b.results[dropped:]
+	}
+
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.Window, b.Flush)
+	}
+}
@@ -0,0 +1,189 @@
+package checker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/opsee/basic/schema"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func testResults(ids ...string) []*schema.CheckResult {
+	results := []*schema.CheckResult{}
+	for _, id := range ids {
+		results = append(results, &schema.CheckResult{
+			CheckId: id,
+			Passing: true,
+			Responses: []*schema.CheckResponse{
+				&schema.CheckResponse{
+					Target: &schema.Target{Id: "id"},
+					Reply:  &schema.CheckResponse_HttpResponse{HttpResponse: &schema.HttpResponse{Code: 200, Body: "OK"}},
+				},
+			},
+		})
+	}
+	return results
+}
+
+func TestResultEnvelopeRoundTrip(t *testing.T) {
+	results := testResults("a", "b", "c")
+
+	for _, compression := range []string{CompressionNone, CompressionGzip} {
+		msg, err := MarshalResults(results, compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := UnmarshalResults(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, decoded, 3, compression) {
+			for i := range results {
+				assert.True(t, results[i].Equal(decoded[i]), compression)
+			}
+		}
+	}
+}
+
+func TestResultEnvelopeAcceptsBareResults(t *testing.T) {
+	result := testResults("a")[0]
+	msg, err := proto.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := UnmarshalResults(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, decoded, 1) {
+		assert.True(t, result.Equal(decoded[0]))
+	}
+}
+
+func TestResultEnvelopeRejectsUnknownCompression(t *testing.T) {
+	_, err := MarshalResults(testResults("a"), "lz4")
+	assert.Error(t, err)
+}
+
+type testEnvelopePublisher struct {
+	sync.Mutex
+	msgs [][]byte
+	err  error
+}
+
+func (p *testEnvelopePublisher) publish(msg []byte) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+func (p *testEnvelopePublisher) setError(err error) {
+	p.Lock()
+	p.err = err
+	p.Unlock()
+}
+
+func (p *testEnvelopePublisher) results(t *testing.T) [][]string {
+	p.Lock()
+	defer p.Unlock()
+	batches := [][]string{}
+	for _, msg := range p.msgs {
+		results, err := UnmarshalResults(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, r := range results {
+			ids = append(ids, r.CheckId)
+		}
+		batches = append(batches, ids)
+	}
+	return batches
+}
+
+func TestResultBatcherFlushesByCount(t *testing.T) {
+	p := &testEnvelopePublisher{}
+	batcher := NewResultBatcher(2, time.Hour, CompressionGzip, p.publish, metrics.NewRegistry())
+
+	for _, result := range testResults("a", "b", "c") {
+		batcher.Add(result)
+	}
+	assert.Equal(t, [][]string{{"a", "b"}}, p.results(t))
+
+	batcher.Flush()
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}}, p.results(t))
+	assert.EqualValues(t, 3, metrics.GetOrRegisterCounter("batched_results", batcher.registry).Count())
+}
+
+func TestResultBatcherFlushesByWindow(t *testing.T) {
+	p := &testEnvelopePublisher{}
+	batcher := NewResultBatcher(10, 20*time.Millisecond, CompressionNone, p.publish, metrics.NewRegistry())
+
+	for _, result := range testResults("a", "b") {
+		batcher.Add(result)
+	}
+	assert.Empty(t, p.results(t))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, [][]string{{"a", "b"}}, p.results(t))
+}
+
+func TestResultBatcherRetriesFailedBatches(t *testing.T) {
+	p := &testEnvelopePublisher{}
+	batcher := NewResultBatcher(2, 20*time.Millisecond, CompressionNone, p.publish, metrics.NewRegistry())
+
+	p.setError(errors.New("nsqd is down"))
+	for _, result := range testResults("a", "b", "c") {
+		batcher.Add(result)
+	}
+	assert.Empty(t, p.results(t))
+	assert.EqualValues(t, 1, metrics.GetOrRegisterCounter("batch_errors", batcher.registry).Count())
+
+	p.setError(nil)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}}, p.results(t))
+}
+
+func TestResultBatcherDropsOldestPendingResults(t *testing.T) {
+	p := &testEnvelopePublisher{}
+	batcher := NewResultBatcher(2, time.Hour, CompressionNone, p.publish, metrics.NewRegistry())
+	batcher.MaxPending = 3
+
+	p.setError(errors.New("nsqd is down"))
+	for _, result := range testResults("a", "b", "c", "d") {
+		batcher.Add(result)
+	}
+	batcher.Flush()
+	assert.EqualValues(t, 1, metrics.GetOrRegisterCounter("batch_dropped_results", batcher.registry).Count())
+
+	p.setError(nil)
+	batcher.Flush()
+	assert.Equal(t, [][]string{{"b", "c"}, {"d"}}, p.results(t))
+}
+
+func TestResultBatcherPublishesWithoutLock(t *testing.T) {
+	var batcher *ResultBatcher
+	locked := false
+	publish := func(msg []byte) error {
+		if batcher.lock.TryLock() {
+			batcher.lock.Unlock()
+		} else {
+			locked = true
+		}
+		return nil
+	}
+	batcher = NewResultBatcher(1, time.Hour, CompressionNone, publish, metrics.NewRegistry())
+
+	batcher.Add(testResults("a")[0])
+	assert.False(t, locked)
+}
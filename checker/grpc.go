@@ -0,0 +1,132 @@
+package checker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/opsee/basic/schema"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	grpcWorkerTaskType = "GRPCRequest"
+
+	// The standard gRPC health checking method.
+	grpcHealthCheckMethod = "/grpc.health.v1.Health/Check"
+)
+
+// HealthCheckRequest and HealthCheckResponse are the grpc.health.v1 messages.
+type HealthCheckRequest struct {
+	Service string `protobuf:"bytes,1,opt,name=service,proto3" json:"service,omitempty"`
+}
+
+func (m *HealthCheckRequest) Reset()         { *m = HealthCheckRequest{} }
+func (m *HealthCheckRequest) String() string { return proto.CompactTextString(m) }
+func (*HealthCheckRequest) ProtoMessage()    {}
+
+type HealthCheckResponse struct {
+	Status int32 `protobuf:"varint,1,opt,name=status,proto3" json:"status,omitempty"`
+}
+
+func (m *HealthCheckResponse) Reset()         { *m = HealthCheckResponse{} }
+func (m *HealthCheckResponse) String() string { return proto.CompactTextString(m) }
+func (*HealthCheckResponse) ProtoMessage()    {}
+
+var grpcServingStatus = map[int32]string{
+	0: "UNKNOWN",
+	1: "SERVING",
+	2: "NOT_SERVING",
+	3: "SERVICE_UNKNOWN",
+}
+
+func init() {
+	Recruiters.RegisterWorker(grpcWorkerTaskType, NewGRPCWorker)
+}
+
+type GRPCRequest struct {
+	Address            string `json:"address"`
+	Host               string `json:"host"`
+	Service            string `json:"service"`
+	TLS                bool   `json:"tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// Certificates are presented to servers that ask for a client
+	// certificate, and RootCAs verifies the server. The system pool is
+	// used if RootCAs is nil.
+	Certificates []tls.Certificate `json:"-"`
+	RootCAs      *x509.CertPool    `json:"-"`
+}
+
+func (r *GRPCRequest) Do(ctx context.Context) <-chan *Response {
+	respChan := make(chan *Response, 1)
+
+	go func() {
+		defer close(respChan)
+		respChan <- r.do(ctx)
+	}()
+
+	return respChan
+}
+
+func (r *GRPCRequest) do(ctx context.Context) *Response {
+	timeout := TCPConnectTimeout
+	if dl, ok := ctx.Deadline(); ok && dl.Sub(time.Now()) < timeout {
+		timeout = dl.Sub(time.Now())
+	}
+
+	opts := []grpc.DialOption{grpc.WithBlock(), grpc.WithTimeout(timeout)}
+	if r.TLS {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			ServerName:         r.Host,
+			InsecureSkipVerify: r.InsecureSkipVerify,
+			Certificates:       r.Certificates,
+			RootCAs:            r.RootCAs,
+		})))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	t0 := time.Now()
+	conn, err := grpc.Dial(r.Address, opts...)
+	if err != nil {
+		return &Response{Error: err}
+	}
+	defer conn.Close()
+
+	// Unlike a failed dial, a failed call is a response from the server, so
+	// it is reported in the reply rather than as an error.
+	healthResponse := &HealthCheckResponse{}
+	err = grpc.Invoke(ctx, grpcHealthCheckMethod, &HealthCheckRequest{Service: r.Service}, healthResponse, conn)
+
+	grpcResponse := &schema.GrpcResponse{
+		Status:  grpcServingStatus[healthResponse.Status],
+		Code:    grpc.Code(err).String(),
+		Message: grpc.ErrorDesc(err),
+		Host:    r.Host,
+		Metrics: []*schema.Metric{
+			latencyMetric("request_latency", time.Since(t0)),
+		},
+	}
+	if err == nil {
+		grpcResponse.Code = codes.OK.String()
+		grpcResponse.Message = ""
+	}
+
+	return &Response{Response: &schema.CheckResponse_GrpcResponse{GrpcResponse: grpcResponse}}
+}
+
+func (r *GRPCRequest) logFields() log.Fields {
+	return log.Fields{"address": r.Address, "service": r.Service}
+}
+
+func NewGRPCWorker(queue chan Worker) Worker {
+	return newRequestWorker(queue, func(r Request) bool {
+		_, ok := r.(*GRPCRequest)
+		return ok
+	})
+}
@@ -0,0 +1,92 @@
+package checker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+type healthServer interface {
+	Check(context.Context, *HealthCheckRequest) (*HealthCheckResponse, error)
+}
+
+type testHealthServer struct {
+	statuses map[string]int32
+}
+
+func (s *testHealthServer) Check(ctx context.Context, req *HealthCheckRequest) (*HealthCheckResponse, error) {
+	status, ok := s.statuses[req.Service]
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service %s", req.Service)
+	}
+	return &HealthCheckResponse{Status: status}, nil
+}
+
+var testHealthServiceDesc = grpc.ServiceDesc{
+	ServiceName: "grpc.health.v1.Health",
+	HandlerType: (*healthServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(HealthCheckRequest)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return srv.(healthServer).Check(ctx, in)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func grpcTestServer(t *testing.T) (net.Listener, *grpc.Server) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	server.RegisterService(&testHealthServiceDesc, &testHealthServer{
+		statuses: map[string]int32{"": 1, "db": 2},
+	})
+	go server.Serve(l)
+	return l, server
+}
+
+func TestGRPCRequestServing(t *testing.T) {
+	l, server := grpcTestServer(t)
+	defer server.Stop()
+
+	request := &GRPCRequest{Address: l.Addr().String()}
+	resp := checkReply(t, <-request.Do(context.Background())).GetGrpcResponse()
+
+	assert.Equal(t, "SERVING", resp.Status)
+	assert.Equal(t, "OK", resp.Code)
+	assert.Equal(t, "request_latency", resp.Metrics[0].Name)
+}
+
+func TestGRPCRequestNotServing(t *testing.T) {
+	l, server := grpcTestServer(t)
+	defer server.Stop()
+
+	request := &GRPCRequest{Address: l.Addr().String(), Service: "db"}
+	resp := checkReply(t, <-request.Do(context.Background())).GetGrpcResponse()
+
+	assert.Equal(t, "NOT_SERVING", resp.Status)
+}
+
+func TestGRPCRequestReportsStatusCode(t *testing.T) {
+	l, server := grpcTestServer(t)
+	defer server.Stop()
+
+	request := &GRPCRequest{Address: l.Addr().String(), Service: "cache"}
+	resp := checkReply(t, <-request.Do(context.Background())).GetGrpcResponse()
+
+	assert.Equal(t, "NotFound", resp.Code)
+	assert.Equal(t, "unknown service cache", resp.Message)
+	assert.Equal(t, "UNKNOWN", resp.Status)
+}
@@ -4,14 +4,17 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -24,6 +27,28 @@ const (
 	httpWorkerTaskType = "HTTPRequest"
 )
 
+// HTTP check redirect policies.
+const (
+	// RedirectPolicyNone doesn't follow redirects, so that checks assert on
+	// the redirect itself. It's the default.
+	RedirectPolicyNone = "none"
+	// RedirectPolicySameHost follows redirects to the same host name, such
+	// as from HTTP to HTTPS.
+	RedirectPolicySameHost = "same-host"
+	// RedirectPolicyAny follows every redirect.
+	RedirectPolicyAny = "any"
+
+	// DefaultMaxRedirects is the most redirects followed by a check that
+	// doesn't set a maximum.
+	DefaultMaxRedirects = 10
+)
+
+// defaultPorts are the ports of URLs without one, by scheme.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
 // HTTPRequest and HTTPResponse leave their bodies as strings to make life
 // easier for now. As soon as we move away from JSON, these should be []byte.
 
@@ -34,12 +59,105 @@ type HTTPRequest struct {
 	Headers            []*schema.Header `json:"headers"`
 	Body               string           `json:"body"`
 	InsecureSkipVerify bool             `json:"insecure_skip_verify"`
+	RedirectPolicy     string           `json:"redirect_policy"`
+	MaxRedirects       int              `json:"max_redirects"`
+	// Certificates are presented to servers that ask for a client
+	// certificate, and RootCAs verifies the server. The system pool is
+	// used if RootCAs is nil.
+	Certificates []tls.Certificate `json:"-"`
+	RootCAs      *x509.CertPool    `json:"-"`
 }
 
 func init() {
 	Recruiters.RegisterWorker(httpWorkerTaskType, NewHTTPWorker)
 }
 
+// httpTimings records when each phase of an HTTP request happens, so that a
+// slow check can be attributed to DNS, connecting, the TLS handshake, the
+// server or the body transfer. The trace hooks may be called concurrently
+// when dialing several addresses.
+type httpTimings struct {
+	lock         sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	bodyRead     time.Time
+}
+
+// record sets a timing if it hasn't been set already, so that only the first
+// of several attempts at a phase starts it.
+func (t *httpTimings) record(at *time.Time) {
+	t.lock.Lock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+	t.lock.Unlock()
+}
+
+// trace returns the httptrace hooks that record the request's timings.
+func (t *httpTimings) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { t.record(&t.dnsStart) },
+		DNSDone:      func(httptrace.DNSDoneInfo) { t.record(&t.dnsDone) },
+		ConnectStart: func(_, _ string) { t.record(&t.connectStart) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				t.record(&t.connectDone)
+			}
+		},
+		TLSHandshakeStart: func() { t.record(&t.tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				t.record(&t.tlsDone)
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.record(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.record(&t.firstByte) },
+	}
+}
+
+// metrics returns the duration of each phase of the request in milliseconds.
+// Phases that didn't happen, such as DNS for an IP address or the TLS
+// handshake for plain HTTP, take no time.
+func (t *httpTimings) metrics() []*schema.Metric {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	phase := func(name string, start, end time.Time) *schema.Metric {
+		value := 0.0
+		if !start.IsZero() && !end.IsZero() {
+			value = end.Sub(start).Seconds() * 1000
+		}
+		return &schema.Metric{
+			Name:  name,
+			Value: value,
+			Unit:  "ms",
+		}
+	}
+
+	// Server processing starts once the request is written, or at the
+	// start if the trace missed it.
+	serverStart := t.wroteRequest
+	if serverStart.IsZero() {
+		serverStart = t.start
+	}
+
+	return []*schema.Metric{
+		phase("dns", t.dnsStart, t.dnsDone),
+		phase("connect", t.connectStart, t.connectDone),
+		phase("tls_handshake", t.tlsStart, t.tlsDone),
+		phase("ttfb", serverStart, t.firstByte),
+		phase("body_read", t.firstByte, t.bodyRead),
+		phase("total", t.start, t.bodyRead),
+	}
+}
+
 func (r *HTTPRequest) isWebSocketRequest() bool {
 	url, err := url.Parse(r.URL)
 	if err != nil {
@@ -68,9 +186,13 @@ func (r *HTTPRequest) doWebSocket() *Response {
 	tlsConfig := &tls.Config{
 		ServerName:         r.Host,
 		InsecureSkipVerify: r.InsecureSkipVerify,
+		Certificates:       r.Certificates,
+		RootCAs:            r.RootCAs,
 	}
 
-	dialer := websocket.DefaultDialer
+	// Copy the default dialer rather than configuring it, since checks with
+	// different credentials run concurrently.
+	dialer := *websocket.DefaultDialer
 	dialer.TLSClientConfig = tlsConfig
 	dialer.HandshakeTimeout = 10 * time.Second
 
@@ -182,170 +304,340 @@ func (r *HTTPRequest) Do(ctx context.Context) <-chan *Response {
 			return
 		}
 
-		tlsConfig := &tls.Config{
-			ServerName:         r.Host,
-			InsecureSkipVerify: r.InsecureSkipVerify,
-		}
+		respChan <- r.doHTTP()
+	}()
 
-		client := &http.Client{
-			CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
-				return errors.New("Not following redirect.")
-			},
-			Transport: &http.Transport{
-				TLSClientConfig:       tlsConfig,
-				ResponseHeaderTimeout: 30 * time.Second,
-				Dial: (&net.Dialer{
-					Timeout: 15 * time.Second,
-				}).Dial,
-			},
-		}
+	return respChan
+}
 
-		req, err := http.NewRequest(r.Method, r.URL, strings.NewReader(r.Body))
+// doHTTP makes the request, following redirects as the redirect policy
+// allows, and reads the final response. The phase timings are those of the
+// final request, while request_latency covers every redirect.
+func (r *HTTPRequest) doHTTP() *Response {
+	t0 := time.Now()
+	redirects := []*schema.Redirect{}
+
+	hop := r
+	for {
+		resp, timings, cancel, err := hop.send()
 		if err != nil {
-			respChan <- &Response{Error: err}
-			return
+			return &Response{Error: err}
 		}
 
-		// Close the connection after we're done. It's the polite thing to do.
-		req.Close = true
-		// Give ourselves an out if we have to cancel the request. Close this
-		// to cancel.
-		cancelChannel := make(chan struct{})
-		cancel := func() { close(cancelChannel) }
-		req.Cancel = cancelChannel
-
-		for _, header := range r.Headers {
-			key := header.Name
-
-			// we have to special case the host header, since the go client
-			// wants that in req.Host
-			if strings.ToLower(key) == "host" && len(header.Values) > 0 {
-				req.Host = header.Values[0]
-			}
-
-			for _, value := range header.Values {
-				req.Header.Add(key, value)
-			}
+		next, err := hop.redirect(resp)
+		if err != nil {
+			resp.Body.Close()
+			return &Response{Error: err}
 		}
-
-		// if we have set the host explicity, override any user-provided host
-		if r.Host != "" {
-			req.Host = r.Host
-			req.Header.Set("Host", r.Host)
+		if next == nil {
+			return r.readResponse(resp, timings, cancel, t0, redirects)
 		}
 
-		t0 := time.Now()
-		// If the http client returns a non-nil response and a non-nil
-		// error, then it may be a redirect. We test.
-		resp, err := client.Do(req)
-		if resp == nil && err != nil {
-			respChan <- &Response{Error: err}
-			return
+		resp.Body.Close()
+		if len(redirects) >= r.maxRedirects() {
+			return &Response{Error: fmt.Errorf("Stopped after %d redirects", len(redirects))}
 		}
 
-		defer resp.Body.Close()
+		redirects = append(redirects, &schema.Redirect{
+			Url:  next.logicalURL(),
+			Code: int32(resp.StatusCode),
+		})
+		log.WithFields(log.Fields{"url": hop.URL, "location": next.URL, "host": next.Host, "code": resp.StatusCode}).Debug("Following redirect.")
+		hop = next
+	}
+}
 
-		if resp.StatusCode < 300 && resp.StatusCode > 399 && err != nil {
-			respChan <- &Response{Error: err}
-			return
+// send makes the request without following redirects. Calling cancel aborts
+// reading the response body.
+func (r *HTTPRequest) send() (*http.Response, *httpTimings, func(), error) {
+	tlsConfig := &tls.Config{
+		ServerName:         r.Host,
+		InsecureSkipVerify: r.InsecureSkipVerify,
+		Certificates:       r.Certificates,
+		RootCAs:            r.RootCAs,
+	}
+
+	client := &http.Client{
+		// Redirects are followed by doHTTP, since each hop may need its
+		// own host and TLS configuration.
+		CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{
+			TLSClientConfig:       tlsConfig,
+			ResponseHeaderTimeout: 30 * time.Second,
+			DialContext: (&net.Dialer{
+				Timeout: 15 * time.Second,
+			}).DialContext,
+		},
+	}
+
+	req, err := http.NewRequest(r.Method, r.URL, strings.NewReader(r.Body))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Close the connection after we're done. It's the polite thing to do.
+	req.Close = true
+	// Give ourselves an out if we have to cancel the request. Close this
+	// to cancel.
+	cancelChannel := make(chan struct{})
+	cancel := func() { close(cancelChannel) }
+	req.Cancel = cancelChannel
+
+	for _, header := range r.Headers {
+		key := header.Name
+
+		// we have to special case the host header, since the go client
+		// wants that in req.Host
+		if strings.ToLower(key) == "host" && len(header.Values) > 0 {
+			req.Host = header.Values[0]
 		}
 
-		log.Debug("Attempting to read body of response...")
-		// WARNING: You cannot do this.
-		//
-		// 	body, err := ioutil.ReadAll(resp.Body)
-		//
-		// We absolutely must limit the size of the body in the response or we will
-		// end up using up too much memory. There is no telling how large the bodies
-		// could be. If we need to address exceptionally large HTTP bodies, then we
-		// can do that in the future.
-		//
-		// For a breakdown of potential messaging costs, see:
-		// https://docs.google.com/a/opsee.co/spreadsheets/d/14Y8DvBkJMhIQoZ11C5_GKeB7NknYyt-fHJaQixkJfKs/edit?usp=sharing
-
-		rdr := bufio.NewReader(resp.Body)
-		var contentLength int64
-
-		if resp.ContentLength >= 0 && resp.ContentLength <= MaxContentLength {
-			contentLength = resp.ContentLength
-		} else {
-			contentLength = MaxContentLength
+		for _, value := range header.Values {
+			req.Header.Add(key, value)
 		}
+	}
 
-		log.WithFields(log.Fields{"Content-Length": resp.ContentLength, "contentLength": contentLength}).Debug("Setting content length.")
-		body := make([]byte, int64(contentLength))
-
-		// ContentLength is unknown.  read what we can
-		if resp.ContentLength == -1 {
-			// If the server does not close the connection and there is no Content-Length header,
-			// then the HTTP Client will block indefinitely when trying to read the response body.
-			// So, we have to wrap this in a timeout and cancel the request in order to continue.
-			var (
-				numBytes int
-				err      error
-			)
-			done := make(chan struct{}, 1)
-
-			go func() {
-				numBytes, err = rdr.Read(body)
-				close(done)
-			}()
-
-			timer := time.NewTimer(BodyReadTimeout)
-			select {
-			case <-timer.C:
-				// Calling cancel() here will thread through the http request causing the
-				// response Body ReadCloser to be closed. The above goroutine will
-				// receive an error in the call to Read(body) and then return, closing
-				// the done channel, BUT IT WILL BE TOO LATE BWAHAHA
-				cancel()
-				err = errors.New("Timed out waiting to read body.")
-			case <-done:
-				// Just continue, really.
-				err = nil
-			}
-			timer.Stop()
+	// if we have set the host explicity, override any user-provided host
+	if r.Host != "" {
+		req.Host = r.Host
+		req.Header.Set("Host", r.Host)
+	}
 
-			if err != nil {
-				log.WithFields(log.Fields{"url": r.URL, "method": r.Method}).WithError(err).Error("Error while reading message body.")
-			}
+	timings := &httpTimings{}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timings.trace()))
 
-			body = bytes.Trim(body, "\x00")
-			log.Debugf("Successfully read %i bytes...", numBytes)
-		} else {
-			body, err = ioutil.ReadAll(io.LimitReader(resp.Body, contentLength)) // read all
-			if err != nil {
-				log.WithFields(log.Fields{"url": r.URL, "method": r.Method}).WithError(err).Error("Error while reading message body.")
+	timings.start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return resp, timings, cancel, nil
+}
+
+// maxRedirects returns the most redirects that may be followed.
+func (r *HTTPRequest) maxRedirects() int {
+	if r.MaxRedirects > 0 {
+		return r.MaxRedirects
+	}
+	return DefaultMaxRedirects
+}
+
+// logicalURL returns the URL as the server sees it, with the host override in
+// place of the address dialed.
+func (r *HTTPRequest) logicalURL() string {
+	u, err := url.Parse(r.URL)
+	if err != nil || r.Host == "" {
+		return r.URL
+	}
+
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(r.Host, port)
+	} else {
+		u.Host = r.Host
+	}
+	return u.String()
+}
+
+// redirect returns the request that follows a redirect response, or nil if
+// the response isn't a redirect or the redirect policy doesn't allow
+// following it.
+//
+// A redirect to the same host keeps dialing the same address with the same
+// host override and certificate verification, so that relative redirects and
+// redirects from HTTP to HTTPS work for host targets. A redirect to another
+// host is made to that host by name and its certificate is always verified,
+// since the override no longer applies. Credentials, including the client
+// certificate, aren't sent to another host, and its certificate is verified
+// against the system roots rather than the check's CA bundle.
+func (r *HTTPRequest) redirect(resp *http.Response) (*HTTPRequest, error) {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, nil
+	}
+
+	if r.RedirectPolicy == "" || r.RedirectPolicy == RedirectPolicyNone {
+		return nil, nil
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, nil
+	}
+
+	dialed, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(r.logicalURL())
+	if err != nil {
+		return nil, err
+	}
+	target, err := base.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid redirect location %q: %s", location, err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported redirect location: %s", target)
+	}
+
+	sameHost := strings.EqualFold(target.Hostname(), base.Hostname())
+	if r.RedirectPolicy == RedirectPolicySameHost && !sameHost {
+		return nil, nil
+	}
+
+	next := &HTTPRequest{
+		Method:             r.Method,
+		URL:                target.String(),
+		Body:               r.Body,
+		InsecureSkipVerify: r.InsecureSkipVerify,
+		RedirectPolicy:     r.RedirectPolicy,
+		MaxRedirects:       r.MaxRedirects,
+	}
+
+	// Like browsers, 301, 302 and 303 redirects are followed with a GET.
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if r.Method != "GET" && r.Method != "HEAD" {
+			next.Method = "GET"
+			next.Body = ""
+		}
+	}
+
+	if sameHost {
+		next.Headers = r.Headers
+		next.Certificates = r.Certificates
+		next.RootCAs = r.RootCAs
+		if r.Host != "" {
+			port := target.Port()
+			if port == "" {
+				port = defaultPorts[target.Scheme]
 			}
+			address := *target
+			address.Host = net.JoinHostPort(dialed.Hostname(), port)
+			next.URL = address.String()
+			next.Host = r.Host
 		}
-		body = bytes.TrimSuffix(body, []byte("\n"))
+		return next, nil
+	}
 
-		httpResponse := &schema.HttpResponse{
-			Code: int32(resp.StatusCode),
-			Body: string(body),
-			Metrics: []*schema.Metric{
-				&schema.Metric{
-					Name:  "request_latency",
-					Value: time.Since(t0).Seconds() * 1000,
-					Unit:  "ms",
-				},
-			},
-			Headers: []*schema.Header{},
+	next.InsecureSkipVerify = false
+	for _, h := range r.Headers {
+		switch strings.ToLower(h.Name) {
+		case "host", "authorization", "www-authenticate", "cookie", "cookie2":
+		default:
+			next.Headers = append(next.Headers, h)
 		}
+	}
+	return next, nil
+}
+
+// readResponse reads the body of the final response of a request.
+func (r *HTTPRequest) readResponse(resp *http.Response, timings *httpTimings, cancel func(), t0 time.Time, redirects []*schema.Redirect) *Response {
+	defer resp.Body.Close()
+
+	log.Debug("Attempting to read body of response...")
+	// WARNING: You cannot do this.
+	//
+	// 	body, err := ioutil.ReadAll(resp.Body)
+	//
+	// We absolutely must limit the size of the body in the response or we will
+	// end up using up too much memory. There is no telling how large the bodies
+	// could be. If we need to address exceptionally large HTTP bodies, then we
+	// can do that in the future.
+	//
+	// For a breakdown of potential messaging costs, see:
+	// https://docs.google.com/a/opsee.co/spreadsheets/d/14Y8DvBkJMhIQoZ11C5_GKeB7NknYyt-fHJaQixkJfKs/edit?usp=sharing
+
+	rdr := bufio.NewReader(resp.Body)
+	var contentLength int64
+
+	if resp.ContentLength >= 0 && resp.ContentLength <= MaxContentLength {
+		contentLength = resp.ContentLength
+	} else {
+		contentLength = MaxContentLength
+	}
 
-		for k, v := range resp.Header {
-			header := &schema.Header{}
-			header.Name = k
-			header.Values = v
-			httpResponse.Headers = append(httpResponse.Headers, header)
+	log.WithFields(log.Fields{"Content-Length": resp.ContentLength, "contentLength": contentLength}).Debug("Setting content length.")
+	body := make([]byte, int64(contentLength))
+
+	// ContentLength is unknown.  read what we can
+	if resp.ContentLength == -1 {
+		// If the server does not close the connection and there is no Content-Length header,
+		// then the HTTP Client will block indefinitely when trying to read the response body.
+		// So, we have to wrap this in a timeout and cancel the request in order to continue.
+		var (
+			numBytes int
+			err      error
+		)
+		done := make(chan struct{}, 1)
+
+		go func() {
+			numBytes, err = rdr.Read(body)
+			close(done)
+		}()
+
+		timer := time.NewTimer(BodyReadTimeout)
+		select {
+		case <-timer.C:
+			// Calling cancel() here will thread through the http request causing the
+			// response Body ReadCloser to be closed. The above goroutine will
+			// receive an error in the call to Read(body) and then return, closing
+			// the done channel, BUT IT WILL BE TOO LATE BWAHAHA
+			cancel()
+			err = errors.New("Timed out waiting to read body.")
+		case <-done:
+			// Just continue, really.
+			err = nil
 		}
+		timer.Stop()
 
-		respChan <- &Response{
-			Response: &schema.CheckResponse_HttpResponse{httpResponse},
+		if err != nil {
+			log.WithFields(log.Fields{"url": r.URL, "method": r.Method}).WithError(err).Error("Error while reading message body.")
 		}
-	}()
 
-	return respChan
+		body = bytes.Trim(body, "\x00")
+		log.Debugf("Successfully read %i bytes...", numBytes)
+	} else {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(resp.Body, contentLength)) // read all
+		if err != nil {
+			log.WithFields(log.Fields{"url": r.URL, "method": r.Method}).WithError(err).Error("Error while reading message body.")
+		}
+	}
+	body = bytes.TrimSuffix(body, []byte("\n"))
+	timings.record(&timings.bodyRead)
+
+	httpResponse := &schema.HttpResponse{
+		Code: int32(resp.StatusCode),
+		Body: string(body),
+		Metrics: append([]*schema.Metric{
+			&schema.Metric{
+				Name:  "request_latency",
+				Value: time.Since(t0).Seconds() * 1000,
+				Unit:  "ms",
+			},
+		}, timings.metrics()...),
+		Headers: []*schema.Header{},
+	}
+
+	if len(redirects) > 0 {
+		httpResponse.Redirects = redirects
+	}
+
+	for k, v := range resp.Header {
+		header := &schema.Header{}
+		header.Name = k
+		header.Values = v
+		httpResponse.Headers = append(httpResponse.Headers, header)
+	}
+
+	return &Response{
+		Response: &schema.CheckResponse_HttpResponse{httpResponse},
+	}
 }
 
 type HTTPWorker struct {
@@ -372,12 +664,11 @@ func (w *HTTPWorker) Work(ctx context.Context, task *Task) *Task {
 
 	request, ok := task.Request.(*HTTPRequest)
 	if ok {
-		log.Debug("request: ", request)
+		log.WithFields(log.Fields{"method": request.Method, "host": request.Host}).Debug("HTTP request")
 		select {
 		case response := <-request.Do(ctx):
 			if response.Error != nil {
-				log.Error("error processing request: %s", *task)
-				log.Error("error: %s", response.Error.Error())
+				log.WithError(response.Error).Errorf("error processing request: %s", request.Host)
 			}
 			task.Response = response
 		case <-ctx.Done():
@@ -388,10 +679,10 @@ func (w *HTTPWorker) Work(ctx context.Context, task *Task) *Task {
 
 	} else {
 		task.Response = &Response{
-			Error: fmt.Errorf("Unable to process request: %s", task.Request),
+			Error: fmt.Errorf("Unable to process request: %T", task.Request),
 		}
 	}
 
-	log.Debug("response: ", task.Response)
+	log.WithFields(task.logFields()).Debug("Finished request.")
 	return task
 }
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/opsee/basic/schema"
@@ -146,3 +147,218 @@ func GenerateRandomString(s int) (string, error) {
 	b, err := GenerateRandomBytes(s)
 	return base64.URLEncoding.EncodeToString(b), err
 }
+
+func httpResponseMetrics(t *testing.T, resp *Response) map[string]float64 {
+	assert.NoError(t, resp.Error)
+	response, ok := resp.Response.(*schema.CheckResponse_HttpResponse)
+	if !assert.True(t, ok) {
+		return nil
+	}
+
+	metrics := map[string]float64{}
+	for _, metric := range response.HttpResponse.Metrics {
+		assert.Equal(t, "ms", metric.Unit)
+		metrics[metric.Name] = metric.Value
+	}
+	return metrics
+}
+
+func TestResponseTimings(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintln(w, "ok")
+	}))
+	defer ts.Close()
+
+	// Use a host name so that the request resolves it.
+	url := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+	requestMaker := &HTTPRequest{Method: "GET", URL: url}
+	metrics := httpResponseMetrics(t, <-requestMaker.Do(context.Background()))
+
+	for _, name := range []string{"request_latency", "dns", "connect", "tls_handshake", "ttfb", "body_read", "total"} {
+		assert.Contains(t, metrics, name)
+	}
+	assert.True(t, metrics["dns"] > 0)
+	assert.True(t, metrics["connect"] > 0)
+	assert.Zero(t, metrics["tls_handshake"])
+	assert.True(t, metrics["ttfb"] >= 20)
+	assert.True(t, metrics["total"] >= metrics["ttfb"])
+}
+
+func TestResponseTimingsTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	}))
+	defer ts.Close()
+
+	requestMaker := &HTTPRequest{Method: "GET", URL: ts.URL, InsecureSkipVerify: true}
+	metrics := httpResponseMetrics(t, <-requestMaker.Do(context.Background()))
+
+	// The URL is an IP address, so there's no DNS lookup.
+	assert.Zero(t, metrics["dns"])
+	assert.True(t, metrics["tls_handshake"] > 0)
+	assert.True(t, metrics["total"] >= metrics["connect"]+metrics["tls_handshake"])
+}
+
+func httpTestResponse(t *testing.T, request *HTTPRequest) *schema.HttpResponse {
+	resp := <-request.Do(context.Background())
+	if !assert.NoError(t, resp.Error) {
+		return nil
+	}
+	response, ok := resp.Response.(*schema.CheckResponse_HttpResponse)
+	if !assert.True(t, ok) {
+		return nil
+	}
+	return response.HttpResponse
+}
+
+// serverPort returns the port of a test server.
+func serverPort(ts *httptest.Server) string {
+	return ts.URL[strings.LastIndex(ts.URL, ":")+1:]
+}
+
+func TestRedirectSameHost(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "example.com", r.Host)
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		case "/new":
+			assert.Equal(t, "token", r.Header.Get("Authorization"))
+			fmt.Fprint(w, "new")
+		}
+	}))
+	defer ts.Close()
+
+	response := httpTestResponse(t, &HTTPRequest{
+		Method:         "GET",
+		URL:            ts.URL + "/old",
+		Host:           "example.com",
+		Headers:        []*schema.Header{{Name: "Authorization", Values: []string{"token"}}},
+		RedirectPolicy: RedirectPolicySameHost,
+	})
+	if response == nil {
+		return
+	}
+
+	assert.EqualValues(t, 200, response.Code)
+	assert.Equal(t, "new", response.Body)
+	assert.Equal(t, []*schema.Redirect{
+		{Url: "http://example.com:" + serverPort(ts) + "/new", Code: 301},
+	}, response.Redirects)
+
+	reply, err := replyJSON(&schema.CheckResponse{Reply: &schema.CheckResponse_HttpResponse{HttpResponse: response}})
+	assert.NoError(t, err)
+	passing, _, err := EvaluateAssertions([]*schema.Assertion{
+		{Key: "redirects[0].code", Relationship: "equal", Operand: "301"},
+		{Key: "redirects[0].url", Relationship: "contain", Operand: "/new"},
+	}, reply)
+	assert.NoError(t, err)
+	assert.True(t, passing)
+}
+
+func TestRedirectSameHostToTLS(t *testing.T) {
+	// httptest's certificate is valid for example.com.
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "example.com", r.TLS.ServerName)
+		assert.Equal(t, "example.com", r.Host)
+		fmt.Fprint(w, "secure")
+	}))
+	defer tlsServer.Close()
+
+	location := "https://example.com:" + serverPort(tlsServer) + "/"
+	ts := httptest.NewServer(http.RedirectHandler(location, http.StatusMovedPermanently))
+	defer ts.Close()
+
+	response := httpTestResponse(t, &HTTPRequest{
+		Method:             "GET",
+		URL:                ts.URL,
+		Host:               "example.com",
+		InsecureSkipVerify: true,
+		RedirectPolicy:     RedirectPolicySameHost,
+	})
+	if response == nil {
+		return
+	}
+
+	assert.Equal(t, "secure", response.Body)
+	assert.Equal(t, []*schema.Redirect{{Url: location, Code: 301}}, response.Redirects)
+}
+
+func TestRedirectSameHostRefusesOtherHosts(t *testing.T) {
+	ts := httptest.NewServer(http.RedirectHandler("http://elsewhere.example.com/", http.StatusFound))
+	defer ts.Close()
+
+	response := httpTestResponse(t, &HTTPRequest{Method: "GET", URL: ts.URL, RedirectPolicy: RedirectPolicySameHost})
+	if response == nil {
+		return
+	}
+
+	assert.EqualValues(t, 302, response.Code)
+	assert.Empty(t, response.Redirects)
+}
+
+func TestRedirectAnyHost(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The host override and credentials don't follow the redirect to
+		// another host, and the POST becomes a GET.
+		assert.True(t, strings.HasPrefix(r.Host, "localhost:"), r.Host)
+		assert.Empty(t, r.Header.Get("Authorization"))
+		assert.Equal(t, "GET", r.Method)
+		assert.Equal(t, "X", r.Header.Get("X-Custom"))
+		fmt.Fprint(w, "other")
+	}))
+	defer other.Close()
+
+	location := "http://localhost:" + serverPort(other) + "/landing"
+	ts := httptest.NewServer(http.RedirectHandler(location, http.StatusFound))
+	defer ts.Close()
+
+	response := httpTestResponse(t, &HTTPRequest{
+		Method: "POST",
+		URL:    ts.URL,
+		Host:   "example.com",
+		Body:   "form",
+		Headers: []*schema.Header{
+			{Name: "Authorization", Values: []string{"token"}},
+			{Name: "X-Custom", Values: []string{"X"}},
+		},
+		RedirectPolicy: RedirectPolicyAny,
+	})
+	if response == nil {
+		return
+	}
+
+	assert.Equal(t, "other", response.Body)
+	assert.Equal(t, []*schema.Redirect{{Url: location, Code: 302}}, response.Redirects)
+}
+
+func TestRedirectToOtherHostVerifiesCertificate(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+
+	ts := httptest.NewServer(http.RedirectHandler("https://localhost:"+serverPort(tlsServer)+"/", http.StatusFound))
+	defer ts.Close()
+
+	// Skipping verification for the target doesn't extend to other hosts,
+	// and httptest's certificate isn't trusted.
+	request := &HTTPRequest{Method: "GET", URL: ts.URL, InsecureSkipVerify: true, RedirectPolicy: RedirectPolicyAny}
+	resp := <-request.Do(context.Background())
+	assert.Error(t, resp.Error)
+}
+
+func TestRedirectMaxRedirects(t *testing.T) {
+	hops := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops++
+		http.Redirect(w, r, fmt.Sprintf("/%d", hops), http.StatusTemporaryRedirect)
+	}))
+	defer ts.Close()
+
+	request := &HTTPRequest{Method: "GET", URL: ts.URL, RedirectPolicy: RedirectPolicyAny, MaxRedirects: 2}
+	resp := <-request.Do(context.Background())
+	if assert.Error(t, resp.Error) {
+		assert.Contains(t, resp.Error.Error(), "Stopped after 2 redirects")
+	}
+	assert.Equal(t, 3, hops)
+}
@@ -0,0 +1,82 @@
+package checker
+
+import (
+	"fmt"
+
+	opsee "github.com/opsee/basic/service"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+	"golang.org/x/net/context"
+)
+
+// ListChecks status filters.
+const (
+	ListChecksPassing = "passing"
+	ListChecksFailing = "failing"
+)
+
+// ListChecks returns the scheduled checks matching the request, in the order
+// they will next run, with their last run and last result.
+func (c *Checker) ListChecks(ctx context.Context, req *opsee.ListChecksRequest) (*opsee.ListChecksResponse, error) {
+	switch req.Status {
+	case "", ListChecksPassing, ListChecksFailing:
+	default:
+		return nil, fmt.Errorf("Unknown check status: %q", req.Status)
+	}
+
+	ids := make(map[string]bool, len(req.CheckIds))
+	for _, id := range req.CheckIds {
+		ids[id] = true
+	}
+
+	checks := []*opsee.ScheduledCheck{}
+	for _, entry := range c.Scheduler.Schedule() {
+		if len(ids) > 0 && !ids[entry.CheckId] {
+			continue
+		}
+		if req.TargetType != "" && (entry.check.Target == nil || entry.check.Target.Type != req.TargetType) {
+			continue
+		}
+
+		scheduled := c.scheduledCheck(entry)
+		if req.Status != "" {
+			if scheduled.LastResult == nil {
+				continue
+			}
+			if scheduled.LastResult.Passing != (req.Status == ListChecksPassing) {
+				continue
+			}
+		}
+
+		checks = append(checks, scheduled)
+	}
+
+	return &opsee.ListChecksResponse{Checks: checks}, nil
+}
+
+// scheduledCheck describes a scheduled check, filling its run state from
+// the state tracker without modifying the scheduled check itself.
+func (c *Checker) scheduledCheck(entry *ScheduleEntry) *opsee.ScheduledCheck {
+	check := *entry.check
+
+	nextRun := &opsee_types.Timestamp{}
+	nextRun.Scan(entry.NextRun)
+
+	scheduled := &opsee.ScheduledCheck{
+		Check:   &check,
+		NextRun: nextRun,
+	}
+
+	if c.States != nil {
+		if last := c.States.LastResult(check.Id); last != nil {
+			scheduled.LastResult = last
+			check.LastRun = last.Timestamp
+		}
+		if state, failing, responses := c.States.State(check.Id); state != "" {
+			check.State = state
+			check.FailingCount = failing
+			check.ResponseCount = responses
+		}
+	}
+
+	return scheduled
+}
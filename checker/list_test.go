@@ -0,0 +1,113 @@
+package checker
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// newListTestChecker schedules a passing sg check, a failing instance check
+// and an instance check that hasn't run.
+func newListTestChecker() *Checker {
+	resolver := newTestResolver()
+	checker := NewChecker(resolver)
+	checker.Scheduler = NewScheduler(resolver)
+	checker.States = NewStateTracker(func(checkId string) (*schema.Check, error) {
+		return checker.Scheduler.RetrieveCheck(&schema.Check{Id: checkId})
+	})
+
+	passing := TestCommonStubs{}.PassingCheck()
+	passing.Id = "passing"
+	failing := TestCommonStubs{}.PassingCheckInstanceTarget()
+	failing.Id = "failing"
+	pending := TestCommonStubs{}.PassingCheckInstanceTarget()
+	pending.Id = "pending"
+	for _, check := range []*schema.Check{passing, failing, pending} {
+		checker.Scheduler.CreateCheck(check)
+	}
+
+	checker.States.Update(&schema.CheckResult{
+		CheckId:   "passing",
+		Timestamp: &opsee_types.Timestamp{Seconds: 100},
+		Responses: []*schema.CheckResponse{{Passing: true}},
+	})
+	checker.States.Update(&schema.CheckResult{
+		CheckId:   "failing",
+		Timestamp: &opsee_types.Timestamp{Seconds: 200},
+		Responses: []*schema.CheckResponse{{Passing: false}, {Passing: true}},
+	})
+
+	return checker
+}
+
+func listedIds(resp *opsee.ListChecksResponse) []string {
+	ids := []string{}
+	for _, c := range resp.Checks {
+		ids = append(ids, c.Check.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestListChecksFilters(t *testing.T) {
+	checker := newListTestChecker()
+
+	tests := []struct {
+		req *opsee.ListChecksRequest
+		ids []string
+	}{
+		{&opsee.ListChecksRequest{}, []string{"failing", "passing", "pending"}},
+		{&opsee.ListChecksRequest{TargetType: "instance"}, []string{"failing", "pending"}},
+		{&opsee.ListChecksRequest{CheckIds: []string{"passing", "pending"}}, []string{"passing", "pending"}},
+		{&opsee.ListChecksRequest{Status: ListChecksPassing}, []string{"passing"}},
+		{&opsee.ListChecksRequest{Status: ListChecksFailing, TargetType: "instance"}, []string{"failing"}},
+		{&opsee.ListChecksRequest{Status: ListChecksFailing, TargetType: "sg"}, []string{}},
+	}
+
+	for i, test := range tests {
+		resp, err := checker.ListChecks(context.Background(), test.req)
+		if assert.NoError(t, err, "test %d", i) {
+			assert.Equal(t, test.ids, listedIds(resp), "test %d", i)
+		}
+	}
+
+	_, err := checker.ListChecks(context.Background(), &opsee.ListChecksRequest{Status: "flapping"})
+	assert.Error(t, err)
+}
+
+func TestListChecksFillsRunState(t *testing.T) {
+	checker := newListTestChecker()
+
+	resp, err := checker.ListChecks(context.Background(), &opsee.ListChecksRequest{CheckIds: []string{"failing", "pending"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, listed := range resp.Checks {
+		assert.NotNil(t, listed.NextRun)
+
+		switch listed.Check.Id {
+		case "failing":
+			assert.EqualValues(t, 200, listed.Check.LastRun.Seconds)
+			assert.Equal(t, StateFail, listed.Check.State)
+			assert.EqualValues(t, 1, listed.Check.FailingCount)
+			assert.EqualValues(t, 2, listed.Check.ResponseCount)
+			if assert.NotNil(t, listed.LastResult) {
+				assert.False(t, listed.LastResult.Passing)
+				assert.EqualValues(t, 1, listed.LastResult.FailingCount)
+			}
+		case "pending":
+			assert.Nil(t, listed.Check.LastRun)
+			assert.Nil(t, listed.LastResult)
+		}
+	}
+
+	// The scheduled checks themselves are left alone.
+	scheduled, _ := checker.Scheduler.RetrieveCheck(&schema.Check{Id: "failing"})
+	assert.Nil(t, scheduled.LastRun)
+}
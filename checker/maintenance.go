@@ -0,0 +1,396 @@
+package checker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	"github.com/satori/go.uuid"
+	"golang.org/x/net/context"
+)
+
+// Maintenance window modes.
+const (
+	// MaintenanceModeMute runs checks, but marks their results as muted.
+	MaintenanceModeMute = "mute"
+	// MaintenanceModeSkip doesn't run checks at all.
+	MaintenanceModeSkip = "skip"
+
+	// MaintenanceSnapshotVersion is the version of the maintenance window file
+	// format written by this bastion.
+	MaintenanceSnapshotVersion = 1
+)
+
+var errNoMaintenanceStore = errors.New("Maintenance windows are not enabled")
+
+// MaintenanceSnapshot is the set of maintenance windows as persisted on disk.
+type MaintenanceSnapshot struct {
+	Version int32                      `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Windows []*opsee.MaintenanceWindow `protobuf:"bytes,2,rep,name=windows" json:"windows,omitempty"`
+}
+
+func (m *MaintenanceSnapshot) Reset()         { *m = MaintenanceSnapshot{} }
+func (m *MaintenanceSnapshot) String() string { return proto.CompactTextString(m) }
+func (*MaintenanceSnapshot) ProtoMessage()    {}
+
+// A MaintenanceStore holds the bastion's maintenance windows, persisting
+// them to Path so that they survive restarts. Windows are discarded once
+// they end.
+type MaintenanceStore struct {
+	Path string
+
+	lock    sync.RWMutex
+	windows map[string]*opsee.MaintenanceWindow
+}
+
+// NewMaintenanceStore loads the maintenance windows persisted in path. If
+// path is empty, windows are kept only in memory.
+func NewMaintenanceStore(path string) (*MaintenanceStore, error) {
+	m := &MaintenanceStore{
+		Path:    path,
+		windows: make(map[string]*opsee.MaintenanceWindow),
+	}
+
+	if path == "" {
+		return m, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+
+	snapshot := &MaintenanceSnapshot{}
+	if err := proto.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Version != MaintenanceSnapshotVersion {
+		return nil, fmt.Errorf("Unsupported maintenance window file version: %d", snapshot.Version)
+	}
+
+	for _, w := range snapshot.Windows {
+		m.windows[w.Id] = w
+	}
+
+	return m, nil
+}
+
+func validateMaintenanceWindow(w *opsee.MaintenanceWindow) error {
+	if w.Start == nil || w.End == nil {
+		return fmt.Errorf("Maintenance window must have a start and an end")
+	}
+	if w.End.Millis() <= w.Start.Millis() {
+		return fmt.Errorf("Maintenance window must end after it starts")
+	}
+	if w.CheckId != "" && w.Target != nil {
+		return fmt.Errorf("Maintenance window must be scoped to a check or a target, not both")
+	}
+	if w.Target != nil && (w.Target.Type == "" || w.Target.Id == "") {
+		return fmt.Errorf("Maintenance window target must have a type and an ID")
+	}
+	switch w.Mode {
+	case MaintenanceModeMute, MaintenanceModeSkip:
+	default:
+		return fmt.Errorf("Unknown maintenance window mode: %q", w.Mode)
+	}
+	return nil
+}
+
+// Create adds maintenance windows, assigning IDs to those without one. A
+// window with the ID of an existing window replaces it. If any window is
+// invalid, none are added.
+func (m *MaintenanceStore) Create(windows []*opsee.MaintenanceWindow) ([]*opsee.MaintenanceWindow, error) {
+	for _, w := range windows {
+		if err := validateMaintenanceWindow(w); err != nil {
+			return nil, err
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, w := range windows {
+		if w.Id == "" {
+			w.Id = uuid.NewV4().String()
+		}
+		m.windows[w.Id] = w
+	}
+
+	return windows, m.save()
+}
+
+// Delete removes the maintenance windows with the given IDs, returning those
+// that existed.
+func (m *MaintenanceStore) Delete(ids []string) ([]*opsee.MaintenanceWindow, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	deleted := []*opsee.MaintenanceWindow{}
+	for _, id := range ids {
+		if w, ok := m.windows[id]; ok {
+			deleted = append(deleted, w)
+			delete(m.windows, id)
+		}
+	}
+
+	return deleted, m.save()
+}
+
+// List returns the maintenance windows that haven't ended, ordered by start.
+func (m *MaintenanceStore) List() []*opsee.MaintenanceWindow {
+	now := time.Now()
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	windows := []*opsee.MaintenanceWindow{}
+	for _, w := range m.windows {
+		if !maintenanceWindowEnded(w, now) {
+			windows = append(windows, w)
+		}
+	}
+	sort.Sort(byStart(windows))
+
+	return windows
+}
+
+// Apply applies the maintenance windows active at now to a run. It returns
+// nil if the run is skipped. Target-scoped skip windows remove their targets
+// from the run, and the run is skipped if no targets remain. Target-scoped
+// mute windows add their targets to the run's muted targets. A window's
+// targets are the run targets it names, or those it resolves to with
+// resolver, so that a window on a group covers the group's instances. If any
+// other mute window applies, or every target is muted, the run is marked
+// muted.
+func (m *MaintenanceStore) Apply(run *schema.CheckTargets, now time.Time, resolver Resolver) *schema.CheckTargets {
+	check := run.Check
+	muted := run.Muted
+	targets := run.Targets
+	mutedTargets := run.MutedTargets
+	for _, w := range m.active(now) {
+		switch {
+		case w.CheckId != "" && w.CheckId != check.Id:
+			continue
+		case w.Target != nil && !sameTarget(w.Target, check.Target):
+			covered := windowTargets(w.Target, targets, resolver)
+			for _, t := range covered {
+				if w.Mode == MaintenanceModeSkip {
+					targets = removeTarget(targets, t)
+				} else if !containsTarget(mutedTargets, t) {
+					mutedTargets = append(mutedTargets, t)
+				}
+			}
+			if len(covered) > 0 && len(targets) == 0 {
+				return nil
+			}
+			continue
+		case w.Mode == MaintenanceModeSkip:
+			return nil
+		}
+
+		muted = true
+	}
+
+	// Drop muted targets that were skipped.
+	var remaining []*schema.Target
+	for _, t := range mutedTargets {
+		if containsTarget(targets, t) {
+			remaining = append(remaining, t)
+		}
+	}
+	if len(targets) > 0 && len(remaining) == len(targets) {
+		muted = true
+	}
+
+	return &schema.CheckTargets{
+		Check:        check,
+		Targets:      targets,
+		Muted:        muted,
+		MutedTargets: remaining,
+	}
+}
+
+// active discards windows that have ended and returns those active at now.
+func (m *MaintenanceStore) active(now time.Time) []*opsee.MaintenanceWindow {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.prune(now)
+
+	windows := []*opsee.MaintenanceWindow{}
+	for _, w := range m.windows {
+		if maintenanceWindowActive(w, now) {
+			windows = append(windows, w)
+		}
+	}
+	return windows
+}
+
+// windowTargets returns the targets a target-scoped window covers: the
+// window's target if it is one of targets, or else those of targets that the
+// window's target resolves to, such as the instances of a group. Without a
+// resolver, only the window's own target is matched.
+func windowTargets(target *schema.Target, targets []*schema.Target, resolver Resolver) []*schema.Target {
+	if containsTarget(targets, target) {
+		return []*schema.Target{target}
+	}
+	if resolver == nil {
+		return nil
+	}
+
+	resolved, err := resolver.Resolve(context.Background(), target)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"target_type": target.Type, "target_id": target.Id}).Warn("Couldn't resolve maintenance window target.")
+		return nil
+	}
+
+	var covered []*schema.Target
+	for _, t := range resolved {
+		if containsTarget(targets, t) && !containsTarget(covered, t) {
+			covered = append(covered, t)
+		}
+	}
+	return covered
+}
+
+// muteResponse marks a response muted if its run is muted, or if its target
+// is one of the run's muted targets.
+func muteResponse(run *schema.CheckTargets, response *schema.CheckResponse) {
+	if run.Muted || containsTarget(run.MutedTargets, response.Target) {
+		response.Muted = true
+	}
+}
+
+// prune discards windows that have ended. The lock must be held.
+func (m *MaintenanceStore) prune(now time.Time) {
+	pruned := false
+	for id, w := range m.windows {
+		if maintenanceWindowEnded(w, now) {
+			delete(m.windows, id)
+			pruned = true
+		}
+	}
+	if pruned {
+		m.save()
+	}
+}
+
+// save persists the windows. The lock must be held.
+func (m *MaintenanceStore) save() error {
+	if m.Path == "" {
+		return nil
+	}
+
+	snapshot := &MaintenanceSnapshot{Version: MaintenanceSnapshotVersion}
+	for _, w := range m.windows {
+		snapshot.Windows = append(snapshot.Windows, w)
+	}
+	sort.Sort(byStart(snapshot.Windows))
+
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(m.Path, data)
+}
+
+func maintenanceWindowActive(w *opsee.MaintenanceWindow, now time.Time) bool {
+	millis := now.UnixNano() / int64(time.Millisecond)
+	return w.Start.Millis() <= millis && millis < w.End.Millis()
+}
+
+func maintenanceWindowEnded(w *opsee.MaintenanceWindow, now time.Time) bool {
+	return w.End.Millis() <= now.UnixNano()/int64(time.Millisecond)
+}
+
+func sameTarget(a, b *schema.Target) bool {
+	return a != nil && b != nil && a.Type == b.Type && a.Id == b.Id
+}
+
+func containsTarget(targets []*schema.Target, target *schema.Target) bool {
+	for _, t := range targets {
+		if sameTarget(t, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeTarget(targets []*schema.Target, target *schema.Target) []*schema.Target {
+	remaining := make([]*schema.Target, 0, len(targets))
+	for _, t := range targets {
+		if !sameTarget(t, target) {
+			remaining = append(remaining, t)
+		}
+	}
+	return remaining
+}
+
+type byStart []*opsee.MaintenanceWindow
+
+func (b byStart) Len() int      { return len(b) }
+func (b byStart) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byStart) Less(i, j int) bool {
+	if b[i].Start.Millis() == b[j].Start.Millis() {
+		return b[i].Id < b[j].Id
+	}
+	return b[i].Start.Millis() < b[j].Start.Millis()
+}
+
+// CreateMaintenanceWindows adds the requested maintenance windows, returning
+// them with their assigned IDs.
+func (c *Checker) CreateMaintenanceWindows(ctx context.Context, req *opsee.MaintenanceWindowRequest) (*opsee.MaintenanceWindowResponse, error) {
+	if c.Maintenance == nil {
+		return nil, errNoMaintenanceStore
+	}
+
+	windows, err := c.Maintenance.Create(req.Windows)
+	if err != nil {
+		log.WithError(err).Error("Couldn't create maintenance windows.")
+		return nil, err
+	}
+
+	return &opsee.MaintenanceWindowResponse{Windows: windows}, nil
+}
+
+// DeleteMaintenanceWindows ends the requested maintenance windows early,
+// returning those that existed. Only window IDs are used.
+func (c *Checker) DeleteMaintenanceWindows(ctx context.Context, req *opsee.MaintenanceWindowRequest) (*opsee.MaintenanceWindowResponse, error) {
+	if c.Maintenance == nil {
+		return nil, errNoMaintenanceStore
+	}
+
+	ids := make([]string, len(req.Windows))
+	for i, w := range req.Windows {
+		ids[i] = w.Id
+	}
+
+	windows, err := c.Maintenance.Delete(ids)
+	if err != nil {
+		log.WithError(err).Error("Couldn't delete maintenance windows.")
+		return nil, err
+	}
+
+	return &opsee.MaintenanceWindowResponse{Windows: windows}, nil
+}
+
+// ListMaintenanceWindows returns the maintenance windows that haven't ended.
+func (c *Checker) ListMaintenanceWindows(ctx context.Context, req *opsee.MaintenanceWindowRequest) (*opsee.MaintenanceWindowResponse, error) {
+	if c.Maintenance == nil {
+		return nil, errNoMaintenanceStore
+	}
+
+	return &opsee.MaintenanceWindowResponse{Windows: c.Maintenance.List()}, nil
+}
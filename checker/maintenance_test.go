@@ -0,0 +1,239 @@
+package checker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func maintenanceTimestamp(t time.Time) *opsee_types.Timestamp {
+	ts := &opsee_types.Timestamp{}
+	ts.Scan(t)
+	return ts
+}
+
+// maintenanceWindow returns a window in mode that started an hour ago and
+// ends in an hour.
+func maintenanceWindow(mode string) *opsee.MaintenanceWindow {
+	now := time.Now()
+	return &opsee.MaintenanceWindow{
+		Start: maintenanceTimestamp(now.Add(-time.Hour)),
+		End:   maintenanceTimestamp(now.Add(time.Hour)),
+		Mode:  mode,
+	}
+}
+
+func maintenanceRun() *schema.CheckTargets {
+	return &schema.CheckTargets{
+		Check: &schema.Check{
+			Id:     "check-id",
+			Target: &schema.Target{Type: "sg", Id: "sg-1"},
+		},
+		Targets: []*schema.Target{
+			{Type: "instance", Id: "i-1"},
+			{Type: "instance", Id: "i-2"},
+		},
+	}
+}
+
+func TestMaintenanceStorePersistsWindows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "maintenance")
+
+	store, err := NewMaintenanceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	windows, err := store.Create([]*opsee.MaintenanceWindow{maintenanceWindow(MaintenanceModeMute), maintenanceWindow(MaintenanceModeSkip)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, windows[0].Id)
+	assert.NotEmpty(t, windows[1].Id)
+
+	_, err = store.Delete([]string{windows[0].Id})
+	assert.NoError(t, err)
+
+	reloaded, err := NewMaintenanceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := reloaded.List()
+	if assert.Len(t, listed, 1) {
+		assert.Equal(t, windows[1].Id, listed[0].Id)
+		assert.Equal(t, MaintenanceModeSkip, listed[0].Mode)
+	}
+}
+
+func TestMaintenanceStoreRejectsInvalidWindows(t *testing.T) {
+	store, _ := NewMaintenanceStore("")
+
+	badMode := maintenanceWindow("snooze")
+	backwards := maintenanceWindow(MaintenanceModeMute)
+	backwards.Start, backwards.End = backwards.End, backwards.Start
+	unbounded := maintenanceWindow(MaintenanceModeMute)
+	unbounded.End = nil
+
+	for _, w := range []*opsee.MaintenanceWindow{badMode, backwards, unbounded} {
+		_, err := store.Create([]*opsee.MaintenanceWindow{maintenanceWindow(MaintenanceModeMute), w})
+		assert.Error(t, err)
+	}
+	assert.Empty(t, store.List())
+}
+
+func TestMaintenanceStoreDiscardsEndedWindows(t *testing.T) {
+	store, _ := NewMaintenanceStore("")
+
+	ended := maintenanceWindow(MaintenanceModeSkip)
+	ended.Start = maintenanceTimestamp(time.Now().Add(-2 * time.Hour))
+	ended.End = maintenanceTimestamp(time.Now().Add(-time.Hour))
+	upcoming := maintenanceWindow(MaintenanceModeSkip)
+	upcoming.Start = maintenanceTimestamp(time.Now().Add(time.Hour))
+	upcoming.End = maintenanceTimestamp(time.Now().Add(2 * time.Hour))
+	store.Create([]*opsee.MaintenanceWindow{ended, upcoming})
+
+	assert.NotNil(t, store.Apply(maintenanceRun(), time.Now(), nil))
+	listed := store.List()
+	if assert.Len(t, listed, 1) {
+		assert.Equal(t, upcoming.Id, listed[0].Id)
+	}
+}
+
+func TestMaintenanceStoreApply(t *testing.T) {
+	scoped := func(mode, checkId string, target *schema.Target) *opsee.MaintenanceWindow {
+		w := maintenanceWindow(mode)
+		w.CheckId = checkId
+		w.Target = target
+		return w
+	}
+
+	tests := []struct {
+		name         string
+		window       *opsee.MaintenanceWindow
+		skipped      bool
+		muted        bool
+		targets      int
+		mutedTargets int
+	}{
+		{"bastion mute", scoped(MaintenanceModeMute, "", nil), false, true, 2, 0},
+		{"bastion skip", scoped(MaintenanceModeSkip, "", nil), true, false, 0, 0},
+		{"check skip", scoped(MaintenanceModeSkip, "check-id", nil), true, false, 0, 0},
+		{"other check", scoped(MaintenanceModeSkip, "other-id", nil), false, false, 2, 0},
+		{"check target mute", scoped(MaintenanceModeMute, "", &schema.Target{Type: "sg", Id: "sg-1"}), false, true, 2, 0},
+		{"instance skip", scoped(MaintenanceModeSkip, "", &schema.Target{Type: "instance", Id: "i-1"}), false, false, 1, 0},
+		{"instance mute", scoped(MaintenanceModeMute, "", &schema.Target{Type: "instance", Id: "i-2"}), false, false, 2, 1},
+		{"other instance", scoped(MaintenanceModeMute, "", &schema.Target{Type: "instance", Id: "i-3"}), false, false, 2, 0},
+	}
+
+	for _, test := range tests {
+		store, _ := NewMaintenanceStore("")
+		if _, err := store.Create([]*opsee.MaintenanceWindow{test.window}); err != nil {
+			t.Fatal(err)
+		}
+
+		run := store.Apply(maintenanceRun(), time.Now(), nil)
+		if test.skipped {
+			assert.Nil(t, run, test.name)
+			continue
+		}
+		if assert.NotNil(t, run, test.name) {
+			assert.Equal(t, test.muted, run.Muted, test.name)
+			assert.Len(t, run.Targets, test.targets, test.name)
+			assert.Len(t, run.MutedTargets, test.mutedTargets, test.name)
+		}
+	}
+}
+
+func TestMaintenanceStoreMutesRunWhenAllTargetsMuted(t *testing.T) {
+	store, _ := NewMaintenanceStore("")
+	mute := maintenanceWindow(MaintenanceModeMute)
+	mute.Target = &schema.Target{Type: "instance", Id: "i-1"}
+	skip := maintenanceWindow(MaintenanceModeSkip)
+	skip.Target = &schema.Target{Type: "instance", Id: "i-2"}
+	store.Create([]*opsee.MaintenanceWindow{mute, skip})
+
+	run := store.Apply(maintenanceRun(), time.Now(), nil)
+	if assert.NotNil(t, run) {
+		assert.True(t, run.Muted)
+		assert.Len(t, run.Targets, 1)
+		assert.Len(t, run.MutedTargets, 1)
+	}
+}
+
+func TestMuteResponse(t *testing.T) {
+	run := maintenanceRun()
+	run.MutedTargets = []*schema.Target{{Type: "instance", Id: "i-2"}}
+
+	responses := []*schema.CheckResponse{{Target: run.Targets[0]}, {Target: run.Targets[1]}}
+	for _, response := range responses {
+		muteResponse(run, response)
+	}
+	assert.False(t, responses[0].Muted)
+	assert.True(t, responses[1].Muted)
+
+	run.Muted = true
+	muteResponse(run, responses[0])
+	assert.True(t, responses[0].Muted)
+}
+
+func TestMaintenanceStoreSkipsRunWithoutTargets(t *testing.T) {
+	store, _ := NewMaintenanceStore("")
+	for _, id := range []string{"i-1", "i-2"} {
+		w := maintenanceWindow(MaintenanceModeSkip)
+		w.Target = &schema.Target{Type: "instance", Id: id}
+		store.Create([]*opsee.MaintenanceWindow{w})
+	}
+
+	assert.Nil(t, store.Apply(maintenanceRun(), time.Now(), nil))
+}
+
+func TestMaintenanceStoreResolvesWindowTargets(t *testing.T) {
+	resolver := &testResolver{Targets: map[string][]*schema.Target{
+		"asg-1": {{Type: "instance", Id: "i-1"}, {Type: "instance", Id: "i-9"}},
+		"elb-1": {{Type: "instance", Id: "i-1"}, {Type: "instance", Id: "i-2"}},
+	}}
+
+	mute := maintenanceWindow(MaintenanceModeMute)
+	mute.Target = &schema.Target{Type: "asg", Id: "asg-1"}
+	store, _ := NewMaintenanceStore("")
+	store.Create([]*opsee.MaintenanceWindow{mute})
+
+	// Without a resolver, the group's instances aren't matched.
+	run := store.Apply(maintenanceRun(), time.Now(), nil)
+	if assert.NotNil(t, run) {
+		assert.Empty(t, run.MutedTargets)
+	}
+
+	run = store.Apply(maintenanceRun(), time.Now(), resolver)
+	if assert.NotNil(t, run) {
+		assert.False(t, run.Muted)
+		assert.Len(t, run.Targets, 2)
+		assert.Equal(t, []*schema.Target{{Type: "instance", Id: "i-1"}}, run.MutedTargets)
+	}
+
+	skip := maintenanceWindow(MaintenanceModeSkip)
+	skip.Target = &schema.Target{Type: "elb", Id: "elb-1"}
+	store.Create([]*opsee.MaintenanceWindow{skip})
+	assert.Nil(t, store.Apply(maintenanceRun(), time.Now(), resolver))
+
+	// Windows whose targets can't be resolved don't apply.
+	store.Delete([]string{skip.Id})
+	unknown := maintenanceWindow(MaintenanceModeSkip)
+	unknown.Target = &schema.Target{Type: "asg", Id: "asg-2"}
+	store.Create([]*opsee.MaintenanceWindow{unknown})
+	run = store.Apply(maintenanceRun(), time.Now(), resolver)
+	if assert.NotNil(t, run) {
+		assert.Len(t, run.Targets, 2)
+	}
+}
@@ -0,0 +1,137 @@
+package checker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// LateRunThreshold is how long a run may wait in the queue before it is
+// counted as late.
+const LateRunThreshold = 5 * time.Second
+
+// A ScheduledRun is a request to run a check. A run that hasn't been
+// published by its deadline is stale and is dropped.
+type ScheduledRun struct {
+	Check       *schema.Check
+	ScheduledAt time.Time
+	Deadline    time.Time
+}
+
+// runQueue holds the runs waiting to be published. Pushing never blocks, and
+// holds at most one pending run per check: a run pushed while another is
+// still pending for the same check replaces it, keeping its place in line.
+type runQueue struct {
+	lock    sync.Mutex
+	order   []string
+	pending map[string]*ScheduledRun
+	closed  bool
+
+	ready    chan struct{}
+	registry metrics.Registry
+}
+
+func newRunQueue(registry metrics.Registry) *runQueue {
+	return &runQueue{
+		pending:  make(map[string]*ScheduledRun),
+		ready:    make(chan struct{}, 1),
+		registry: registry,
+	}
+}
+
+// Push adds a run to the queue, coalescing it with any pending run of the
+// same check.
+func (q *runQueue) Push(run *ScheduledRun) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	id := run.Check.Id
+	if _, ok := q.pending[id]; ok {
+		metrics.GetOrRegisterCounter("runs_coalesced", q.registry).Inc(1)
+	} else {
+		q.order = append(q.order, id)
+	}
+	q.pending[id] = run
+	q.updateDepth()
+	q.signal()
+}
+
+// Pop removes the oldest run from the queue, or returns nil if the queue is
+// empty.
+func (q *runQueue) Pop() *ScheduledRun {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.order) == 0 {
+		return nil
+	}
+
+	id := q.order[0]
+	q.order = q.order[1:]
+	run := q.pending[id]
+	delete(q.pending, id)
+	q.updateDepth()
+
+	if len(q.order) > 0 {
+		q.signal()
+	}
+
+	return run
+}
+
+// Remove discards the pending run of a check, if any.
+func (q *runQueue) Remove(checkId string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, ok := q.pending[checkId]; !ok {
+		return
+	}
+	delete(q.pending, checkId)
+	for i, id := range q.order {
+		if id == checkId {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+	q.updateDepth()
+}
+
+// Len returns the number of pending runs.
+func (q *runQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.order)
+}
+
+// Ready receives whenever the queue may have runs to pop.
+func (q *runQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Close discards pending runs and ignores any further pushes.
+func (q *runQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.order = nil
+	q.pending = make(map[string]*ScheduledRun)
+	q.updateDepth()
+}
+
+func (q *runQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *runQueue) updateDepth() {
+	metrics.GetOrRegisterGauge("queue_depth", q.registry).Update(int64(len(q.order)))
+}
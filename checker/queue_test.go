@@ -0,0 +1,94 @@
+package checker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func queuedRun(id string, scheduledAt time.Time) *ScheduledRun {
+	return &ScheduledRun{
+		Check:       &schema.Check{Id: id},
+		ScheduledAt: scheduledAt,
+		Deadline:    scheduledAt.Add(time.Minute),
+	}
+}
+
+func TestRunQueueIsFIFO(t *testing.T) {
+	queue := newRunQueue(metrics.NewRegistry())
+	now := time.Now()
+	queue.Push(queuedRun("a", now))
+	queue.Push(queuedRun("b", now))
+	queue.Push(queuedRun("c", now))
+
+	for _, id := range []string{"a", "b", "c"} {
+		assert.Equal(t, id, queue.Pop().Check.Id)
+	}
+	assert.Nil(t, queue.Pop())
+}
+
+func TestRunQueueCoalescesRuns(t *testing.T) {
+	registry := metrics.NewRegistry()
+	queue := newRunQueue(registry)
+	now := time.Now()
+	queue.Push(queuedRun("a", now))
+	queue.Push(queuedRun("b", now))
+	queue.Push(queuedRun("a", now.Add(time.Minute)))
+
+	assert.Equal(t, 2, queue.Len())
+	assert.EqualValues(t, 1, metrics.GetOrRegisterCounter("runs_coalesced", registry).Count())
+	assert.EqualValues(t, 2, metrics.GetOrRegisterGauge("queue_depth", registry).Value())
+
+	// The newest run keeps the place of the one it replaced.
+	run := queue.Pop()
+	assert.Equal(t, "a", run.Check.Id)
+	assert.Equal(t, now.Add(time.Minute), run.ScheduledAt)
+	assert.Equal(t, "b", queue.Pop().Check.Id)
+}
+
+func TestRunQueueRemove(t *testing.T) {
+	queue := newRunQueue(metrics.NewRegistry())
+	now := time.Now()
+	queue.Push(queuedRun("a", now))
+	queue.Push(queuedRun("b", now))
+	queue.Remove("a")
+	queue.Remove("missing")
+
+	assert.Equal(t, 1, queue.Len())
+	assert.Equal(t, "b", queue.Pop().Check.Id)
+}
+
+func TestRunQueueSignalsUntilEmpty(t *testing.T) {
+	queue := newRunQueue(metrics.NewRegistry())
+	now := time.Now()
+	queue.Push(queuedRun("a", now))
+	queue.Push(queuedRun("b", now))
+
+	for _, id := range []string{"a", "b"} {
+		select {
+		case <-queue.Ready():
+		default:
+			t.Fatal("queue not ready")
+		}
+		assert.Equal(t, id, queue.Pop().Check.Id)
+	}
+
+	select {
+	case <-queue.Ready():
+		t.Fatal("empty queue is ready")
+	default:
+	}
+}
+
+func TestRunQueueClose(t *testing.T) {
+	queue := newRunQueue(metrics.NewRegistry())
+	queue.Push(queuedRun("a", time.Now()))
+	queue.Close()
+	queue.Push(queuedRun("b", time.Now()))
+
+	assert.Equal(t, 0, queue.Len())
+	assert.Nil(t, queue.Pop())
+}
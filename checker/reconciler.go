@@ -0,0 +1,218 @@
+package checker
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/basic/schema"
+	"github.com/opsee/bastion/netutil"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// DefaultReconcileInterval is how often the checker compares its
+	// scheduled checks with the backend's.
+	DefaultReconcileInterval = 5 * time.Minute
+	// DefaultReconcileJitter is the most that is randomly added to each
+	// reconcile interval, so that bastions don't all hit the backend at once.
+	DefaultReconcileJitter = 30 * time.Second
+)
+
+// A ReconcileSummary lists the IDs of the checks changed by a reconcile.
+type ReconcileSummary struct {
+	Created   []string
+	Deleted   []string
+	Replaced  []string
+	Failed    []string
+	Unchanged int
+}
+
+// Changed returns true if the reconcile changed any scheduled checks.
+func (s *ReconcileSummary) Changed() bool {
+	return len(s.Created)+len(s.Deleted)+len(s.Replaced) > 0
+}
+
+// Reconcile makes the set of scheduled checks match checks, creating checks
+// that are missing, deleting checks that are no longer defined, and replacing
+// checks whose definitions have changed.
+func (s *Scheduler) Reconcile(checks []*schema.Check) *ReconcileSummary {
+	summary := &ReconcileSummary{}
+
+	desired := make(map[string]*schema.Check, len(checks))
+	for _, check := range checks {
+		if err := normalizeCheck(check); err != nil {
+			summary.Failed = append(summary.Failed, check.Id)
+			continue
+		}
+		desired[check.Id] = check
+	}
+
+	for _, scheduled := range s.Checks() {
+		if _, ok := desired[scheduled.Id]; ok {
+			continue
+		}
+		if _, err := s.DeleteCheck(scheduled); err != nil {
+			log.WithError(err).WithField("check_id", scheduled.Id).Error("Couldn't delete orphaned check.")
+			summary.Failed = append(summary.Failed, scheduled.Id)
+			continue
+		}
+		summary.Deleted = append(summary.Deleted, scheduled.Id)
+	}
+
+	for id, check := range desired {
+		scheduled, _ := s.RetrieveCheck(check)
+		if scheduled != nil && sameDefinition(scheduled, check) {
+			summary.Unchanged++
+			continue
+		}
+
+		if _, _, err := s.UpdateCheck(check); err != nil {
+			log.WithError(err).WithField("check_id", id).Error("Couldn't schedule check.")
+			summary.Failed = append(summary.Failed, id)
+			continue
+		}
+
+		if scheduled != nil {
+			summary.Replaced = append(summary.Replaced, id)
+		} else {
+			summary.Created = append(summary.Created, id)
+		}
+	}
+
+	sort.Strings(summary.Created)
+	sort.Strings(summary.Deleted)
+	sort.Strings(summary.Replaced)
+	sort.Strings(summary.Failed)
+
+	return summary
+}
+
+// checkFields extracts each field of a check's definition, by the field's
+// JSON name, for comparison.
+var checkFields = []struct {
+	name string
+	get  func(*schema.Check) *schema.Check
+}{
+	{"interval", func(c *schema.Check) *schema.Check { return &schema.Check{Interval: c.Interval} }},
+	{"schedule", func(c *schema.Check) *schema.Check { return &schema.Check{Schedule: c.Schedule} }},
+	{"time_zone", func(c *schema.Check) *schema.Check { return &schema.Check{TimeZone: c.TimeZone} }},
+	{"target", func(c *schema.Check) *schema.Check { return &schema.Check{Target: c.Target} }},
+	{"name", func(c *schema.Check) *schema.Check { return &schema.Check{Name: c.Name} }},
+	{"spec", func(c *schema.Check) *schema.Check { return &schema.Check{Spec: c.Spec, CheckSpec: c.CheckSpec} }},
+	{"assertions", func(c *schema.Check) *schema.Check { return &schema.Check{Assertions: c.Assertions} }},
+	{"notifications", func(c *schema.Check) *schema.Check { return &schema.Check{Notifications: c.Notifications} }},
+	{"customer_id", func(c *schema.Check) *schema.Check { return &schema.Check{CustomerId: c.CustomerId} }},
+	{"execution_group_id", func(c *schema.Check) *schema.Check { return &schema.Check{ExecutionGroupId: c.ExecutionGroupId} }},
+	{"min_failing_count", func(c *schema.Check) *schema.Check { return &schema.Check{MinFailingCount: c.MinFailingCount} }},
+	{"min_failing_time", func(c *schema.Check) *schema.Check { return &schema.Check{MinFailingTime: c.MinFailingTime} }},
+}
+
+// changedFields returns the JSON names of the fields whose definitions differ
+// between two checks, ignoring their run state.
+func changedFields(a, b *schema.Check) []string {
+	a, b = definition(a), definition(b)
+	changed := []string{}
+	for _, f := range checkFields {
+		if !f.get(a).Equal(f.get(b)) {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed
+}
+
+// sameDefinition compares two checks, ignoring their run state.
+func sameDefinition(a, b *schema.Check) bool {
+	return definition(a).Equal(definition(b))
+}
+
+func definition(check *schema.Check) *schema.Check {
+	c := *check
+	c.LastRun = nil
+	c.Results = nil
+	c.FailingCount = 0
+	c.ResponseCount = 0
+	c.State = ""
+	// Checks created through the API may not carry the bartnet check spec.
+	if c.Spec != nil {
+		c.CheckSpec = nil
+	}
+	return &c
+}
+
+// reconcile fetches checks from the backend and reconciles the scheduler
+// with them.
+func (c *Checker) reconcile(tries int) error {
+	checks, err := c.GetExistingChecks(tries)
+	if err != nil {
+		metrics.GetOrRegisterCounter("reconcile_errors", c.registry).Inc(1)
+		return err
+	}
+
+	summary := c.Scheduler.Reconcile(checks)
+	c.saveSnapshot()
+
+	metrics.GetOrRegisterCounter("reconciles", c.registry).Inc(1)
+	metrics.GetOrRegisterCounter("reconcile_created", c.registry).Inc(int64(len(summary.Created)))
+	metrics.GetOrRegisterCounter("reconcile_deleted", c.registry).Inc(int64(len(summary.Deleted)))
+	metrics.GetOrRegisterCounter("reconcile_replaced", c.registry).Inc(int64(len(summary.Replaced)))
+	metrics.GetOrRegisterCounter("reconcile_failed", c.registry).Inc(int64(len(summary.Failed)))
+
+	fields := log.Fields{
+		"created":   summary.Created,
+		"deleted":   summary.Deleted,
+		"replaced":  summary.Replaced,
+		"failed":    summary.Failed,
+		"unchanged": summary.Unchanged,
+	}
+	if summary.Changed() || len(summary.Failed) > 0 {
+		log.WithFields(fields).Info("Reconciled checks with Opsee.")
+	} else {
+		log.WithFields(fields).Debug("Reconciled checks with Opsee.")
+	}
+
+	return nil
+}
+
+// reconcileLoop synchronizes checks with the backend, retrying with backoff
+// until the first sync succeeds, and then reconciles every ReconcileInterval
+// plus up to ReconcileJitter.
+func (c *Checker) reconcileLoop() {
+	backoff := netutil.NewExponentialBackOff()
+	backoff.MaxElapsedTime = 0
+
+	for {
+		err := c.reconcile(NumCheckSyncRetries)
+		if err == nil {
+			break
+		}
+
+		wait := backoff.NextBackOff()
+		log.WithError(err).Errorf("Couldn't retrieve existing checks from server, retrying in %s.", wait)
+
+		select {
+		case <-c.reconcileStop:
+			return
+		case <-time.After(wait):
+		}
+	}
+
+	for {
+		wait := c.ReconcileInterval
+		if c.ReconcileJitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(c.ReconcileJitter)))
+		}
+
+		select {
+		case <-c.reconcileStop:
+			return
+		case <-time.After(wait):
+		}
+
+		// Later failures are retried on the next interval.
+		if err := c.reconcile(1); err != nil {
+			log.WithError(err).Error("Couldn't reconcile checks with server.")
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package checker
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/basic/schema"
+)
+
+// RedactedValue replaces redacted header values and body matches.
+const RedactedValue = "[redacted]"
+
+// DefaultDenyHeaders are the response headers whose values are redacted by
+// default, since they commonly carry credentials.
+var DefaultDenyHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// A redactionPattern scrubs its matches from a body. Matches are replaced by
+// template, which may refer to submatches, unless valid rejects them.
+type redactionPattern struct {
+	regexp   *regexp.Regexp
+	template string
+	valid    func(match string) bool
+}
+
+func (p *redactionPattern) scrub(text string) string {
+	if p.valid == nil {
+		return p.regexp.ReplaceAllString(text, p.template)
+	}
+
+	return p.regexp.ReplaceAllStringFunc(text, func(match string) string {
+		if !p.valid(match) {
+			return match
+		}
+		return p.template
+	})
+}
+
+// RedactionPatterns are the built-in body scrubbing patterns, by name.
+var RedactionPatterns = map[string][]*redactionPattern{
+	// Bearer tokens, JWTs and values keyed as tokens, keys, secrets or
+	// passwords. Keys are kept, so that the shape of the body is still
+	// visible.
+	"token": {
+		{
+			regexp:   regexp.MustCompile(`(?i)(\bbearer\s+|\b(?:api[_-]?key|access[_-]?token|refresh[_-]?token|auth[_-]?token|token|secret|password|passwd)["']?\s*[:=]\s*["']?)[^\s"'&,;<]{4,}`),
+			template: "${1}" + RedactedValue,
+		},
+		{
+			regexp:   regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+			template: RedactedValue,
+		},
+	},
+	"email": {
+		{
+			regexp:   regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+			template: RedactedValue,
+		},
+	},
+	// Card numbers are only redacted if they pass the Luhn check.
+	"card": {
+		{
+			regexp:   regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+			template: RedactedValue,
+			valid:    luhn,
+		},
+	},
+}
+
+// luhn reports whether the digits in s pass the Luhn checksum.
+func luhn(s string) bool {
+	sum := 0
+	double := false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// RedactionConfig configures a Redactor.
+type RedactionConfig struct {
+	// AllowHeaders, if not empty, lists the only response headers whose
+	// values are kept.
+	AllowHeaders []string
+	// DenyHeaders lists response headers whose values are redacted.
+	DenyHeaders []string
+	// BodyPatterns names the RedactionPatterns scrubbed from bodies.
+	BodyPatterns []string
+	// BodyRegexps are further regular expressions scrubbed from bodies.
+	BodyRegexps []string
+	// DropPassingBodies drops the bodies of passing responses entirely.
+	DropPassingBodies bool
+}
+
+// A Redactor removes sensitive data from check responses before they leave
+// the runner: the values of denied, or not allowed, headers, and matches of
+// its patterns in bodies. It may also drop the bodies of passing responses,
+// which are rarely looked at.
+type Redactor struct {
+	allow             map[string]bool
+	deny              map[string]bool
+	patterns          []*redactionPattern
+	headerPatterns    []*redactionPattern
+	dropPassingBodies bool
+}
+
+// NewRedactor returns a Redactor configured by cfg.
+func NewRedactor(cfg RedactionConfig) (*Redactor, error) {
+	r := &Redactor{
+		allow:             make(map[string]bool),
+		deny:              make(map[string]bool),
+		dropPassingBodies: cfg.DropPassingBodies,
+	}
+
+	for _, h := range cfg.AllowHeaders {
+		r.allow[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, h := range cfg.DenyHeaders {
+		r.deny[http.CanonicalHeaderKey(h)] = true
+	}
+
+	for _, name := range cfg.BodyPatterns {
+		patterns, ok := RedactionPatterns[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown redaction pattern: %q", name)
+		}
+		r.patterns = append(r.patterns, patterns...)
+	}
+	for _, expr := range cfg.BodyRegexps {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redaction regexp %q: %s", expr, err)
+		}
+		r.patterns = append(r.patterns, &redactionPattern{regexp: re, template: RedactedValue})
+	}
+
+	if len(r.deny) > 0 {
+		names := []string{}
+		for name := range r.deny {
+			names = append(names, regexp.QuoteMeta(name))
+		}
+		sort.Strings(names)
+		alternatives := strings.Join(names, "|")
+		r.headerPatterns = []*redactionPattern{
+			// Headers as written on the wire, "Name: value".
+			{
+				regexp:   regexp.MustCompile(`(?i)\b(` + alternatives + `)(\s*:\s*)[^"\r\n]+`),
+				template: "${1}${2}" + RedactedValue,
+			},
+			// Headers as formatted by their String method.
+			{
+				regexp:   regexp.MustCompile(`(?i)(name:"(?:` + alternatives + `)")(?:\s*values:"(?:[^"\\]|\\.)*")+`),
+				template: `${1} values:"` + RedactedValue + `"`,
+			},
+		}
+	}
+
+	return r, nil
+}
+
+// redactHeader reports whether the values of a header are redacted.
+func (r *Redactor) redactHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if len(r.allow) > 0 && !r.allow[name] {
+		return true
+	}
+	return r.deny[name]
+}
+
+// Scrub replaces the matches of the redactor's patterns in text.
+func (r *Redactor) Scrub(text string) string {
+	if r == nil {
+		return text
+	}
+
+	for _, p := range r.patterns {
+		text = p.scrub(text)
+	}
+	return text
+}
+
+// RedactResponse redacts the headers and body of a check response's reply,
+// and the values reported by its assertion results. Its assertions must
+// already have been evaluated. DNS record data and gRPC health check
+// messages are scrubbed like bodies. TLS responses are left alone, since they
+// only describe the certificates a server presents to anyone.
+func (r *Redactor) RedactResponse(response *schema.CheckResponse) {
+	if r == nil {
+		return
+	}
+
+	dropBody := r.dropPassingBodies && response.Passing
+
+	if httpResponse := response.GetHttpResponse(); httpResponse != nil {
+		for _, h := range httpResponse.Headers {
+			if r.redactHeader(h.Name) {
+				for i := range h.Values {
+					h.Values[i] = RedactedValue
+				}
+			}
+		}
+		if dropBody {
+			httpResponse.Body = ""
+		} else {
+			httpResponse.Body = r.Scrub(httpResponse.Body)
+		}
+	}
+
+	if tcpResponse := response.GetTcpResponse(); tcpResponse != nil {
+		if dropBody {
+			tcpResponse.Body = ""
+		} else {
+			tcpResponse.Body = r.Scrub(tcpResponse.Body)
+		}
+	}
+
+	if dnsResponse := response.GetDnsResponse(); dnsResponse != nil {
+		for _, answer := range dnsResponse.Answers {
+			answer.Data = r.Scrub(answer.Data)
+		}
+		if dropBody {
+			dnsResponse.Body = ""
+		} else {
+			dnsResponse.Body = r.Scrub(dnsResponse.Body)
+		}
+	}
+
+	if grpcResponse := response.GetGrpcResponse(); grpcResponse != nil {
+		grpcResponse.Message = r.Scrub(grpcResponse.Message)
+	}
+
+	for _, result := range response.AssertionResults {
+		switch {
+		case result.Key == "header" && r.redactHeader(result.Value):
+			result.Actual = RedactedValue
+		case result.Key == "body" && dropBody:
+			result.Actual = ""
+		default:
+			result.Actual = r.Scrub(result.Actual)
+		}
+	}
+}
+
+// redactHeaderValues returns a copy of headers with the values of redacted
+// headers replaced.
+func (r *Redactor) redactHeaderValues(headers []*schema.Header) []*schema.Header {
+	redacted := make([]*schema.Header, len(headers))
+	for i, h := range headers {
+		redacted[i] = h
+		if h != nil && r.redactHeader(h.Name) {
+			values := make([]string, len(h.Values))
+			for j := range values {
+				values[j] = RedactedValue
+			}
+			redacted[i] = &schema.Header{Name: h.Name, Values: values}
+		}
+	}
+	return redacted
+}
+
+// scrubHeaders replaces the values of denied headers written out in text.
+func (r *Redactor) scrubHeaders(text string) string {
+	for _, p := range r.headerPatterns {
+		text = p.scrub(text)
+	}
+	return text
+}
+
+// redactEntry returns a copy of a log entry with the values of redacted
+// headers replaced: fields named after denied headers, fields holding
+// headers, and denied headers written out in the message or string fields.
+func (r *Redactor) redactEntry(entry *log.Entry) *log.Entry {
+	data := make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		if r.deny[http.CanonicalHeaderKey(key)] {
+			data[key] = RedactedValue
+			continue
+		}
+
+		switch v := value.(type) {
+		case string:
+			value = r.scrubHeaders(v)
+		case []*schema.Header:
+			value = r.redactHeaderValues(v)
+		case *schema.Header:
+			value = r.redactHeaderValues([]*schema.Header{v})[0]
+		case http.Header:
+			headers := make(http.Header, len(v))
+			for name, values := range v {
+				if r.redactHeader(name) {
+					values = []string{RedactedValue}
+				}
+				headers[name] = values
+			}
+			value = headers
+		}
+		data[key] = value
+	}
+
+	redacted := *entry
+	redacted.Data = data
+	redacted.Message = r.scrubHeaders(entry.Message)
+	return &redacted
+}
+
+// LogFormatter returns a formatter that formats log entries with f, redacting
+// headers and scrubbing the redactor's patterns from them. Header values are
+// redacted from fields holding headers as they are from responses, but only
+// denied headers are recognized in text.
+func (r *Redactor) LogFormatter(f log.Formatter) log.Formatter {
+	return &scrubbingFormatter{formatter: f, redactor: r}
+}
+
+type scrubbingFormatter struct {
+	formatter log.Formatter
+	redactor  *Redactor
+}
+
+func (f *scrubbingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if f.redactor == nil {
+		return f.formatter.Format(entry)
+	}
+
+	b, err := f.formatter.Format(f.redactor.redactEntry(entry))
+	if err != nil {
+		return b, err
+	}
+	return []byte(f.redactor.Scrub(string(b))), nil
+}
+
+// ParseRedactionList splits a comma separated list of header or pattern
+// names, as given on the command line.
+func ParseRedactionList(list string) []string {
+	names := []string{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -1,10 +1,13 @@
 package checker
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -14,6 +17,7 @@ import (
 	"github.com/opsee/bastion/config"
 	opsee_types "github.com/opsee/protobuf/opseeproto/types"
 	metrics "github.com/rcrowley/go-metrics"
+	"github.com/satori/go.uuid"
 	"golang.org/x/net/context"
 )
 
@@ -24,7 +28,34 @@ type NSQRunnerConfig struct {
 	ConsumerChannelName string
 	ConsumerNsqdHost    string
 	ProducerNsqdHost    string
-	MaxHandlers         int
+	// CancelQueueName is the topic on which streaming runs are cancelled.
+	// Every runner consumes all of its messages.
+	CancelQueueName string
+	// PartialQueueName is the topic on which the partial results of
+	// streaming runs are published, apart from ProducerQueueName so that
+	// they never leave the bastion. Partial results are not published if
+	// it is empty.
+	PartialQueueName string
+	MaxHandlers      int
+	// SpoolDir is where results are spooled while they can't be published.
+	// Results are not spooled if it is empty.
+	SpoolDir      string
+	SpoolMaxBytes int64
+	SpoolMaxAge   time.Duration
+	// Results are published in envelopes of up to BatchSize results, at least
+	// once per BatchWindow, if BatchSize is greater than one.
+	BatchSize        int
+	BatchWindow      time.Duration
+	BatchCompression string
+	// CertsDir holds the TLS credentials that checks refer to by name. See
+	// CertStore.
+	CertsDir string
+	// Secrets supplies the values of the ${secret:name} placeholders in
+	// checks, and is redacted from their responses.
+	Secrets *SecretStore
+	// Redactor, if set, redacts headers and bodies of check responses
+	// before they are published.
+	Redactor *Redactor
 }
 
 type NSQRunner struct {
@@ -32,9 +63,18 @@ type NSQRunner struct {
 	config   *NSQRunnerConfig
 	producer *nsq.Producer
 	consumer *nsq.Consumer
+	cancels  *nsq.Consumer
+	spool    *Spool
+	batcher  *ResultBatcher
 }
 
 func NewNSQRunner(runner *Runner, cfg *NSQRunnerConfig) (*NSQRunner, error) {
+	if cfg.CertsDir != "" {
+		runner.certs = NewCertStore(cfg.CertsDir)
+	}
+	runner.secrets = cfg.Secrets
+	runner.redactor = cfg.Redactor
+
 	consumerConfig := nsq.NewConfig()
 	// This will effectively be the maximum number of simultaneous Checks that we can
 	// run. Keep in mind that each Check MAY yield many requests, and there are only
@@ -56,6 +96,59 @@ func NewNSQRunner(runner *Runner, cfg *NSQRunnerConfig) (*NSQRunner, error) {
 	log.Debugf("NSQRunner producing on queue %s", cfg.ProducerQueueName)
 
 	registry := metrics.NewPrefixedChildRegistry(metricsRegistry, "runner.")
+
+	publish := func(msg []byte) error {
+		return producer.Publish(cfg.ProducerQueueName, msg)
+	}
+
+	var spool *Spool
+	if cfg.SpoolDir != "" {
+		spool, err = NewSpool(cfg.SpoolDir, publish, registry)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.SpoolMaxBytes > 0 {
+			spool.MaxBytes = cfg.SpoolMaxBytes
+		}
+		if cfg.SpoolMaxAge > 0 {
+			spool.MaxAge = cfg.SpoolMaxAge
+		}
+		spool.Start()
+		publish = spool.Publish
+		log.Debugf("NSQRunner spooling results in %s", cfg.SpoolDir)
+	}
+
+	var batcher *ResultBatcher
+	if cfg.BatchSize > 1 {
+		if cfg.BatchCompression != CompressionNone && cfg.BatchCompression != CompressionGzip {
+			return nil, fmt.Errorf("Unsupported batch compression: %s", cfg.BatchCompression)
+		}
+		batcher = NewResultBatcher(cfg.BatchSize, cfg.BatchWindow, cfg.BatchCompression, publish, registry)
+		log.Debugf("NSQRunner batching up to %d results every %s", batcher.MaxCount, batcher.Window)
+	}
+
+	// publishPartial publishes a partial result immediately on its own
+	// topic, bypassing the batcher and the spool, so that a streaming
+	// TestCheck sees it as soon as possible.
+	publishPartial := func(result *schema.CheckResult) {
+		if cfg.PartialQueueName == "" {
+			return
+		}
+		msg, err := proto.Marshal(result)
+		if err != nil {
+			log.WithError(err).Error("Error marshaling partial CheckResult")
+			return
+		}
+		if err := producer.Publish(cfg.PartialQueueName, msg); err != nil {
+			log.WithError(err).Error("Error publishing partial CheckResult")
+		}
+	}
+
+	// streams holds the cancel functions of in-flight streaming runs by run
+	// ID, so that the checker can cancel them.
+	var streamsLock sync.Mutex
+	streams := make(map[string]context.CancelFunc)
+
 	bastionCustomerId := config.GetConfig().CustomerId
 
 	bastionRegion := ""
@@ -84,6 +177,8 @@ func NewNSQRunner(runner *Runner, cfg *NSQRunnerConfig) (*NSQRunner, error) {
 			Timestamp:  timestamp,
 			Version:    BastionProtoVersion,
 			Region:     bastionRegion,
+			Muted:      checkWithTargets.Muted,
+			RunId:      checkWithTargets.RunId,
 		}
 
 		// Backward compatibility required.
@@ -98,45 +193,83 @@ func NewNSQRunner(runner *Runner, cfg *NSQRunnerConfig) (*NSQRunner, error) {
 				Error:  fmt.Sprintf("Could not resolve target: type=%s id=%s name=%s", check.Target.Type, check.Target.Id, check.Target.Name),
 			}}
 		} else {
-			d, err := time.ParseDuration(fmt.Sprintf("%ds", check.Interval))
-
-			ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(d*2))
-
-			// A call to RunCheck is synchronous. Calling cancel() is not necessarily superfluous though.
-			responses, err := runner.RunCheck(ctx, check, checkWithTargets.Targets)
+			ctx, cancel := runContext(check, time.Now())
+
+			var responses []*schema.CheckResponse
+			var err error
+			if checkWithTargets.Stream {
+				runId := checkWithTargets.RunId
+				streamsLock.Lock()
+				streams[runId] = cancel
+				streamsLock.Unlock()
+
+				// Each target's response is published as a partial result
+				// as soon as it arrives, ahead of the complete result.
+				responses, err = runner.StreamCheck(ctx, check, checkWithTargets.Targets, int(checkWithTargets.MaxHosts), func(response *schema.CheckResponse) {
+					muteResponse(checkWithTargets, response)
+					partial := *result
+					partial.Responses = []*schema.CheckResponse{response}
+					partial.Passing = response.Passing
+					partial.Partial = true
+					partial.Muted = response.Muted
+					publishPartial(&partial)
+				})
+
+				streamsLock.Lock()
+				delete(streams, runId)
+				streamsLock.Unlock()
+			} else {
+				// A call to RunCheck is synchronous. Calling cancel() is not necessarily superfluous though.
+				responses, err = runner.RunCheck(ctx, check, checkWithTargets.Targets)
+			}
 			log.WithFields(log.Fields{"check_id": check.Id}).Debug("Running check.")
 			cancel()
 
-			if responses == nil {
-				log.WithFields(log.Fields{"check_id": check.Id}).Debug("skipping check.")
-				return nil
-			}
-
 			if err != nil {
-				log.WithError(err).WithFields(log.Fields{"check": check}).Error("Error running check.")
+				log.WithError(err).WithFields(log.Fields{"check_id": check.Id}).Error("Error running check.")
 				result.Responses = []*schema.CheckResponse{&schema.CheckResponse{
 					Target: check.Target,
-					Error:  handleError(err),
+					Error:  runner.secrets.Redact(handleError(err)),
 				}}
+			} else if responses == nil {
+				log.WithFields(log.Fields{"check_id": check.Id}).Debug("skipping check.")
+				return nil
 			} else {
-				// Determine if the CheckResult has its passing flag set.
-				passing := true
+				// Determine if the CheckResult has its passing flag set. Muted
+				// responses don't count, unless every response is muted.
+				passing, mutedPassing, muted := true, true, checkWithTargets.Muted || len(responses) > 0
 				for _, response := range responses {
+					muteResponse(checkWithTargets, response)
+					if response.Muted {
+						mutedPassing = mutedPassing && response.Passing
+						continue
+					}
+					muted = false
 					if !response.Passing {
 						passing = false
 					}
 				}
+				if muted {
+					passing = mutedPassing
+				}
 				result.Responses = responses
 				result.Passing = passing
+				result.Muted = muted
 			}
 		}
 
+		if batcher != nil {
+			batcher.Add(result)
+			metrics.GetOrRegisterCounter("nsq_messages_handled", registry).Inc(1)
+			return nil
+		}
+
 		msg, err := proto.Marshal(result)
 		if err != nil {
 			log.WithError(err).Error("Error marshaling CheckResult")
 			return err
 		}
-		if err := producer.Publish(cfg.ProducerQueueName, msg); err != nil {
+		if err := publish(msg); err != nil {
 			log.WithError(err).Error("Error publishing CheckResult")
 			return err
 		} else {
@@ -155,6 +288,39 @@ func NewNSQRunner(runner *Runner, cfg *NSQRunnerConfig) (*NSQRunner, error) {
 		return nil
 	}), cfg.MaxHandlers)
 
+	var cancels *nsq.Consumer
+	if cfg.CancelQueueName != "" {
+		// Every runner consumes all cancellations, on a channel of its own.
+		channel := fmt.Sprintf("%s-%s#ephemeral", cfg.Id, uuid.NewV4().String())
+		cancels, err = nsq.NewConsumer(cfg.CancelQueueName, channel, nsq.NewConfig())
+		if err != nil {
+			return nil, err
+		}
+		cancels.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
+			run := &schema.CheckTargets{}
+			if err := proto.Unmarshal(m.Body, run); err != nil {
+				log.WithError(err).Errorf("Error decoding cancellation: %s", string(m.Body))
+				return err
+			}
+			if !run.Cancel || run.RunId == "" {
+				return nil
+			}
+
+			streamsLock.Lock()
+			cancel, ok := streams[run.RunId]
+			streamsLock.Unlock()
+			if ok {
+				log.WithFields(log.Fields{"run_id": run.RunId}).Info("Cancelling streaming run.")
+				cancel()
+			}
+			return nil
+		}))
+		if err := cancels.ConnectToNSQD(cfg.ConsumerNsqdHost); err != nil {
+			return nil, err
+		}
+		log.Debugf("NSQRunner consuming cancellations on queue %s, channel %s", cfg.CancelQueueName, channel)
+	}
+
 	err = consumer.ConnectToNSQD(cfg.ConsumerNsqdHost)
 	if err != nil {
 		return nil, err
@@ -165,12 +331,25 @@ func NewNSQRunner(runner *Runner, cfg *NSQRunnerConfig) (*NSQRunner, error) {
 		runner:   runner,
 		producer: producer,
 		consumer: consumer,
+		cancels:  cancels,
+		spool:    spool,
+		batcher:  batcher,
 	}, nil
 }
 
 func (r *NSQRunner) Stop() {
+	if r.cancels != nil {
+		r.cancels.Stop()
+		<-r.cancels.StopChan
+	}
 	r.consumer.Stop()
 	<-r.consumer.StopChan
+	if r.batcher != nil {
+		r.batcher.Flush()
+	}
+	if r.spool != nil {
+		r.spool.Stop()
+	}
 	r.producer.Stop()
 }
 
@@ -180,10 +359,14 @@ func (r *NSQRunner) Stop() {
 // concurrent use. It provides an asynchronous API for submitting jobs and
 // manages its own concurrency.
 type Runner struct {
-	dispatcher  *Dispatcher
-	slateClient *SlateClient
-	registry    metrics.Registry
-	checkType   interface{}
+	dispatcher   *Dispatcher
+	slateClient  *SlateClient
+	slateShadows chan struct{}
+	registry     metrics.Registry
+	checkType    interface{}
+	certs        *CertStore
+	secrets      *SecretStore
+	redactor     *Redactor
 }
 
 // NewRunner returns a runner associated with a particular resolver.
@@ -191,9 +374,10 @@ func NewRunner(checkType interface{}) *Runner {
 	dispatcher := NewDispatcher()
 
 	r := &Runner{
-		dispatcher: dispatcher,
-		registry:   metrics.NewPrefixedChildRegistry(metricsRegistry, "runner."),
-		checkType:  checkType,
+		dispatcher:   dispatcher,
+		slateShadows: make(chan struct{}, MaxSlateShadows),
+		registry:     metrics.NewPrefixedChildRegistry(metricsRegistry, "runner."),
+		checkType:    checkType,
 	}
 
 	slateHost := config.GetConfig().SlateHost
@@ -205,29 +389,89 @@ func NewRunner(checkType interface{}) *Runner {
 	return r
 }
 
+// MinRunPeriod is the shortest period assumed between runs of a check. It
+// is used for checks, such as test checks, that have neither an interval nor
+// a schedule.
+const MinRunPeriod = 30 * time.Second
+
+// runPeriod returns the time between runs of a check: its interval, or the
+// gap between the next two runs on its cron schedule, but never less than
+// MinRunPeriod.
+func runPeriod(check *schema.Check, now time.Time) time.Duration {
+	period := time.Duration(check.Interval) * time.Second
+	if period <= 0 && check.Schedule != "" {
+		if cron, err := ParseCronSchedule(check.Schedule, check.TimeZone); err == nil {
+			next := cron.Next(now)
+			if !next.IsZero() {
+				period = cron.Next(next).Sub(next)
+			}
+		}
+	}
+	if period < MinRunPeriod {
+		period = MinRunPeriod
+	}
+	return period
+}
+
+// runContext returns the context of a run of check starting at now, which
+// ends after twice the check's run period.
+func runContext(check *schema.Check, now time.Time) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(context.Background(), now.Add(2*runPeriod(check, now)))
+}
+
 func (r *Runner) dispatch(ctx context.Context, check *schema.Check, targets []*schema.Target) (chan *Task, error) {
+	tg, err := r.taskGroup(check, targets)
+	if err != nil || tg == nil {
+		return nil, err
+	}
+
+	return r.dispatcher.Dispatch(ctx, tg), nil
+}
+
+// taskGroup returns the tasks that run a check against its targets. It
+// returns a nil TaskGroup if the check isn't run by this runner.
+func (r *Runner) taskGroup(check *schema.Check, targets []*schema.Target) (TaskGroup, error) {
 	// If the Check submitted is invalid, RunCheck will return a single
 	// CheckResponse indicating that there was an error with the Check.
-	log.WithFields(log.Fields{"check": check}).Debug("dispatch check")
+	log.WithFields(log.Fields{"check_id": check.Id}).Debug("dispatch check")
+
+	spec, err := checkSpec(check)
+	if err != nil {
+		return nil, err
+	}
+
+	// Secrets and TLS credentials are loaded once per check, and only by the
+	// runner that runs checks against targets.
+	var (
+		certs   []tls.Certificate
+		rootCAs *x509.CertPool
+	)
+	if _, ok := r.checkType.(*schema.HttpCheck); ok {
+		spec, err = r.secrets.expandSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		certs, rootCAs, err = r.certs.Credentials(specCredentials(spec))
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	tg := TaskGroup{}
+	// DNS checks don't depend on target addresses, so we only query each
+	// name once per nameserver, and share the answer between its targets.
+	dnsRequests := map[string]*DNSRequest{}
 
 	for _, target := range targets {
 		log.WithFields(log.Fields{"target": target}).Debug("dispatch - Handling target.")
 
 		var request Request
-		switch check.GetSpec().(type) {
-		case *schema.Check_HttpCheck:
-			typedCheck := check.GetHttpCheck()
+		switch typedCheck := spec.(type) {
+		case *schema.HttpCheck:
 			_, ok := r.checkType.(*schema.HttpCheck)
 			if !ok {
 				return nil, nil
 			}
-			var (
-				host       string
-				address    string
-				skipVerify = true
-			)
 
 			log.WithFields(log.Fields{"target": target}).Debug("dispatch - dispatching for target")
 			if target.Address == "" {
@@ -235,21 +479,8 @@ func (r *Runner) dispatch(ctx context.Context, check *schema.Check, targets []*s
 				continue
 			}
 
-			// special case host targets so that we may explicitly set host name in http requests
-			// and validate ssl certs
-			switch target.Type {
-			case "host", "external_host":
-				// target.Name is used to determine the hostname for TLS, since target.Id has been
-				// set to the IP address
-				host = target.Name
-				skipVerify = false
-			}
-
-			if strings.Contains(target.Address, ":") {
-				address = target.Address
-			} else {
-				address = fmt.Sprintf("%s:%d", target.Address, typedCheck.Port)
-			}
+			host, skipVerify := targetServerName(target)
+			address := targetAddress(target, typedCheck.Port)
 
 			request = &HTTPRequest{
 				Method:             typedCheck.Verb,
@@ -258,10 +489,128 @@ func (r *Runner) dispatch(ctx context.Context, check *schema.Check, targets []*s
 				Body:               typedCheck.Body,
 				Host:               host,
 				InsecureSkipVerify: skipVerify,
+				RedirectPolicy:     typedCheck.RedirectPolicy,
+				MaxRedirects:       int(typedCheck.MaxRedirects),
+				Certificates:       certs,
+				RootCAs:            rootCAs,
+			}
+
+		case *schema.TcpCheck:
+			// TCP checks are run by the same runner as HTTP checks.
+			_, ok := r.checkType.(*schema.HttpCheck)
+			if !ok {
+				return nil, nil
+			}
+
+			log.WithFields(log.Fields{"target": target}).Debug("dispatch - dispatching for target")
+			if target.Address == "" {
+				log.WithFields(log.Fields{"target": target}).Error("Target missing address.")
+				continue
+			}
+
+			host, skipVerify := targetServerName(target)
+
+			request = &TCPRequest{
+				Address:            targetAddress(target, typedCheck.Port),
+				Host:               host,
+				Send:               typedCheck.Send,
+				Expect:             typedCheck.Expect,
+				ReadBytes:          int(typedCheck.ReadBytes),
+				TLS:                typedCheck.Tls,
+				InsecureSkipVerify: skipVerify,
+				Certificates:       certs,
+				RootCAs:            rootCAs,
+			}
+
+		case *schema.TlsCheck:
+			// TLS checks are run by the same runner as HTTP checks.
+			_, ok := r.checkType.(*schema.HttpCheck)
+			if !ok {
+				return nil, nil
+			}
+
+			log.WithFields(log.Fields{"target": target}).Debug("dispatch - dispatching for target")
+			if target.Address == "" {
+				log.WithFields(log.Fields{"target": target}).Error("Target missing address.")
+				continue
+			}
+
+			host, _ := targetServerName(target)
+			if typedCheck.ServerName != "" {
+				host = typedCheck.ServerName
+			}
+
+			port := typedCheck.Port
+			if port == 0 {
+				port = 443
+			}
+
+			request = &TLSRequest{
+				Address:      targetAddress(target, port),
+				Host:         host,
+				RootCAs:      rootCAs,
+				Certificates: certs,
+			}
+
+		case *schema.DnsCheck:
+			// DNS checks are run by the same runner as HTTP checks.
+			_, ok := r.checkType.(*schema.HttpCheck)
+			if !ok {
+				return nil, nil
+			}
+
+			recordType, ok := dnsRecordType(typedCheck)
+			if !ok {
+				return nil, fmt.Errorf("Unsupported DNS record type: %s", typedCheck.RecordType)
+			}
+
+			name := typedCheck.Name
+			if name == "" {
+				name = target.Name
+			}
+			if name == "" {
+				log.WithFields(log.Fields{"target": target}).Error("DNS check missing name.")
+				continue
+			}
+
+			server := dnsServer(typedCheck)
+			dnsRequest, ok := dnsRequests[server+" "+name]
+			if !ok {
+				dnsRequest = &DNSRequest{
+					Server: server,
+					Name:   name,
+					Type:   recordType,
+				}
+				dnsRequests[server+" "+name] = dnsRequest
+			}
+			request = dnsRequest
+
+		case *schema.GrpcCheck:
+			// gRPC checks are run by the same runner as HTTP checks.
+			_, ok := r.checkType.(*schema.HttpCheck)
+			if !ok {
+				return nil, nil
+			}
+
+			log.WithFields(log.Fields{"target": target}).Debug("dispatch - dispatching for target")
+			if target.Address == "" {
+				log.WithFields(log.Fields{"target": target}).Error("Target missing address.")
+				continue
+			}
+
+			host, skipVerify := targetServerName(target)
+
+			request = &GRPCRequest{
+				Address:            targetAddress(target, typedCheck.Port),
+				Host:               host,
+				Service:            typedCheck.Service,
+				TLS:                typedCheck.Tls,
+				InsecureSkipVerify: skipVerify,
+				Certificates:       certs,
+				RootCAs:            rootCAs,
 			}
 
-		case *schema.Check_CloudwatchCheck:
-			cloudwatchCheck := check.GetCloudwatchCheck()
+		case *schema.CloudWatchCheck:
 			_, ok := r.checkType.(*schema.CloudWatchCheck)
 			if !ok {
 				return nil, nil
@@ -273,7 +622,7 @@ func (r *Runner) dispatch(ctx context.Context, check *schema.Check, targets []*s
 				log.WithFields(log.Fields{"target": target}).Error("Target missing Id")
 				continue
 			}
-			if len(cloudwatchCheck.Metrics) == 0 {
+			if len(typedCheck.Metrics) == 0 {
 				log.Info("Refusing to create CloudWatchCheck with 0 metrics")
 				continue
 			}
@@ -287,11 +636,11 @@ func (r *Runner) dispatch(ctx context.Context, check *schema.Check, targets []*s
 
 			request = &CloudWatchRequest{
 				Target:                 target,
-				Metrics:                cloudwatchCheck.Metrics,
-				StatisticsIntervalSecs: int(check.Interval * 2),
+				Metrics:                typedCheck.Metrics,
+				StatisticsIntervalSecs: int(2 * runPeriod(check, time.Now()) / time.Second),
 				StatisticsPeriod:       CloudWatchStatisticsPeriod,
 				Statistics:             []string{"Average"},
-				Namespace:              cloudwatchCheck.Metrics[0].Namespace,
+				Namespace:              typedCheck.Metrics[0].Namespace,
 				User: &schema.User{
 					Id:         1,
 					Verified:   true,
@@ -306,81 +655,178 @@ func (r *Runner) dispatch(ctx context.Context, check *schema.Check, targets []*s
 			}
 
 		default:
-			log.WithFields(log.Fields{"type": reflect.TypeOf(check.Spec)}).Error("dispatch - Unknown check type.")
+			log.WithFields(log.Fields{"type": reflect.TypeOf(spec)}).Error("dispatch - Unknown check type.")
 			return nil, fmt.Errorf("Unrecognized check type.")
 		}
 
-		t := reflect.TypeOf(request).Elem().Name()
-		log.WithFields(log.Fields{"request": request, "type": t}).Debug("dispatch - Creating task from request.")
-
 		task := &Task{
 			Target:  target,
-			Type:    t,
+			Type:    reflect.TypeOf(request).Elem().Name(),
 			Request: request,
 		}
 
-		log.Debug("dispatch - Dispatching task: %s", *task)
+		log.WithFields(task.logFields()).Debug("dispatch - Dispatching task.")
 
 		tg = append(tg, task)
 	}
 
-	return r.dispatcher.Dispatch(ctx, tg), nil
+	return tg, nil
+}
+
+// targetServerName returns the TLS server name to use for a target and whether
+// certificate verification should be skipped. Host targets are special cased
+// so that we may explicitly set the host name in requests and validate certs.
+func targetServerName(target *schema.Target) (string, bool) {
+	switch target.Type {
+	case "host", "external_host":
+		// target.Name is used to determine the hostname for TLS, since target.Id has been
+		// set to the IP address
+		return target.Name, false
+	}
+	return "", true
+}
+
+// targetAddress returns a dialable address for a target, using port unless
+// the target address already includes one.
+func targetAddress(target *schema.Target, port int32) string {
+	if strings.Contains(target.Address, ":") {
+		return target.Address
+	}
+	return fmt.Sprintf("%s:%d", target.Address, port)
 }
 
 func (r *Runner) runAssertions(ctx context.Context, check *schema.Check, tasks chan *Task) []*schema.CheckResponse {
 	responses := []*schema.CheckResponse{}
 	for t := range tasks {
-		if t.Response == nil {
-			log.WithFields(log.Fields{"task": *t}).Error("Task has no response")
-			continue
+		if response := r.checkResponse(check, t); response != nil {
+			responses = append(responses, response)
 		}
+	}
 
-		log.WithFields(log.Fields{"task": *t}).Debug("runAssertions - Handling finished task.")
+	return responses
+}
 
-		passing := false
+// checkResponse evaluates a check's assertions against a finished task,
+// returning nil if the task has no response.
+func (r *Runner) checkResponse(check *schema.Check, t *Task) *schema.CheckResponse {
+	if t.Response == nil {
+		log.WithFields(t.logFields()).Error("Task has no response")
+		return nil
+	}
 
-		response := &schema.CheckResponse{
-			Target: t.Target,
-			Reply:  t.Response.Response,
-		}
+	log.WithFields(t.logFields()).Debug("runAssertions - Handling finished task.")
 
-		if e := t.Response.Error; e != nil {
-			response.Error = e.Error()
-		}
+	passing := false
+	evaluated := false
 
-		if response.Error == "" && len(check.Assertions) > 0 && r.slateClient != nil {
-			var (
-				jsonBytes json.RawMessage
-				err       error
-			)
-			switch t := response.Reply.(type) {
-			case *schema.CheckResponse_HttpResponse:
-				jsonBytes, err = json.Marshal(t.HttpResponse)
-			case *schema.CheckResponse_CloudwatchResponse:
-				jsonBytes, err = json.Marshal(t.CloudwatchResponse)
-			default:
-				err = fmt.Errorf("reply type not found: %#v", t)
-			}
+	response := &schema.CheckResponse{
+		Target: t.Target,
+		Reply:  t.Response.Response,
+	}
 
-			if err != nil {
-				log.WithError(err).Error("Couldn't marshal check response reply.")
-				return nil
-			}
+	if e := t.Response.Error; e != nil {
+		response.Error = e.Error()
+	}
 
-			passing, err = r.slateClient.CheckAssertions(ctx, check, jsonBytes)
+	// A check without assertions is never passing.
+	var jsonBytes json.RawMessage
+	if response.Error == "" && len(check.Assertions) > 0 {
+		var err error
+		jsonBytes, err = replyJSON(response)
+		if err != nil {
+			log.WithError(err).Error("Couldn't marshal check response reply.")
+			response.Error = err.Error()
+		} else {
+			passing, response.AssertionResults, err = EvaluateAssertions(check.Assertions, jsonBytes)
+			evaluated = true
 			if err != nil {
-				// even one failure with contacting slate will cause the check to not be run
-				log.WithError(err).Error("Could not contact slate.")
-				return nil
+				log.WithError(err).Error("Couldn't evaluate assertions.")
+				response.Error = err.Error()
 			}
 		}
-		log.WithFields(log.Fields{"Check Name": check.Name, "Check Id": check.Id}).Debugf("Check is passing: %t", passing)
+	}
+	log.WithFields(log.Fields{"Check Name": check.Name, "Check Id": check.Id}).Debugf("Check is passing: %t", passing)
 
-		response.Passing = passing
-		responses = append(responses, response)
+	response.Passing = passing
+
+	// Targets may echo secrets back, and responses may carry data that
+	// shouldn't leave the bastion, so they're redacted once assertions have
+	// been evaluated, before they're sent anywhere.
+	r.secrets.RedactResponse(response)
+	r.redactor.RedactResponse(response)
+
+	// Slate is given the reply the assertions were evaluated against, from
+	// before redaction.
+	if evaluated {
+		r.shadowSlate(check, jsonBytes, passing)
 	}
 
-	return responses
+	return response
+}
+
+// replyJSON returns the JSON form of a check response's reply, which is what
+// assertions are evaluated against.
+func replyJSON(response *schema.CheckResponse) (json.RawMessage, error) {
+	switch t := response.Reply.(type) {
+	case *schema.CheckResponse_HttpResponse:
+		return json.Marshal(t.HttpResponse)
+	case *schema.CheckResponse_CloudwatchResponse:
+		return json.Marshal(t.CloudwatchResponse)
+	case *schema.CheckResponse_TcpResponse:
+		return json.Marshal(t.TcpResponse)
+	case *schema.CheckResponse_TlsResponse:
+		return json.Marshal(t.TlsResponse)
+	case *schema.CheckResponse_DnsResponse:
+		return json.Marshal(t.DnsResponse)
+	case *schema.CheckResponse_GrpcResponse:
+		return json.Marshal(t.GrpcResponse)
+	default:
+		return nil, fmt.Errorf("reply type not found: %#v", t)
+	}
+}
+
+// shadowSlate compares the local assertion result with Slate's in the
+// background, unless MaxSlateShadows comparisons are already in flight.
+func (r *Runner) shadowSlate(check *schema.Check, jsonBytes json.RawMessage, passing bool) {
+	if r.slateClient == nil {
+		return
+	}
+
+	select {
+	case r.slateShadows <- struct{}{}:
+	default:
+		metrics.GetOrRegisterCounter("slate_skipped", r.registry).Inc(1)
+		return
+	}
+
+	go func() {
+		defer func() { <-r.slateShadows }()
+		r.compareWithSlate(check, jsonBytes, passing)
+	}()
+}
+
+// compareWithSlate asks Slate to evaluate the assertions as well, and records
+// any disagreement with the local result. Slate is advisory only: failing to
+// contact it never affects the check.
+func (r *Runner) compareWithSlate(check *schema.Check, jsonBytes json.RawMessage, passing bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), SlateShadowTimeout)
+	defer cancel()
+
+	slatePassing, err := r.slateClient.CheckAssertions(ctx, check, jsonBytes)
+	if err != nil {
+		log.WithError(err).Warn("Could not contact slate.")
+		metrics.GetOrRegisterCounter("slate_errors", r.registry).Inc(1)
+		return
+	}
+
+	if slatePassing != passing {
+		log.WithFields(log.Fields{
+			"check_id": check.Id,
+			"local":    passing,
+			"slate":    slatePassing,
+		}).Warn("Slate disagrees with local assertion result.")
+		metrics.GetOrRegisterCounter("slate_mismatches", r.registry).Inc(1)
+	}
 }
 
 // If the Context passed to RunCheck includes a MaxHosts value, at most MaxHosts
@@ -413,12 +859,43 @@ func (r *Runner) RunCheck(ctx context.Context, check *schema.Check, targets []*s
 		return nil, nil
 	}
 
-	// TODO(greg): Move assertion processing to a parallel model, but for now
-	// try to be a little nicer to slate and run these serially, blocking until
-	// all assertions have been processed.
-	// In the event of a slate failure, we're return nil for the list of responses,
-	// which will skip putting results on the queue!
-	// TODO: Alert opsee in that scenario
+	// Assertions are evaluated locally, so every dispatched check yields
+	// responses. Slate, if configured, is only consulted for comparison.
 	responses := r.runAssertions(ctx, check, tasks)
 	return responses, nil
 }
+
+// StreamCheck runs a check like RunCheck, but calls respond with each
+// target's response as soon as its task finishes. If maxHosts is greater than
+// zero, dispatching stops once maxHosts responses have arrived, and later
+// tasks are cancelled. StreamCheck returns the responses passed to respond,
+// or nil if the check isn't run by this runner.
+func (r *Runner) StreamCheck(ctx context.Context, check *schema.Check, targets []*schema.Target, maxHosts int, respond func(*schema.CheckResponse)) ([]*schema.CheckResponse, error) {
+	tg, err := r.taskGroup(check, targets)
+	if err != nil || tg == nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	responses := []*schema.CheckResponse{}
+	for t := range r.dispatcher.Stream(ctx, tg) {
+		response := r.checkResponse(check, t)
+		if response == nil {
+			continue
+		}
+
+		responses = append(responses, response)
+		respond(response)
+
+		if maxHosts > 0 && len(responses) >= maxHosts {
+			// Tasks still running return as soon as they see the
+			// cancellation, and the dispatcher's channel is buffered, so
+			// there's no need to wait for them.
+			break
+		}
+	}
+
+	return responses, nil
+}
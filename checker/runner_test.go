@@ -92,6 +92,56 @@ func (s *RunnerTestSuite) TestRunCheckAdheresToMaxHosts() {
 	assert.Equal(s.T(), 1, len(responses))
 }
 
+func (s *RunnerTestSuite) TestStreamCheckRespondsPerTarget() {
+	check := s.Common.PassingCheckMultiTarget()
+	targets, err := s.Resolver.Resolve(s.Context, &schema.Target{
+		Id: "sg3",
+	})
+	assert.NoError(s.T(), err)
+
+	streamed := []*schema.CheckResponse{}
+	responses, err := s.Runner.StreamCheck(s.Context, check, targets, 0, func(response *schema.CheckResponse) {
+		streamed = append(streamed, response)
+	})
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), responses, 3)
+	assert.Equal(s.T(), responses, streamed)
+	for _, response := range responses {
+		assert.NotNil(s.T(), response.Reply)
+	}
+}
+
+func (s *RunnerTestSuite) TestStreamCheckStopsAtMaxHosts() {
+	check := s.Common.PassingCheckMultiTarget()
+	targets, err := s.Resolver.Resolve(s.Context, &schema.Target{
+		Id: "sg3",
+	})
+	assert.NoError(s.T(), err)
+
+	streamed := 0
+	responses, err := s.Runner.StreamCheck(s.Context, check, targets, 2, func(response *schema.CheckResponse) {
+		streamed++
+	})
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), responses, 2)
+	assert.Equal(s.T(), 2, streamed)
+}
+
+func (s *RunnerTestSuite) TestStreamCheckSkipsOtherCheckTypes() {
+	check := s.Common.PassingCheckMultiTarget()
+	targets, err := s.Resolver.Resolve(s.Context, &schema.Target{
+		Id: "sg3",
+	})
+	assert.NoError(s.T(), err)
+
+	runner := NewRunner(&schema.CloudWatchCheck{})
+	responses, err := runner.StreamCheck(s.Context, check, targets, 0, func(response *schema.CheckResponse) {
+		assert.Fail(s.T(), "StreamCheck responded to a check of another type.")
+	})
+	assert.NoError(s.T(), err)
+	assert.Nil(s.T(), responses)
+}
+
 func (s *RunnerTestSuite) TestRunCheckCanCheckAnInstanceTarget() {
 	ctx := context.WithValue(s.Context, "MaxHosts", 3)
 	targets, err := s.Resolver.Resolve(s.Context, &schema.Target{
@@ -164,6 +214,46 @@ func (s *RunnerTestSuite) TestRunCheckBadCheckReturnsError() {
 	assert.Nil(s.T(), responses)
 }
 
+func (s *RunnerTestSuite) TestRunPeriod() {
+	now := time.Date(2016, 3, 1, 12, 0, 30, 0, time.UTC)
+	check := s.Common.PassingCheck()
+
+	check.Interval = 120
+	assert.Equal(s.T(), 2*time.Minute, runPeriod(check, now))
+
+	check.Interval = 0
+	check.Schedule = "0 */6 * * *"
+	assert.Equal(s.T(), 6*time.Hour, runPeriod(check, now))
+
+	check.Schedule = ""
+	assert.Equal(s.T(), MinRunPeriod, runPeriod(check, now))
+}
+
+func (s *RunnerTestSuite) TestRunCheckWithScheduleAndZeroInterval() {
+	check := s.Common.PassingCheckMultiTarget()
+	check.Interval = 0
+	check.Schedule = "*/5 * * * *"
+	targets, err := s.Resolver.Resolve(s.Context, &schema.Target{
+		Id: "sg3",
+	})
+	assert.NoError(s.T(), err)
+
+	now := time.Now()
+	ctx, cancel := runContext(check, now)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(s.T(), ok)
+	assert.True(s.T(), deadline.Sub(now) >= 2*MinRunPeriod)
+
+	responses, err := s.Runner.RunCheck(ctx, check, targets)
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), responses, 3)
+	for _, response := range responses {
+		assert.Empty(s.T(), response.Error)
+		assert.NotNil(s.T(), response.Reply)
+	}
+}
+
 func TestRunnerTestSuite(t *testing.T) {
 	setupTestEnv()
 	suite.Run(t, new(RunnerTestSuite))
@@ -2,6 +2,9 @@ package checker
 
 import (
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
@@ -9,6 +12,7 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/opsee/basic/schema"
 	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+	metrics "github.com/rcrowley/go-metrics"
 )
 
 const (
@@ -20,65 +24,225 @@ func validateCheck(check *schema.Check) error {
 	if check.Id == "" {
 		return fmt.Errorf("Check has null ID")
 	}
-	if check.Interval < MinimumCheckInterval {
+	if check.Schedule != "" {
+		if _, err := ParseCronSchedule(check.Schedule, check.TimeZone); err != nil {
+			return fmt.Errorf("Invalid check schedule: %s", err)
+		}
+	} else if check.Interval < MinimumCheckInterval {
 		return fmt.Errorf("Check interval below threshold (%d minimum): %d", MinimumCheckInterval, check.Interval)
 	}
 	if check.Target == nil {
 		return fmt.Errorf("Check has null target")
 	}
-	if check.Spec == nil {
-		return fmt.Errorf("Check has null Spec")
+	if _, err := checkSpec(check); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-// CheckTimer sends a check over a channel at a set interval.
-// TODO(greg): Instead of sending check pointers over this channel, we should send a check execution
-// task -- some wrapper object with a context that includes a deadline. Basically, add contexts to
-// scheduled executions.
+// normalizeCheck turns the check spec into the oneof for check types that
+// have one. Since we're still retrieving checks from bartnet, this should be
+// done for every check on its way into the scheduler.
+// TODO: remove this after no bartnet
+func normalizeCheck(check *schema.Check) error {
+	if check.Spec == nil && check.CheckSpec != nil {
+		any, err := opsee_types.UnmarshalAny(check.CheckSpec)
+		if err != nil {
+			log.WithError(err).Error("couldn't unmarshal the check spec from bartnet")
+			return err
+		}
+
+		switch spec := any.(type) {
+		case *schema.HttpCheck:
+			check.Spec = &schema.Check_HttpCheck{spec}
+		case *schema.CloudWatchCheck:
+			check.Spec = &schema.Check_CloudwatchCheck{spec}
+		case *schema.TcpCheck:
+			check.Spec = &schema.Check_TcpCheck{TcpCheck: spec}
+		case *schema.TlsCheck:
+			check.Spec = &schema.Check_TlsCheck{TlsCheck: spec}
+		case *schema.DnsCheck:
+			check.Spec = &schema.Check_DnsCheck{DnsCheck: spec}
+		case *schema.GrpcCheck:
+			check.Spec = &schema.Check_GrpcCheck{GrpcCheck: spec}
+		}
+	}
+
+	return nil
+}
+
+// scheduleOffset returns the check's phase within its interval. It is derived
+// from the check ID, so that a check always runs at the same point in its
+// interval, even across restarts, and checks are spread evenly across their
+// intervals instead of all running at once.
+func scheduleOffset(checkId string, interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(checkId))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// A runSchedule computes when a check runs.
+type runSchedule interface {
+	// Next returns the first run after t.
+	Next(t time.Time) time.Time
+}
+
+// intervalSchedule runs a check every interval, at its offset within the
+// interval.
+type intervalSchedule struct {
+	interval time.Duration
+	offset   time.Duration
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	next := t.Truncate(s.interval).Add(s.offset)
+	if !next.After(t) {
+		next = next.Add(s.interval)
+	}
+	return next
+}
+
+// CheckTimer queues runs of a check at a set interval, or on its cron
+// schedule.
 type CheckTimer struct {
-	Check   *schema.Check
-	runChan chan *schema.Check
-	stop    chan struct{}
-	ticker  *time.Ticker
-}
-
-// NewCheckTimer creates a new timer and associates the given channel with that timer.
-// Every N seconds (the Check's Duration field), the CheckTimer will send the check over
-// the runChan channel. If this channel blocks for more than N seconds, you will start
-// executing stale check requests. Managing backpressure for this channel is important.
-// TODO(greg): manage backpressure for this channel.
-func NewCheckTimer(check *schema.Check, runChan chan *schema.Check) (*CheckTimer, error) {
+	Check *schema.Check
+	// Interval is zero for checks with a cron schedule.
+	Interval time.Duration
+	// Offset is the check's phase within its interval.
+	Offset time.Duration
+	// Cron is the check's cron schedule, if it has one.
+	Cron *CronSchedule
+	// Jitter is the most that is randomly added to each run.
+	Jitter   time.Duration
+	schedule runSchedule
+	queue    *runQueue
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	lock    sync.Mutex
+	nextRun time.Time
+}
+
+// NewCheckTimer creates a new timer and associates the given queue with that timer.
+// Every N seconds (the Check's Duration field), at its offset within the interval plus
+// up to jitter, the CheckTimer will push a run of the check onto the queue. The run's
+// deadline is the end of the interval, so that a run that can't be published before
+// the next one is due is dropped instead of executed late. A check with a cron schedule
+// runs on its schedule instead, with no offset.
+func NewCheckTimer(check *schema.Check, queue *runQueue, jitter time.Duration) (*CheckTimer, error) {
+	if check.Schedule != "" {
+		cron, err := ParseCronSchedule(check.Schedule, check.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+		return startCheckTimer(&CheckTimer{
+			Check:    check,
+			Cron:     cron,
+			Jitter:   jitter,
+			schedule: cron,
+			queue:    queue,
+		}), nil
+	}
+
 	d, err := time.ParseDuration(fmt.Sprintf("%ds", check.Interval))
 	if err != nil {
 		return nil, err
 	}
-	ct := &CheckTimer{
-		check,
-		runChan,
-		make(chan struct{}, 1),
-		time.NewTicker(d),
+	if d <= 0 {
+		return nil, fmt.Errorf("Invalid check interval: %s", d)
+	}
+	// Jitter must never push a run into the next interval.
+	if jitter >= d {
+		jitter = d / 2
 	}
 
-	go func() {
-		for {
-			select {
-			case <-ct.ticker.C:
-				ct.runChan <- ct.Check
-			case <-ct.stop:
-				ct.ticker.Stop()
-				return
-			}
+	offset := scheduleOffset(check.Id, d)
+	return startCheckTimer(&CheckTimer{
+		Check:    check,
+		Interval: d,
+		Offset:   offset,
+		Jitter:   jitter,
+		schedule: intervalSchedule{interval: d, offset: offset},
+		queue:    queue,
+	}), nil
+}
+
+func startCheckTimer(ct *CheckTimer) *CheckTimer {
+	ct.stop = make(chan struct{})
+	ct.nextRun = ct.schedule.Next(time.Now())
+
+	go ct.run()
+
+	return ct
+}
+
+// jitter returns a random delay for the run at next, less than Jitter and
+// less than half the time until the following run.
+func (c *CheckTimer) jitter(next time.Time) time.Duration {
+	max := c.Jitter
+	if gap := c.schedule.Next(next).Sub(next); max >= gap {
+		max = gap / 2
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// deadline returns the deadline of a run: the end of the interval, or the
+// following run on the check's schedule.
+func (c *CheckTimer) deadline(scheduledAt time.Time) time.Time {
+	if c.Interval > 0 {
+		return scheduledAt.Add(c.Interval)
+	}
+	return c.schedule.Next(scheduledAt)
+}
+
+func (c *CheckTimer) run() {
+	for {
+		next := c.NextRun()
+		wait := next.Sub(time.Now()) + c.jitter(next)
+
+		timer := time.NewTimer(wait)
+		select {
+		case scheduledAt := <-timer.C:
+			c.queue.Push(&ScheduledRun{
+				Check:       c.Check,
+				ScheduledAt: scheduledAt,
+				Deadline:    c.deadline(scheduledAt),
+			})
+		case <-c.stop:
+			timer.Stop()
+			return
 		}
-	}()
 
-	return ct, nil
+		// Never run twice in the same interval, even if the clock steps back.
+		now := time.Now()
+		if now.Before(next) {
+			now = next
+		}
+		c.lock.Lock()
+		c.nextRun = c.schedule.Next(now)
+		c.lock.Unlock()
+	}
+}
+
+// NextRun returns the time of the check's next run, before jitter.
+func (c *CheckTimer) NextRun() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.nextRun
 }
 
-// Stop the Check's timer.
+// Stop the Check's timer. It is safe to call more than once.
 func (c *CheckTimer) Stop() {
-	c.stop <- struct{}{}
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
 }
 
 /*******************************************************************************
@@ -87,36 +251,52 @@ func (c *CheckTimer) Stop() {
 
 type scheduleMap struct {
 	sync.RWMutex
-	checks  map[string]*CheckTimer
-	runChan chan *schema.Check
+	checks map[string]*CheckTimer
+	queue  *runQueue
 }
 
-func newScheduleMap() *scheduleMap {
+func newScheduleMap(registry metrics.Registry) *scheduleMap {
 	return &scheduleMap{
-		checks:  make(map[string]*CheckTimer),
-		runChan: make(chan *schema.Check, 10),
+		checks: make(map[string]*CheckTimer),
+		queue:  newRunQueue(registry),
 	}
 }
 
-func (m *scheduleMap) RunChan() chan *schema.Check {
-	return m.runChan
+func (m *scheduleMap) Queue() *runQueue {
+	return m.queue
 }
 
 // Set adds a new CheckTimer to the schedule map, returning the CheckTimer
-// after creation. It blocks acquiring a write lock on the schedule map.
+// after creation. It blocks acquiring a write lock on the schedule map. A
+// CheckTimer already set for key is stopped, as by Replace, so that the check
+// isn't run by both.
+
+func (m *scheduleMap) Set(key string, check *schema.Check, jitter time.Duration) (*CheckTimer, error) {
+	ct, _, err := m.Replace(key, check, jitter)
+	return ct, err
+}
 
-func (m *scheduleMap) Set(key string, check *schema.Check) (*CheckTimer, error) {
+// Replace swaps the CheckTimer for key for a new one for check, returning the
+// CheckTimer it replaced, if any. If the new CheckTimer can't be created, the
+// schedule map is left as it was. The replaced check's pending run is
+// discarded, so that it doesn't run with its old definition.
+
+func (m *scheduleMap) Replace(key string, check *schema.Check, jitter time.Duration) (*CheckTimer, *CheckTimer, error) {
 	m.Lock()
 	defer m.Unlock()
-	ct, err := NewCheckTimer(check, m.runChan)
+	ct, err := NewCheckTimer(check, m.queue, jitter)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	m.checks[key] = ct
 
-	m.runChan <- ct.Check
+	old := m.checks[key]
+	if old != nil {
+		old.Stop()
+		m.queue.Remove(key)
+	}
+	m.checks[key] = ct
 
-	return ct, nil
+	return ct, old, nil
 }
 
 // Get blocks until it can acquire a read lock on the schedule map, it then
@@ -129,9 +309,21 @@ func (m *scheduleMap) Get(key string) *CheckTimer {
 	return v
 }
 
+// Checks returns every scheduled check.
+
+func (m *scheduleMap) Checks() []*schema.Check {
+	m.RLock()
+	defer m.RUnlock()
+	checks := make([]*schema.Check, 0, len(m.checks))
+	for _, ct := range m.checks {
+		checks = append(checks, ct.Check)
+	}
+	return checks
+}
+
 // Delete blocks until it can acquire a write lock on the schedule map, and
-// then deletes the check from the schedule map. It also stops the ticker for
-// the check so that it can be GC'd.
+// then deletes the check from the schedule map. It also stops the timer for
+// the check so that it can be GC'd, and discards its pending run.
 
 func (m *scheduleMap) Delete(key string) *CheckTimer {
 	m.Lock()
@@ -141,19 +333,20 @@ func (m *scheduleMap) Delete(key string) *CheckTimer {
 		v.Stop()
 	}
 	delete(m.checks, key)
+	m.queue.Remove(key)
 
 	return v
 }
 
-// Destroy will stop all of the tickers in a schedulemap and close the
-// channel returned by RunChan().
+// Destroy will stop all of the timers in a schedulemap and close the
+// queue returned by Queue().
 func (m *scheduleMap) Destroy() {
 	m.Lock()
 	defer m.Unlock()
 	for _, check := range m.checks {
-		check.ticker.Stop()
+		check.Stop()
 	}
-	close(m.runChan)
+	m.queue.Close()
 }
 
 type Publisher interface {
@@ -161,22 +354,31 @@ type Publisher interface {
 	Stop()
 }
 
-//  Scheduler is responsible for managing the set of timers used for checks
+//	Scheduler is responsible for managing the set of timers used for checks
+//
 // as well as publishing requests for runners to run checks.
 type Scheduler struct {
 	scheduleMap *scheduleMap
 	Producer    Publisher
+	// Jitter is the most that is randomly added to each scheduled run of a
+	// check, on top of its offset within its interval.
+	Jitter time.Duration
+	// Maintenance, if set, mutes or skips runs during maintenance windows.
+	Maintenance *MaintenanceStore
 	stopChan    chan struct{}
 	resolver    Resolver
+	registry    metrics.Registry
 }
 
 // NewScheduler creates a funcitoning scheduler including its own scheduleMap.
 
 func NewScheduler(r Resolver) *Scheduler {
+	registry := metrics.NewPrefixedChildRegistry(metricsRegistry, "scheduler.")
 	scheduler := &Scheduler{
-		scheduleMap: newScheduleMap(),
+		scheduleMap: newScheduleMap(registry),
 		stopChan:    make(chan struct{}, 1),
 		resolver:    r,
+		registry:    registry,
 	}
 
 	return scheduler
@@ -185,32 +387,42 @@ func NewScheduler(r Resolver) *Scheduler {
 // CreateCheck takes as its input a Check. It maintains an internal mapping of
 // check.ID -> check. If a check for that ID already exists, it will return the
 // previous value for the Check. This is so that we can be aware of check
-// redefinition when it happens.
+// redefinition when it happens. The check's first run is queued immediately,
+// rather than at its first scheduled time.
 
 func (s *Scheduler) CreateCheck(check *schema.Check) (*schema.Check, error) {
-	// since we're still retrieving checks from bartnet, turn the check spec into the oneof
-	// this should be the sole entrypoint for checks
-	// TODO: remove this after no bartnet
-	if check.Spec == nil && check.CheckSpec != nil {
-		any, err := opsee_types.UnmarshalAny(check.CheckSpec)
-		if err != nil {
-			log.WithError(err).Error("couldn't unmarshal the check spec from bartnet")
-			return nil, err
-		}
+	c, err := s.RestoreCheck(check)
+	if err != nil {
+		return c, err
+	}
 
-		switch spec := any.(type) {
-		case *schema.HttpCheck:
-			check.Spec = &schema.Check_HttpCheck{spec}
-		case *schema.CloudWatchCheck:
-			check.Spec = &schema.Check_CloudwatchCheck{spec}
-		}
+	if ct := s.scheduleMap.Get(c.Id); ct != nil {
+		now := time.Now()
+		s.scheduleMap.Queue().Push(&ScheduledRun{
+			Check:       ct.Check,
+			ScheduledAt: now,
+			Deadline:    ct.deadline(now),
+		})
+	}
+
+	return c, nil
+}
+
+// RestoreCheck schedules a check that was already scheduled before, such as
+// one loaded from a snapshot. Unlike CreateCheck, it doesn't queue an
+// immediate run, so that restoring many checks at once doesn't run them all
+// at the same moment.
+
+func (s *Scheduler) RestoreCheck(check *schema.Check) (*schema.Check, error) {
+	if err := normalizeCheck(check); err != nil {
+		return nil, err
 	}
 
 	if err := validateCheck(check); err != nil {
 		return check, err
 	}
 
-	ct, err := s.scheduleMap.Set(check.Id, check)
+	ct, err := s.scheduleMap.Set(check.Id, check, s.Jitter)
 	if err != nil {
 		return nil, err
 	}
@@ -218,6 +430,34 @@ func (s *Scheduler) CreateCheck(check *schema.Check) (*schema.Check, error) {
 	return ct.Check, nil
 }
 
+// UpdateCheck atomically replaces the definition of a check, returning the
+// new definition and the names of the fields that changed. The new definition
+// is validated first: if it is invalid, the existing check keeps running and
+// is returned with the error. A check that doesn't exist yet is created.
+
+func (s *Scheduler) UpdateCheck(check *schema.Check) (*schema.Check, []string, error) {
+	err := normalizeCheck(check)
+	if err == nil {
+		err = validateCheck(check)
+	}
+	if err != nil {
+		if ct := s.scheduleMap.Get(check.Id); ct != nil {
+			return ct.Check, nil, err
+		}
+		return nil, nil, err
+	}
+
+	ct, old, err := s.scheduleMap.Replace(check.Id, check, s.Jitter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if old == nil {
+		return ct.Check, nil, nil
+	}
+	return ct.Check, changedFields(old.Check, ct.Check), nil
+}
+
 // Retrieve a Check by ID. If a check associated with the ID exists, then it
 // will be returned. Otherwise, it will return nil and an error indicating the
 // check does not exist.
@@ -238,6 +478,63 @@ func (s *Scheduler) RetrieveCheck(check *schema.Check) (*schema.Check, error) {
 	return ct.Check, err
 }
 
+// ScheduleEntry describes when a check runs.
+type ScheduleEntry struct {
+	CheckId  string        `json:"check_id"`
+	Interval time.Duration `json:"interval,omitempty"`
+	Offset   time.Duration `json:"offset"`
+	Schedule string        `json:"schedule,omitempty"`
+	TimeZone string        `json:"time_zone,omitempty"`
+	Jitter   time.Duration `json:"jitter"`
+	NextRun  time.Time     `json:"next_run"`
+
+	check *schema.Check
+}
+
+// Schedule returns the schedule of every check, in the order they will next
+// run.
+
+func (s *Scheduler) Schedule() []*ScheduleEntry {
+	s.scheduleMap.RLock()
+	schedule := make([]*ScheduleEntry, 0, len(s.scheduleMap.checks))
+	for id, ct := range s.scheduleMap.checks {
+		entry := &ScheduleEntry{
+			CheckId:  id,
+			Interval: ct.Interval,
+			Offset:   ct.Offset,
+			Jitter:   ct.Jitter,
+			NextRun:  ct.NextRun(),
+			check:    ct.Check,
+		}
+		if ct.Cron != nil {
+			entry.Schedule = ct.Cron.Expression
+			entry.TimeZone = ct.Cron.Location.String()
+		}
+		schedule = append(schedule, entry)
+	}
+	s.scheduleMap.RUnlock()
+
+	sort.Sort(byNextRun(schedule))
+	return schedule
+}
+
+type byNextRun []*ScheduleEntry
+
+func (b byNextRun) Len() int      { return len(b) }
+func (b byNextRun) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byNextRun) Less(i, j int) bool {
+	if b[i].NextRun.Equal(b[j].NextRun) {
+		return b[i].CheckId < b[j].CheckId
+	}
+	return b[i].NextRun.Before(b[j].NextRun)
+}
+
+// Checks returns every scheduled check.
+
+func (s *Scheduler) Checks() []*schema.Check {
+	return s.scheduleMap.Checks()
+}
+
 func (s *Scheduler) DeleteCheck(check *schema.Check) (*schema.Check, error) {
 	var (
 		c   *CheckTimer
@@ -262,44 +559,16 @@ func (s *Scheduler) Start() error {
 	}
 
 	go func() {
+		queue := s.scheduleMap.Queue()
 		for {
 			select {
 			case <-s.stopChan:
 				s.Producer.Stop()
 				s.scheduleMap.Destroy()
 				return
-			case check := <-s.scheduleMap.RunChan():
-				var (
-					checkWithTargets *schema.CheckTargets
-					err              error
-				)
-
-				// TODO(greg): Clean this up and get rid of schema.CheckTargets.
-				checkWithTargets, err = NewCheckTargets(s.resolver, check)
-				if err != nil {
-					log.Error(err.Error())
-				}
-
-				if checkWithTargets == nil {
-					checkWithTargets = &schema.CheckTargets{
-						Check:   check,
-						Targets: nil,
-					}
-				}
-
-				msg, err := proto.Marshal(checkWithTargets)
-				if err != nil {
-					log.Error(err.Error())
-				} else {
-					// TODO(greg): All of the channel configuration stuff, really needs to
-					// be centralized and easily managed. It can just be a static file or
-					// something that every microservice refers to--just to make sure
-					// they're all on the same page.
-					if err := s.Producer.Publish("runner", msg); err != nil {
-						log.Error(err.Error())
-					} else {
-						log.Debug("Scheduled check for execution: %s", check.Id)
-					}
+			case <-queue.Ready():
+				if run := queue.Pop(); run != nil {
+					s.publish(run)
 				}
 			}
 		}
@@ -308,6 +577,72 @@ func (s *Scheduler) Start() error {
 	return nil
 }
 
+// publish publishes a run request for runners, unless it has gone stale.
+
+func (s *Scheduler) publish(run *ScheduledRun) {
+	check := run.Check
+
+	now := time.Now()
+	if now.After(run.Deadline) {
+		log.WithFields(log.Fields{"check_id": check.Id, "scheduled_at": run.ScheduledAt}).Warn("Dropping stale check run.")
+		metrics.GetOrRegisterCounter("runs_dropped", s.registry).Inc(1)
+		return
+	}
+
+	delay := now.Sub(run.ScheduledAt)
+	metrics.GetOrRegisterTimer("run_delay", s.registry).Update(delay)
+	if delay > LateRunThreshold {
+		metrics.GetOrRegisterCounter("runs_late", s.registry).Inc(1)
+	}
+
+	var (
+		checkWithTargets *schema.CheckTargets
+		err              error
+	)
+
+	// TODO(greg): Clean this up and get rid of schema.CheckTargets.
+	checkWithTargets, err = NewCheckTargets(s.resolver, check)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	if checkWithTargets == nil {
+		checkWithTargets = &schema.CheckTargets{
+			Check:   check,
+			Targets: nil,
+		}
+	}
+
+	if s.Maintenance != nil {
+		checkWithTargets = s.Maintenance.Apply(checkWithTargets, now, s.resolver)
+		if checkWithTargets == nil {
+			log.WithField("check_id", check.Id).Debug("Skipping check run during maintenance window.")
+			metrics.GetOrRegisterCounter("runs_skipped", s.registry).Inc(1)
+			return
+		}
+		if checkWithTargets.Muted {
+			metrics.GetOrRegisterCounter("runs_muted", s.registry).Inc(1)
+		}
+	}
+
+	msg, err := proto.Marshal(checkWithTargets)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	// TODO(greg): All of the channel configuration stuff, really needs to
+	// be centralized and easily managed. It can just be a static file or
+	// something that every microservice refers to--just to make sure
+	// they're all on the same page.
+	if err := s.Producer.Publish("runner", msg); err != nil {
+		log.Error(err.Error())
+	} else {
+		metrics.GetOrRegisterCounter("runs_published", s.registry).Inc(1)
+		log.Debug("Scheduled check for execution: %s", check.Id)
+	}
+}
+
 func (s *Scheduler) Stop() {
 	s.stopChan <- struct{}{}
 }
@@ -1,11 +1,17 @@
 package checker
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+	metrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/context"
 )
 
 // Test the Scheduler
@@ -56,6 +62,24 @@ func (s *SchedulerTestSuite) TestCheckWithoutSpecIsInvalid() {
 	assert.Error(s.T(), validateCheck(check))
 }
 
+func (s *SchedulerTestSuite) TestCheckWithScheduleIsValid() {
+	check := s.Common.Check()
+	check.Interval = 0
+	check.Schedule = "5 2 * * *"
+	check.TimeZone = "America/Los_Angeles"
+	assert.NoError(s.T(), validateCheck(check))
+}
+
+func (s *SchedulerTestSuite) TestCheckWithInvalidScheduleIsInvalid() {
+	check := s.Common.Check()
+	check.Schedule = "5 25 * * *"
+	assert.Error(s.T(), validateCheck(check))
+
+	check.Schedule = "5 2 * * *"
+	check.TimeZone = "Nowhere/Special"
+	assert.Error(s.T(), validateCheck(check))
+}
+
 /*******************************************************************************
  * CreateCheck()
  ******************************************************************************/
@@ -72,19 +96,76 @@ func (s *SchedulerTestSuite) TestCreateCheckStoresCheck() {
 	assert.Equal(s.T(), id, c.Id, "Scheduler.RetrieveCheck returned ID does not match.")
 }
 
-// TODO(greg): I don't know why this causes tests to hang, but it does. I'm
-// commenting this test out for now. We can fix it later.
-// func (s *SchedulerTestSuite) TestCreateCheckStartsSchedulingCheck() {
-// 	scheduler := s.Scheduler
-// 	check := s.Common.PassingCheck()
-// 	check.Interval = 1
-// 	id := check.Id
-// 	scheduler.CreateCheck(check)
-// 	rcvdCheck := <-scheduler.scheduleMap.runChan
-// 	scheduler.scheduleMap.Destroy()
-// 	assert.NotNil(s.T(), rcvdCheck)
-// 	assert.Equal(s.T(), id, rcvdCheck.Id)
-// }
+func (s *SchedulerTestSuite) TestCreateCheckQueuesFirstRun() {
+	check := s.Common.Check()
+	_, err := s.Scheduler.CreateCheck(check)
+	assert.NoError(s.T(), err)
+
+	run := s.Scheduler.scheduleMap.Queue().Pop()
+	if assert.NotNil(s.T(), run, "CreateCheck didn't queue a run.") {
+		assert.Equal(s.T(), check.Id, run.Check.Id)
+		assert.WithinDuration(s.T(), time.Now(), run.ScheduledAt, time.Second)
+		assert.Equal(s.T(), time.Duration(check.Interval)*time.Second, run.Deadline.Sub(run.ScheduledAt))
+	}
+}
+
+func (s *SchedulerTestSuite) TestRestoreCheckDoesNotQueueRun() {
+	check := s.Common.Check()
+	_, err := s.Scheduler.RestoreCheck(check)
+	assert.NoError(s.T(), err)
+	assert.Len(s.T(), s.Scheduler.Checks(), 1)
+	assert.Equal(s.T(), 0, s.Scheduler.scheduleMap.Queue().Len())
+}
+
+func (s *SchedulerTestSuite) TestCreateCheckStopsExistingTimer() {
+	scheduler := s.Scheduler
+	scheduler.CreateCheck(s.Common.Check())
+	old := scheduler.scheduleMap.Get(s.Common.Check().Id)
+
+	scheduler.CreateCheck(s.Common.Check())
+	select {
+	case <-old.stop:
+	default:
+		s.T().Error("CreateCheck did not stop the existing check's timer.")
+	}
+	assert.False(s.T(), old == scheduler.scheduleMap.Get(s.Common.Check().Id))
+	assert.Len(s.T(), scheduler.Checks(), 1)
+}
+
+func (s *SchedulerTestSuite) TestCreateCheckNormalizesCheckSpec() {
+	any, err := opsee_types.MarshalAny(&schema.GrpcCheck{Port: 50051})
+	if err != nil {
+		s.T().Fatal(err)
+	}
+	check := s.Common.Check()
+	check.Spec = nil
+	check.CheckSpec = any
+
+	c, err := s.Scheduler.CreateCheck(check)
+	if assert.NoError(s.T(), err) {
+		assert.Equal(s.T(), int32(50051), c.GetGrpcCheck().Port)
+	}
+}
+
+func (s *SchedulerTestSuite) TestCheckTimerQueuesRuns() {
+	check := s.Common.PassingCheck()
+	check.Interval = 1
+	queue := newRunQueue(metrics.NewRegistry())
+	ct, err := NewCheckTimer(check, queue, 0)
+	assert.NoError(s.T(), err)
+	defer ct.Stop()
+
+	select {
+	case <-queue.Ready():
+	case <-time.After(2 * time.Second):
+		s.T().Fatal("CheckTimer didn't queue a run.")
+	}
+	run := queue.Pop()
+	if assert.NotNil(s.T(), run) {
+		assert.Equal(s.T(), check.Id, run.Check.Id)
+		assert.Equal(s.T(), time.Second, run.Deadline.Sub(run.ScheduledAt))
+	}
+}
 
 /*******************************************************************************
  * RetrieveCheck()
@@ -124,6 +205,309 @@ func (s *SchedulerTestSuite) TestDeleteReturnsOriginalCheck() {
 	assert.Equal(s.T(), check.Id, c.Id, "DeleteCheck returned incorrect check ID.")
 }
 
+/*******************************************************************************
+ * UpdateCheck()
+ ******************************************************************************/
+
+func (s *SchedulerTestSuite) TestUpdateCheckReportsChanges() {
+	scheduler := s.Scheduler
+	scheduler.CreateCheck(s.Common.Check())
+	old := scheduler.scheduleMap.Get(s.Common.Check().Id)
+
+	check := s.Common.Check()
+	check.Interval = 120
+	check.Name = "renamed"
+	c, changed, err := scheduler.UpdateCheck(check)
+	assert.NoError(s.T(), err)
+	assert.EqualValues(s.T(), 120, c.Interval)
+	assert.Equal(s.T(), []string{"interval", "name"}, changed)
+
+	select {
+	case <-old.stop:
+	default:
+		s.T().Error("UpdateCheck did not stop the replaced check's timer.")
+	}
+	assert.Equal(s.T(), 120*time.Second, scheduler.scheduleMap.Get(check.Id).Interval)
+
+	_, changed, err = scheduler.UpdateCheck(s.Common.Check())
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), []string{"interval", "name"}, changed)
+	_, changed, err = scheduler.UpdateCheck(s.Common.Check())
+	assert.NoError(s.T(), err)
+	assert.Empty(s.T(), changed)
+}
+
+func (s *SchedulerTestSuite) TestUpdateCheckKeepsCheckIfInvalid() {
+	scheduler := s.Scheduler
+	scheduler.CreateCheck(s.Common.Check())
+	old := scheduler.scheduleMap.Get(s.Common.Check().Id)
+
+	check := s.Common.Check()
+	check.Interval = 1
+	c, changed, err := scheduler.UpdateCheck(check)
+	assert.Error(s.T(), err)
+	assert.Empty(s.T(), changed)
+	if assert.NotNil(s.T(), c) {
+		assert.EqualValues(s.T(), s.Common.Check().Interval, c.Interval)
+	}
+	assert.True(s.T(), old == scheduler.scheduleMap.Get(check.Id))
+}
+
+func (s *SchedulerTestSuite) TestUpdateCheckCreatesMissingCheck() {
+	c, changed, err := s.Scheduler.UpdateCheck(s.Common.Check())
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), s.Common.Check().Id, c.Id)
+	assert.Empty(s.T(), changed)
+	assert.Len(s.T(), s.Scheduler.Checks(), 1)
+}
+
+func (s *SchedulerTestSuite) TestCheckerUpdateCheckResponses() {
+	checker := NewChecker(newTestResolver())
+	checker.Scheduler = s.Scheduler
+	s.Scheduler.CreateCheck(s.Common.Check())
+
+	valid := s.Common.Check()
+	valid.MinFailingCount = 2
+	invalid := s.Common.Check()
+	invalid.Id = "invalid"
+	invalid.Target = nil
+	resp, err := checker.UpdateCheck(context.Background(), &opsee.CheckResourceRequest{Checks: []*schema.Check{valid, invalid}})
+	assert.NoError(s.T(), err)
+	if assert.Len(s.T(), resp.Responses, 2) {
+		assert.Empty(s.T(), resp.Responses[0].Error)
+		assert.Equal(s.T(), []string{"min_failing_count"}, resp.Responses[0].Changed)
+		assert.Equal(s.T(), "invalid", resp.Responses[1].Id)
+		assert.NotEmpty(s.T(), resp.Responses[1].Error)
+		assert.Nil(s.T(), resp.Responses[1].Check)
+	}
+}
+
+/*******************************************************************************
+ * Schedule()
+ ******************************************************************************/
+
+func (s *SchedulerTestSuite) TestScheduleOffsetIsDeterministic() {
+	interval := time.Minute
+	offset := scheduleOffset("check-id", interval)
+	assert.Equal(s.T(), offset, scheduleOffset("check-id", interval))
+	assert.True(s.T(), offset >= 0 && offset < interval)
+	assert.Equal(s.T(), time.Duration(0), scheduleOffset("check-id", 0))
+}
+
+func (s *SchedulerTestSuite) TestScheduleOffsetsSpreadAcrossInterval() {
+	interval := time.Minute
+	buckets := make([]int, 6)
+	for i := 0; i < 600; i++ {
+		offset := scheduleOffset(fmt.Sprintf("check-%d", i), interval)
+		buckets[offset/(10*time.Second)]++
+	}
+	for i, n := range buckets {
+		assert.InDelta(s.T(), 100, n, 40, "bucket %d", i)
+	}
+}
+
+func (s *SchedulerTestSuite) TestCheckTimerNextRun() {
+	schedule := intervalSchedule{interval: time.Minute, offset: 15 * time.Second}
+	base := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(s.T(), base.Add(15*time.Second), schedule.Next(base))
+	assert.Equal(s.T(), base.Add(15*time.Second), schedule.Next(base.Add(14*time.Second)))
+	assert.Equal(s.T(), base.Add(75*time.Second), schedule.Next(base.Add(15*time.Second)))
+	assert.Equal(s.T(), base.Add(75*time.Second), schedule.Next(base.Add(50*time.Second)))
+}
+
+func (s *SchedulerTestSuite) TestScheduleListsChecksInRunOrder() {
+	scheduler := s.Scheduler
+	scheduler.Jitter = time.Hour
+	for _, id := range []string{"a", "b", "c"} {
+		check := s.Common.Check()
+		check.Id = id
+		scheduler.CreateCheck(check)
+	}
+
+	schedule := scheduler.Schedule()
+	if assert.Len(s.T(), schedule, 3) {
+		for i, entry := range schedule {
+			assert.Equal(s.T(), time.Minute, entry.Interval)
+			assert.Equal(s.T(), scheduleOffset(entry.CheckId, time.Minute), entry.Offset)
+			// Jitter is capped so that runs stay within their interval.
+			assert.Equal(s.T(), 30*time.Second, entry.Jitter)
+			assert.True(s.T(), entry.NextRun.After(time.Now()))
+			if i > 0 {
+				assert.False(s.T(), entry.NextRun.Before(schedule[i-1].NextRun))
+			}
+		}
+	}
+}
+
+/*******************************************************************************
+ * Start()
+ ******************************************************************************/
+
+// blockingPublisher blocks every publish until it is released.
+type blockingPublisher struct {
+	release   chan struct{}
+	published chan []byte
+}
+
+func (p *blockingPublisher) Publish(topic string, msg []byte) error {
+	<-p.release
+	p.published <- msg
+	return nil
+}
+
+func (p *blockingPublisher) Stop() {}
+
+func (s *SchedulerTestSuite) TestCreateAndDeleteDontBlockOnPublish() {
+	scheduler := s.Scheduler
+	publisher := &blockingPublisher{release: make(chan struct{}), published: make(chan []byte, 100)}
+	scheduler.Producer = publisher
+	assert.NoError(s.T(), scheduler.Start())
+	defer scheduler.Stop()
+	defer close(publisher.release)
+
+	queue := scheduler.scheduleMap.Queue()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 50; i++ {
+			check := s.Common.PassingCheck()
+			check.Id = fmt.Sprintf("check-%d", i)
+			scheduler.CreateCheck(check)
+			queue.Push(&ScheduledRun{Check: check, ScheduledAt: time.Now(), Deadline: time.Now().Add(time.Minute)})
+		}
+		for i := 0; i < 50; i++ {
+			scheduler.DeleteCheck(&schema.Check{Id: fmt.Sprintf("check-%d", i)})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		s.T().Fatal("Creating and deleting checks blocked on publish.")
+	}
+}
+
+func (s *SchedulerTestSuite) TestStaleRunsAreDropped() {
+	scheduler := s.Scheduler
+	publisher := &blockingPublisher{release: make(chan struct{}), published: make(chan []byte, 10)}
+	close(publisher.release)
+	scheduler.Producer = publisher
+
+	stale := s.Common.PassingCheck()
+	stale.Id = "stale"
+	scheduler.publish(&ScheduledRun{Check: stale, ScheduledAt: time.Now().Add(-2 * time.Minute), Deadline: time.Now().Add(-time.Minute)})
+
+	late := s.Common.PassingCheck()
+	late.Id = "late"
+	scheduler.publish(&ScheduledRun{Check: late, ScheduledAt: time.Now().Add(-30 * time.Second), Deadline: time.Now().Add(30 * time.Second)})
+
+	assert.Len(s.T(), publisher.published, 1)
+	assert.EqualValues(s.T(), 1, metrics.GetOrRegisterCounter("runs_dropped", scheduler.registry).Count())
+	assert.EqualValues(s.T(), 1, metrics.GetOrRegisterCounter("runs_late", scheduler.registry).Count())
+}
+
+func (s *SchedulerTestSuite) TestScheduleIncludesCronSchedules() {
+	scheduler := s.Scheduler
+	check := s.Common.Check()
+	check.Interval = 0
+	check.Schedule = "5 2 * * *"
+	check.TimeZone = "Europe/Paris"
+	_, err := scheduler.CreateCheck(check)
+	assert.NoError(s.T(), err)
+
+	schedule := scheduler.Schedule()
+	if assert.Len(s.T(), schedule, 1) {
+		entry := schedule[0]
+		assert.Equal(s.T(), "5 2 * * *", entry.Schedule)
+		assert.Equal(s.T(), "Europe/Paris", entry.TimeZone)
+		assert.Equal(s.T(), time.Duration(0), entry.Interval)
+		next := entry.NextRun.In(mustParseCron(s.T(), "@daily", "Europe/Paris").Location)
+		assert.Equal(s.T(), 2, next.Hour())
+		assert.Equal(s.T(), 5, next.Minute())
+	}
+}
+
+/*******************************************************************************
+ * Reconcile()
+ ******************************************************************************/
+
+func (s *SchedulerTestSuite) reconcileCheck(id string) *schema.Check {
+	check := s.Common.Check()
+	check.Id = id
+	return check
+}
+
+func (s *SchedulerTestSuite) TestReconcileSchedulesBackendChecks() {
+	scheduler := s.Scheduler
+	scheduler.CreateCheck(s.reconcileCheck("unchanged"))
+	scheduler.CreateCheck(s.reconcileCheck("changed"))
+	scheduler.CreateCheck(s.reconcileCheck("orphaned"))
+
+	changed := s.reconcileCheck("changed")
+	changed.Interval = 120
+	summary := scheduler.Reconcile([]*schema.Check{
+		s.reconcileCheck("unchanged"),
+		changed,
+		s.reconcileCheck("missing"),
+	})
+
+	assert.Equal(s.T(), []string{"missing"}, summary.Created)
+	assert.Equal(s.T(), []string{"orphaned"}, summary.Deleted)
+	assert.Equal(s.T(), []string{"changed"}, summary.Replaced)
+	assert.Empty(s.T(), summary.Failed)
+	assert.Equal(s.T(), 1, summary.Unchanged)
+	assert.True(s.T(), summary.Changed())
+
+	c, err := scheduler.RetrieveCheck(changed)
+	assert.NoError(s.T(), err)
+	assert.EqualValues(s.T(), 120, c.Interval)
+	_, err = scheduler.RetrieveCheck(&schema.Check{Id: "orphaned"})
+	assert.Error(s.T(), err)
+	assert.Len(s.T(), scheduler.Checks(), 3)
+}
+
+func (s *SchedulerTestSuite) TestReconcileIgnoresRunState() {
+	scheduler := s.Scheduler
+	scheduler.CreateCheck(s.reconcileCheck("check"))
+
+	check := s.reconcileCheck("check")
+	check.State = StateFail
+	check.FailingCount = 2
+	check.ResponseCount = 3
+	summary := scheduler.Reconcile([]*schema.Check{check})
+
+	assert.False(s.T(), summary.Changed())
+	assert.Equal(s.T(), 1, summary.Unchanged)
+}
+
+func (s *SchedulerTestSuite) TestReconcileReportsInvalidChecks() {
+	scheduler := s.Scheduler
+
+	invalid := s.reconcileCheck("invalid")
+	invalid.Interval = 1
+	summary := scheduler.Reconcile([]*schema.Check{invalid})
+
+	assert.Equal(s.T(), []string{"invalid"}, summary.Failed)
+	assert.False(s.T(), summary.Changed())
+	assert.Empty(s.T(), scheduler.Checks())
+}
+
+func (s *SchedulerTestSuite) TestReconcileKeepsCheckIfReplacementInvalid() {
+	scheduler := s.Scheduler
+	scheduler.CreateCheck(s.reconcileCheck("check"))
+
+	invalid := s.reconcileCheck("check")
+	invalid.Interval = 1
+	summary := scheduler.Reconcile([]*schema.Check{invalid})
+
+	assert.Equal(s.T(), []string{"check"}, summary.Failed)
+	c, err := scheduler.RetrieveCheck(invalid)
+	if assert.NoError(s.T(), err) {
+		assert.EqualValues(s.T(), s.Common.Check().Interval, c.Interval)
+	}
+}
+
 /*******************************************************************************
  * RunCheck() Benchmarks
   ******************************************************************************/
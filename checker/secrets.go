@@ -0,0 +1,657 @@
+package checker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultSecretsPath is where the checker and runner keep the bastion's
+	// secrets.
+	DefaultSecretsPath = "/var/lib/opsee/secrets/secrets"
+
+	// DefaultSecretKeyPath is where the checker and runner keep the key
+	// material that the bastion's secrets key is derived from.
+	DefaultSecretKeyPath = "/var/lib/opsee/secrets/key"
+
+	// SecretKeySize is the size of the key material in a secret key file.
+	SecretKeySize = 32
+
+	// SecretsFileVersion is the version of the secrets file format written by
+	// this bastion.
+	SecretsFileVersion = 1
+
+	// MinSecretLength is the length of the shortest secret value. Shorter
+	// values would be redacted from unrelated text.
+	MinSecretLength = 4
+)
+
+var (
+	errNoSecretStore = errors.New("Secrets are not enabled")
+
+	secretNameRegexp        = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	secretPlaceholderRegexp = regexp.MustCompile(`\$\{secret:([^}]*)\}`)
+)
+
+// SecretsFile is the secret store as persisted on disk.
+type SecretsFile struct {
+	Version int32  `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Nonce   []byte `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	// Sealed is a SecretSet encrypted with AES-GCM.
+	Sealed []byte `protobuf:"bytes,3,opt,name=sealed,proto3" json:"sealed,omitempty"`
+}
+
+func (m *SecretsFile) Reset()         { *m = SecretsFile{} }
+func (m *SecretsFile) String() string { return proto.CompactTextString(m) }
+func (*SecretsFile) ProtoMessage()    {}
+
+// SecretSet is the plaintext of a SecretsFile.
+type SecretSet struct {
+	Secrets []*opsee.Secret `protobuf:"bytes,1,rep,name=secrets" json:"secrets,omitempty"`
+}
+
+func (m *SecretSet) Reset()         { *m = SecretSet{} }
+func (m *SecretSet) String() string { return proto.CompactTextString(m) }
+func (*SecretSet) ProtoMessage()    {}
+
+// LoadSecretKeyFile reads the bastion's secret key material from path,
+// generating it if the file doesn't exist. The file must only be accessible
+// to its owner.
+func LoadSecretKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return createSecretKeyFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("Secret key file %s is accessible to other users", path)
+	}
+
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != SecretKeySize {
+		return nil, fmt.Errorf("Secret key file %s must hold %d bytes", path, SecretKeySize)
+	}
+	return key, nil
+}
+
+// createSecretKeyFile generates key material and writes it to path, readable
+// only by its owner. If another process creates the file first, its key
+// material is used instead.
+func createSecretKeyFile(path string) ([]byte, error) {
+	key := make([]byte, SecretKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	// Unlike a rename, a link never replaces an existing key file.
+	if err := os.Link(f.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return LoadSecretKeyFile(path)
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// BastionSecretKey derives the key that encrypts a bastion's secrets from the
+// bastion's secret key material and its identity. The key material never
+// leaves the bastion, so a secrets file can't be read anywhere else.
+func BastionSecretKey(material []byte, customerId, bastionId string) []byte {
+	mac := hmac.New(sha256.New, material)
+	mac.Write([]byte(customerId))
+	mac.Write([]byte{0})
+	mac.Write([]byte(bastionId))
+	return mac.Sum(nil)
+}
+
+// A SecretStore holds named secrets, such as API tokens, that checks refer to
+// with ${secret:name} placeholders instead of carrying them in plaintext. The
+// runner substitutes them when a check runs, and redacts their values from
+// responses and logs.
+//
+// Secrets are persisted to Path, encrypted with a key derived from the
+// bastion's secret key material. The checker manages them through its RPCs, and the
+// runner picks up changes to the file as checks run.
+type SecretStore struct {
+	Path string
+
+	aead     cipher.AEAD
+	lock     sync.RWMutex
+	secrets  map[string]string
+	replacer *strings.Replacer
+	modTime  time.Time
+	size     int64
+}
+
+// NewSecretStore loads the secrets persisted in path, which are encrypted
+// with key. If path is empty, secrets are kept only in memory.
+func NewSecretStore(path string, key []byte) (*SecretStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SecretStore{
+		Path:    path,
+		aead:    aead,
+		secrets: make(map[string]string),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ValidSecretName reports whether name may be used to refer to a secret.
+func ValidSecretName(name string) bool {
+	return secretNameRegexp.MatchString(name)
+}
+
+// Put adds secrets, replacing any with the same names. If any secret is
+// invalid, or they can't be saved, none are added. The secrets are returned
+// without their values.
+func (s *SecretStore) Put(secrets []*opsee.Secret) ([]*opsee.Secret, error) {
+	for _, secret := range secrets {
+		if !ValidSecretName(secret.Name) {
+			return nil, fmt.Errorf("Invalid secret name: %q", secret.Name)
+		}
+		if secret.Value == "" {
+			return nil, fmt.Errorf("Secret %s has no value", secret.Name)
+		}
+		if utf8.RuneCountInString(secret.Value) < MinSecretLength {
+			return nil, fmt.Errorf("Secret %s must be at least %d characters long", secret.Name, MinSecretLength)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	updated := make(map[string]string, len(s.secrets)+len(secrets))
+	for name, value := range s.secrets {
+		updated[name] = value
+	}
+	names := make([]string, len(secrets))
+	for i, secret := range secrets {
+		updated[secret.Name] = secret.Value
+		names[i] = secret.Name
+	}
+
+	if err := s.save(updated); err != nil {
+		return nil, err
+	}
+	return namedSecrets(names), nil
+}
+
+// Delete removes the secrets with the given names, returning those that
+// existed, without their values. If they can't be saved, none are removed.
+func (s *SecretStore) Delete(names []string) ([]*opsee.Secret, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	updated := make(map[string]string, len(s.secrets))
+	for name, value := range s.secrets {
+		updated[name] = value
+	}
+	deleted := []string{}
+	for _, name := range names {
+		if _, ok := updated[name]; ok {
+			deleted = append(deleted, name)
+			delete(updated, name)
+		}
+	}
+
+	if err := s.save(updated); err != nil {
+		return nil, err
+	}
+	return namedSecrets(deleted), nil
+}
+
+// List returns the secrets, ordered by name and without their values.
+func (s *SecretStore) List() ([]*opsee.Secret, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(s.secrets))
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return namedSecrets(names), nil
+}
+
+// Expand substitutes secret values for the ${secret:name} placeholders in
+// text. It fails if a placeholder names an unknown secret.
+func (s *SecretStore) Expand(text string) (string, error) {
+	if !secretPlaceholderRegexp.MatchString(text) {
+		return text, nil
+	}
+	if s == nil {
+		return "", errNoSecretStore
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.refresh(); err != nil {
+		return "", err
+	}
+
+	var missing string
+	expanded := secretPlaceholderRegexp.ReplaceAllStringFunc(text, func(placeholder string) string {
+		name := secretPlaceholderRegexp.FindStringSubmatch(placeholder)[1]
+		value, ok := s.secrets[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("Unknown secret: %q", missing)
+	}
+
+	return expanded, nil
+}
+
+// Redact replaces the values of secrets in text with their placeholders.
+func (s *SecretStore) Redact(text string) string {
+	if s == nil {
+		return text
+	}
+
+	s.lock.RLock()
+	replacer := s.replacer
+	s.lock.RUnlock()
+
+	if replacer == nil {
+		return text
+	}
+	return replacer.Replace(text)
+}
+
+// RedactResponse redacts secrets from the error, reply and assertion results
+// of a check response.
+func (s *SecretStore) RedactResponse(response *schema.CheckResponse) {
+	if s == nil {
+		return
+	}
+
+	s.lock.RLock()
+	empty := s.replacer == nil
+	s.lock.RUnlock()
+	if empty {
+		return
+	}
+
+	response.Error = s.Redact(response.Error)
+	redactStrings(reflect.ValueOf(response.Reply), s.Redact)
+	redactStrings(reflect.ValueOf(response.AssertionResults), s.Redact)
+}
+
+// expandSpec returns a copy of a check spec with the secret placeholders in
+// the fields sent to the target expanded. The spec itself is left alone, so
+// that secret values are never published or logged with the check.
+func (s *SecretStore) expandSpec(spec interface{}) (interface{}, error) {
+	var err error
+
+	switch typedSpec := spec.(type) {
+	case *schema.HttpCheck:
+		expanded := proto.Clone(typedSpec).(*schema.HttpCheck)
+		if expanded.Path, err = s.Expand(typedSpec.Path); err != nil {
+			return nil, err
+		}
+		if expanded.Body, err = s.Expand(typedSpec.Body); err != nil {
+			return nil, err
+		}
+		for _, h := range expanded.Headers {
+			for i, v := range h.Values {
+				if h.Values[i], err = s.Expand(v); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return expanded, nil
+
+	case *schema.TcpCheck:
+		expanded := *typedSpec
+		if expanded.Send, err = s.Expand(typedSpec.Send); err != nil {
+			return nil, err
+		}
+		return &expanded, nil
+	}
+
+	return spec, nil
+}
+
+// LogFormatter returns a formatter that formats log entries with f, then
+// redacts secrets from them.
+func (s *SecretStore) LogFormatter(f log.Formatter) log.Formatter {
+	return &redactingFormatter{formatter: f, secrets: s}
+}
+
+type redactingFormatter struct {
+	formatter log.Formatter
+	secrets   *SecretStore
+}
+
+func (f *redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	b, err := f.formatter.Format(entry)
+	if err != nil {
+		return b, err
+	}
+	return []byte(f.secrets.Redact(string(b))), nil
+}
+
+// redactStrings applies redact to the exported strings reachable from v.
+func redactStrings(v reflect.Value, redact func(string) string) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			redactStrings(v.Elem(), redact)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				redactStrings(v.Field(i), redact)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			redactStrings(v.Index(i), redact)
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, k := range v.MapKeys() {
+			v.SetMapIndex(k, reflect.ValueOf(redact(v.MapIndex(k).String())).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(redact(v.String()))
+		}
+	}
+}
+
+func namedSecrets(names []string) []*opsee.Secret {
+	secrets := make([]*opsee.Secret, len(names))
+	for i, name := range names {
+		secrets[i] = &opsee.Secret{Name: name}
+	}
+	return secrets
+}
+
+// refresh reloads the secrets if the file has been changed by another
+// process. The lock must be held.
+func (s *SecretStore) refresh() error {
+	if s.Path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) && len(s.secrets) == 0 {
+			return nil
+		}
+	} else if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
+
+	return s.load()
+}
+
+// load reads and decrypts the secrets file. The lock must be held.
+func (s *SecretStore) load() error {
+	s.secrets = make(map[string]string)
+	s.modTime, s.size = time.Time{}, 0
+	defer s.updateReplacer()
+
+	if s.Path == "" {
+		return nil
+	}
+
+	f, err := os.Open(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	file := &SecretsFile{}
+	if err := proto.Unmarshal(data, file); err != nil {
+		return err
+	}
+	if file.Version != SecretsFileVersion {
+		return fmt.Errorf("Unsupported secrets file version: %d", file.Version)
+	}
+
+	plaintext, err := s.aead.Open(nil, file.Nonce, file.Sealed, nil)
+	if err != nil {
+		return fmt.Errorf("Couldn't decrypt secrets: %s", err)
+	}
+
+	set := &SecretSet{}
+	if err := proto.Unmarshal(plaintext, set); err != nil {
+		return err
+	}
+	for _, secret := range set.Secrets {
+		s.secrets[secret.Name] = secret.Value
+	}
+	s.modTime, s.size = info.ModTime(), info.Size()
+
+	return nil
+}
+
+// save encrypts and persists secrets, and only once they are persisted makes
+// them the store's secrets. The lock must be held.
+func (s *SecretStore) save(secrets map[string]string) error {
+	if s.Path == "" {
+		s.secrets = secrets
+		s.updateReplacer()
+		return nil
+	}
+
+	set := &SecretSet{}
+	for name, value := range secrets {
+		set.Secrets = append(set.Secrets, &opsee.Secret{Name: name, Value: value})
+	}
+	plaintext, err := proto.Marshal(set)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	data, err := proto.Marshal(&SecretsFile{
+		Version: SecretsFileVersion,
+		Nonce:   nonce,
+		Sealed:  s.aead.Seal(nil, nonce, plaintext, nil),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.Path, data); err != nil {
+		return err
+	}
+
+	s.secrets = secrets
+	s.updateReplacer()
+	if info, err := os.Stat(s.Path); err == nil {
+		s.modTime, s.size = info.ModTime(), info.Size()
+	}
+	return nil
+}
+
+// updateReplacer rebuilds the replacer used by Redact. Longer values are
+// replaced first, so that a secret containing another is redacted whole.
+// Values are also redacted in their JSON-escaped form. The lock must be held.
+func (s *SecretStore) updateReplacer() {
+	names := make([]string, 0, len(s.secrets))
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(s.secrets[names[i]]) == len(s.secrets[names[j]]) {
+			return names[i] < names[j]
+		}
+		return len(s.secrets[names[i]]) > len(s.secrets[names[j]])
+	})
+
+	pairs := []string{}
+	for _, name := range names {
+		value := s.secrets[name]
+		placeholder := "${secret:" + name + "}"
+		pairs = append(pairs, value, placeholder)
+		if escaped, err := json.Marshal(value); err == nil {
+			if e := string(escaped[1 : len(escaped)-1]); e != value {
+				pairs = append(pairs, e, placeholder)
+			}
+		}
+	}
+
+	if len(pairs) == 0 {
+		s.replacer = nil
+		return
+	}
+	s.replacer = strings.NewReplacer(pairs...)
+}
+
+// PutSecrets adds or replaces the requested secrets. The response lists their
+// names only.
+func (c *Checker) PutSecrets(ctx context.Context, req *opsee.SecretRequest) (*opsee.SecretResponse, error) {
+	if c.Secrets == nil {
+		return nil, errNoSecretStore
+	}
+
+	secrets, err := c.Secrets.Put(req.Secrets)
+	if err != nil {
+		log.WithError(err).Error("Couldn't put secrets.")
+		return nil, err
+	}
+
+	return &opsee.SecretResponse{Secrets: secrets}, nil
+}
+
+// DeleteSecrets removes the requested secrets, returning the names of those
+// that existed. Only secret names are used.
+func (c *Checker) DeleteSecrets(ctx context.Context, req *opsee.SecretRequest) (*opsee.SecretResponse, error) {
+	if c.Secrets == nil {
+		return nil, errNoSecretStore
+	}
+
+	names := make([]string, len(req.Secrets))
+	for i, secret := range req.Secrets {
+		names[i] = secret.Name
+	}
+
+	secrets, err := c.Secrets.Delete(names)
+	if err != nil {
+		log.WithError(err).Error("Couldn't delete secrets.")
+		return nil, err
+	}
+
+	return &opsee.SecretResponse{Secrets: secrets}, nil
+}
+
+// ListSecrets returns the names of the bastion's secrets.
+func (c *Checker) ListSecrets(ctx context.Context, req *opsee.SecretRequest) (*opsee.SecretResponse, error) {
+	if c.Secrets == nil {
+		return nil, errNoSecretStore
+	}
+
+	secrets, err := c.Secrets.List()
+	if err != nil {
+		log.WithError(err).Error("Couldn't list secrets.")
+		return nil, err
+	}
+
+	return &opsee.SecretResponse{Secrets: secrets}, nil
+}
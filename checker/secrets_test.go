@@ -0,0 +1,279 @@
+package checker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+var (
+	testSecretKeyMaterial = bytes.Repeat([]byte{7}, SecretKeySize)
+	testSecretKey         = BastionSecretKey(testSecretKeyMaterial, "customer-id", "bastion-id")
+)
+
+// testSecretStore returns a store holding the secret "token".
+func testSecretStore(t *testing.T, path string) *SecretStore {
+	store, err := NewSecretStore(path, testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Put([]*opsee.Secret{{Name: "token", Value: "s3cr3t-t0ken"}}); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSecretStorePersistsSecretsEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets")
+
+	store := testSecretStore(t, path)
+	_, err = store.Put([]*opsee.Secret{{Name: "password", Value: "hunter2"}})
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, bytes.Contains(data, []byte("s3cr3t-t0ken")))
+	assert.False(t, bytes.Contains(data, []byte("password")))
+
+	reloaded, err := NewSecretStore(path, testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed, err := reloaded.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []*opsee.Secret{{Name: "password"}, {Name: "token"}}, listed)
+
+	_, err = NewSecretStore(path, BastionSecretKey(testSecretKeyMaterial, "customer-id", "another-bastion"))
+	assert.Error(t, err)
+	_, err = NewSecretStore(path, BastionSecretKey(bytes.Repeat([]byte{8}, SecretKeySize), "customer-id", "bastion-id"))
+	assert.Error(t, err)
+}
+
+func TestLoadSecretKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets", "key")
+
+	key, err := LoadSecretKeyFile(path)
+	if assert.NoError(t, err) {
+		assert.Len(t, key, SecretKeySize)
+	}
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	reloaded, err := LoadSecretKeyFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, key, reloaded)
+
+	assert.NoError(t, os.Chmod(path, 0644))
+	_, err = LoadSecretKeyFile(path)
+	assert.Error(t, err)
+
+	short := filepath.Join(dir, "short")
+	assert.NoError(t, ioutil.WriteFile(short, []byte("key"), 0600))
+	_, err = LoadSecretKeyFile(short)
+	assert.Error(t, err)
+}
+
+func TestSecretStoreRejectsInvalidSecrets(t *testing.T) {
+	store := testSecretStore(t, "")
+
+	_, err := store.Put([]*opsee.Secret{{Name: "ok", Value: "value"}, {Name: "not ok}", Value: "value"}})
+	assert.Error(t, err)
+	_, err = store.Put([]*opsee.Secret{{Name: "empty"}})
+	assert.Error(t, err)
+	_, err = store.Put([]*opsee.Secret{{Name: "short", Value: "ab"}})
+	assert.Error(t, err)
+
+	listed, _ := store.List()
+	assert.Len(t, listed, 1)
+}
+
+func TestSecretStoreKeepsSecretsIfSaveFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The secrets file's directory is a dangling symlink, so the store can't
+	// create it.
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "missing", "dir"), link); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewSecretStore(filepath.Join(link, "secrets"), testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Put([]*opsee.Secret{{Name: "token", Value: "s3cr3t-t0ken"}})
+	assert.Error(t, err)
+
+	listed, err := store.List()
+	assert.NoError(t, err)
+	assert.Len(t, listed, 0)
+	assert.Equal(t, "s3cr3t-t0ken", store.Redact("s3cr3t-t0ken"))
+}
+
+func TestSecretStoreSeesChangesFromOtherProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets")
+
+	runner, err := NewSecretStore(path, testSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = runner.Expand("${secret:token}")
+	assert.Error(t, err)
+
+	checker := testSecretStore(t, path)
+	expanded, err := runner.Expand("Bearer ${secret:token}")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer s3cr3t-t0ken", expanded)
+
+	_, err = checker.Delete([]string{"token"})
+	assert.NoError(t, err)
+	_, err = runner.Expand("${secret:token}")
+	assert.Error(t, err)
+	assert.Equal(t, "s3cr3t-t0ken", runner.Redact("s3cr3t-t0ken"))
+}
+
+func TestSecretStoreExpand(t *testing.T) {
+	store := testSecretStore(t, "")
+
+	expanded, err := store.Expand("a ${secret:token} b ${secret:token}")
+	assert.NoError(t, err)
+	assert.Equal(t, "a s3cr3t-t0ken b s3cr3t-t0ken", expanded)
+
+	_, err = store.Expand("${secret:missing}")
+	assert.Error(t, err)
+
+	var noStore *SecretStore
+	expanded, err = noStore.Expand("no placeholders")
+	assert.NoError(t, err)
+	assert.Equal(t, "no placeholders", expanded)
+	_, err = noStore.Expand("${secret:token}")
+	assert.Equal(t, errNoSecretStore, err)
+}
+
+func TestSecretStoreRedact(t *testing.T) {
+	store := testSecretStore(t, "")
+	store.Put([]*opsee.Secret{{Name: "quoted", Value: `pa"ss`}})
+
+	assert.Equal(t, "Bearer ${secret:token}", store.Redact("Bearer s3cr3t-t0ken"))
+	assert.Equal(t, `{"password":"${secret:quoted}"}`, store.Redact(`{"password":"pa\"ss"}`))
+
+	buf := &bytes.Buffer{}
+	logger := log.New()
+	logger.Out = buf
+	logger.Formatter = store.LogFormatter(&log.TextFormatter{DisableColors: true})
+	logger.WithField("header", "Bearer s3cr3t-t0ken").Info("request: s3cr3t-t0ken")
+	assert.NotContains(t, buf.String(), "s3cr3t-t0ken")
+	assert.Contains(t, buf.String(), "${secret:token}")
+}
+
+func TestSecretStoreRedactResponse(t *testing.T) {
+	store := testSecretStore(t, "")
+
+	target := &schema.Target{Id: "s3cr3t-t0ken"}
+	response := &schema.CheckResponse{
+		Target: target,
+		Error:  "error: s3cr3t-t0ken",
+		Reply: &schema.CheckResponse_HttpResponse{HttpResponse: &schema.HttpResponse{
+			Body:    "you sent s3cr3t-t0ken",
+			Headers: []*schema.Header{{Name: "X-Echo", Values: []string{"s3cr3t-t0ken"}}},
+		}},
+		AssertionResults: []*schema.AssertionResult{{Actual: "s3cr3t-t0ken"}},
+	}
+	store.RedactResponse(response)
+
+	assert.Equal(t, "error: ${secret:token}", response.Error)
+	assert.Equal(t, "you sent ${secret:token}", response.GetHttpResponse().Body)
+	assert.Equal(t, "${secret:token}", response.GetHttpResponse().Headers[0].Values[0])
+	assert.Equal(t, "${secret:token}", response.AssertionResults[0].Actual)
+	assert.Equal(t, "s3cr3t-t0ken", target.Id)
+
+	response = &schema.CheckResponse{
+		Reply: &schema.CheckResponse_TcpResponse{TcpResponse: &schema.TcpResponse{Body: "s3cr3t-t0ken"}},
+	}
+	store.RedactResponse(response)
+	assert.Equal(t, "${secret:token}", response.GetTcpResponse().Body)
+}
+
+func TestRunnerExpandsAndRedactsSecrets(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer ts.Close()
+
+	spec := TestCommonStubs{}.HTTPCheck()
+	port, _ := strconv.Atoi(serverPort(ts))
+	spec.Port = int32(port)
+	spec.Headers = []*schema.Header{{Name: "Authorization", Values: []string{"Bearer ${secret:token}"}}}
+	check := TestCommonStubs{}.PassingCheck()
+	check.Spec = &schema.Check_HttpCheck{HttpCheck: spec}
+	check.Assertions = []*schema.Assertion{{Key: "body", Relationship: "equal", Operand: "Bearer s3cr3t-t0ken"}}
+	targets := []*schema.Target{{Type: "instance", Id: "i-1", Address: "127.0.0.1"}}
+
+	runner := NewRunner(&schema.HttpCheck{})
+	_, err := runner.RunCheck(context.Background(), check, targets)
+	assert.Error(t, err)
+
+	runner.secrets = testSecretStore(t, "")
+	responses, err := runner.RunCheck(context.Background(), check, targets)
+	if assert.NoError(t, err) && assert.Len(t, responses, 1) {
+		assert.True(t, responses[0].Passing)
+		assert.Equal(t, "Bearer ${secret:token}", responses[0].GetHttpResponse().Body)
+	}
+	assert.Equal(t, "Bearer ${secret:token}", spec.Headers[0].Values[0])
+}
+
+func TestCheckerSecretRPCs(t *testing.T) {
+	c := &Checker{}
+	_, err := c.ListSecrets(context.Background(), &opsee.SecretRequest{})
+	assert.Equal(t, errNoSecretStore, err)
+
+	c.Secrets = testSecretStore(t, "")
+	resp, err := c.PutSecrets(context.Background(), &opsee.SecretRequest{Secrets: []*opsee.Secret{{Name: "password", Value: "hunter2"}}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*opsee.Secret{{Name: "password"}}, resp.Secrets)
+	}
+
+	resp, err = c.DeleteSecrets(context.Background(), &opsee.SecretRequest{Secrets: []*opsee.Secret{{Name: "token"}, {Name: "missing"}}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*opsee.Secret{{Name: "token"}}, resp.Secrets)
+	}
+
+	resp, err = c.ListSecrets(context.Background(), &opsee.SecretRequest{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*opsee.Secret{{Name: "password"}}, resp.Secrets)
+	}
+}
@@ -12,6 +12,17 @@ import (
 	"golang.org/x/net/context"
 )
 
+const (
+	// SlateShadowTimeout bounds how long the runner waits on Slate when
+	// comparing its assertion results with the local ones.
+	SlateShadowTimeout = 30 * time.Second
+
+	// MaxSlateShadows bounds the number of comparisons with Slate in flight
+	// at once. Responses finished while that many are outstanding are not
+	// compared.
+	MaxSlateShadows = 16
+)
+
 // SlateClient -- for clienting slates.
 type SlateClient struct {
 	slateUrl   string
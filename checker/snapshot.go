@@ -0,0 +1,95 @@
+package checker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/opsee/basic/schema"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+// CheckSnapshotVersion is the version of the check snapshot format written by
+// this bastion. Snapshots with any other version are not loaded.
+const CheckSnapshotVersion = 1
+
+// A CheckSnapshot is the set of scheduled checks as persisted on disk, so that
+// a restarted checker can resume scheduling before the backend is reachable.
+type CheckSnapshot struct {
+	Version   int32                  `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Timestamp *opsee_types.Timestamp `protobuf:"bytes,2,opt,name=timestamp" json:"timestamp,omitempty"`
+	Checks    []*schema.Check        `protobuf:"bytes,3,rep,name=checks" json:"checks,omitempty"`
+}
+
+func (m *CheckSnapshot) Reset()         { *m = CheckSnapshot{} }
+func (m *CheckSnapshot) String() string { return proto.CompactTextString(m) }
+func (*CheckSnapshot) ProtoMessage()    {}
+
+// WriteCheckSnapshot atomically replaces the snapshot at path with checks.
+func WriteCheckSnapshot(path string, checks []*schema.Check) error {
+	timestamp := &opsee_types.Timestamp{}
+	timestamp.Scan(time.Now())
+
+	msg, err := proto.Marshal(&CheckSnapshot{
+		Version:   CheckSnapshotVersion,
+		Timestamp: timestamp,
+		Checks:    checks,
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, msg)
+}
+
+// writeFileAtomic replaces the file at path with data. It writes, syncs, then
+// renames, so that a crash never leaves a partial file in place of the last
+// good one.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// ReadCheckSnapshot reads the snapshot at path.
+func ReadCheckSnapshot(path string) (*CheckSnapshot, error) {
+	msg, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &CheckSnapshot{}
+	if err := proto.Unmarshal(msg, snapshot); err != nil {
+		return nil, err
+	}
+
+	if snapshot.Version != CheckSnapshotVersion {
+		return nil, fmt.Errorf("Unsupported check snapshot version: %d", snapshot.Version)
+	}
+
+	return snapshot, nil
+}
@@ -0,0 +1,115 @@
+package checker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/opsee/basic/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempSnapshotPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "checks.snapshot"), func() { os.RemoveAll(dir) }
+}
+
+func snapshotChecks(ids ...string) []*schema.Check {
+	checks := make([]*schema.Check, len(ids))
+	for i, id := range ids {
+		checks[i] = TestCommonStubs{}.PassingCheck()
+		checks[i].Id = id
+	}
+	return checks
+}
+
+func TestCheckSnapshotRoundTrip(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+
+	checks := snapshotChecks("a", "b")
+	checks[1].Schedule = "5 2 * * *"
+	checks[1].TimeZone = "America/Chicago"
+	assert.NoError(t, WriteCheckSnapshot(path, checks))
+
+	snapshot, err := ReadCheckSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualValues(t, CheckSnapshotVersion, snapshot.Version)
+	assert.NotNil(t, snapshot.Timestamp)
+	if assert.Len(t, snapshot.Checks, 2) {
+		assert.True(t, checks[0].Equal(snapshot.Checks[0]))
+		assert.True(t, checks[1].Equal(snapshot.Checks[1]))
+		assert.Equal(t, "America/Chicago", snapshot.Checks[1].TimeZone)
+	}
+}
+
+func TestCheckSnapshotReplacesPrevious(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+
+	assert.NoError(t, WriteCheckSnapshot(path, snapshotChecks("a", "b")))
+	assert.NoError(t, WriteCheckSnapshot(path, snapshotChecks("c")))
+
+	snapshot, err := ReadCheckSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, snapshot.Checks, 1) {
+		assert.Equal(t, "c", snapshot.Checks[0].Id)
+	}
+
+	// No temporary files are left behind.
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestCheckSnapshotRejectsUnknownVersion(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+
+	msg, err := proto.Marshal(&CheckSnapshot{Version: CheckSnapshotVersion + 1, Checks: snapshotChecks("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, ioutil.WriteFile(path, msg, 0600))
+
+	_, err = ReadCheckSnapshot(path)
+	assert.Error(t, err)
+}
+
+func TestCheckerSchedulesSnapshotOnStartup(t *testing.T) {
+	path, cleanup := tempSnapshotPath(t)
+	defer cleanup()
+
+	resolver := newTestResolver()
+	checker := NewChecker(resolver)
+	checker.Scheduler = NewScheduler(resolver)
+	checker.SnapshotPath = path
+
+	// Nothing to load on first boot.
+	checker.loadSnapshot()
+	assert.Empty(t, checker.Scheduler.Checks())
+
+	for _, check := range snapshotChecks("a", "b") {
+		checker.Scheduler.CreateCheck(check)
+	}
+	checker.saveSnapshot()
+
+	restarted := NewChecker(resolver)
+	restarted.Scheduler = NewScheduler(resolver)
+	restarted.SnapshotPath = path
+	restarted.loadSnapshot()
+
+	a, err := restarted.Scheduler.RetrieveCheck(&schema.Check{Id: "a"})
+	assert.NoError(t, err)
+	assert.NotNil(t, a)
+	assert.Len(t, restarted.Scheduler.Checks(), 2)
+}
@@ -0,0 +1,38 @@
+package checker
+
+import (
+	"fmt"
+
+	"github.com/opsee/basic/schema"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+)
+
+// checkSpec returns the typed spec for a check. Checks that haven't been
+// normalized, e.g. ones from bartnet, may only have their spec in CheckSpec.
+func checkSpec(check *schema.Check) (interface{}, error) {
+	switch spec := check.GetSpec().(type) {
+	case *schema.Check_HttpCheck:
+		return spec.HttpCheck, nil
+	case *schema.Check_CloudwatchCheck:
+		return spec.CloudwatchCheck, nil
+	case *schema.Check_TcpCheck:
+		return spec.TcpCheck, nil
+	case *schema.Check_TlsCheck:
+		return spec.TlsCheck, nil
+	case *schema.Check_DnsCheck:
+		return spec.DnsCheck, nil
+	case *schema.Check_GrpcCheck:
+		return spec.GrpcCheck, nil
+	}
+
+	if check.CheckSpec == nil {
+		return nil, fmt.Errorf("Check has null Spec")
+	}
+
+	spec, err := opsee_types.UnmarshalAny(check.CheckSpec)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode check spec of type %s: %s", check.CheckSpec.TypeUrl, err.Error())
+	}
+
+	return spec, nil
+}
@@ -0,0 +1,311 @@
+package checker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/bastion/netutil"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// DefaultSpoolMaxBytes bounds the total size of spooled messages.
+	DefaultSpoolMaxBytes = 64 * 1024 * 1024
+	// DefaultSpoolMaxAge is how long a message may wait in the spool before
+	// it is discarded.
+	DefaultSpoolMaxAge = 24 * time.Hour
+
+	spoolFileSuffix = ".msg"
+)
+
+// SpoolPublishFunc delivers a message upstream.
+type SpoolPublishFunc func(msg []byte) error
+
+type spoolEntry struct {
+	seq  uint64
+	path string
+	size int64
+	time time.Time
+}
+
+// A Spool is a durable, disk-backed queue of messages waiting to be
+// published. Messages are published directly while the uplink is healthy.
+// Once a publish fails, messages are written to the spool directory and
+// replayed in order, with exponential backoff, until the uplink comes back.
+// The spool discards its oldest messages to stay under MaxBytes, and any
+// message older than MaxAge.
+type Spool struct {
+	Dir      string
+	MaxBytes int64
+	MaxAge   time.Duration
+	// BackOff governs retries while the uplink is down.
+	BackOff netutil.BackOff
+
+	publish  SpoolPublishFunc
+	registry metrics.Registry
+
+	lock    sync.Mutex
+	entries []*spoolEntry
+	size    int64
+	nextSeq uint64
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewSpool opens the spool in dir, creating it if necessary. Messages left in
+// it by a previous process are replayed once the spool is started.
+func NewSpool(dir string, publish SpoolPublishFunc, registry metrics.Registry) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	backoff := netutil.NewExponentialBackOff()
+	// Keep retrying for as long as the uplink is down.
+	backoff.MaxElapsedTime = 0
+
+	s := &Spool{
+		Dir:      dir,
+		MaxBytes: DefaultSpoolMaxBytes,
+		MaxAge:   DefaultSpoolMaxAge,
+		BackOff:  backoff,
+		publish:  publish,
+		registry: registry,
+		notify:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Start begins replaying spooled messages. The spool must not be
+// reconfigured once started.
+func (s *Spool) Start() {
+	go s.replay()
+	s.wake()
+}
+
+// load reads the entries left on disk.
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, spoolFileSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolFileSuffix), 10, 64)
+		if err != nil {
+			log.WithField("file", name).Warn("Ignoring unrecognized file in spool.")
+			continue
+		}
+
+		s.entries = append(s.entries, &spoolEntry{
+			seq:  seq,
+			path: filepath.Join(s.Dir, name),
+			size: f.Size(),
+			time: f.ModTime(),
+		})
+		s.size += f.Size()
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+
+	sort.Sort(bySeq(s.entries))
+	s.updateDepth()
+
+	if len(s.entries) > 0 {
+		log.WithFields(log.Fields{"dir": s.Dir, "depth": len(s.entries)}).Info("Replaying spooled messages.")
+	}
+
+	return nil
+}
+
+// Publish publishes msg, spooling it if the spool is not empty or if the
+// publish fails. It only returns an error if the message could be neither
+// published nor spooled.
+func (s *Spool) Publish(msg []byte) error {
+	if s.Depth() == 0 {
+		err := s.publish(msg)
+		if err == nil {
+			return nil
+		}
+		log.WithError(err).Warn("Publish failed, spooling message.")
+	}
+
+	if err := s.enqueue(msg); err != nil {
+		return err
+	}
+	s.wake()
+
+	return nil
+}
+
+// Depth returns the number of messages in the spool.
+func (s *Spool) Depth() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.entries)
+}
+
+// Stop stops replaying. Spooled messages remain on disk.
+func (s *Spool) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Spool) enqueue(msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	size := int64(len(msg))
+	if size > s.MaxBytes {
+		return fmt.Errorf("Message of %d bytes exceeds spool size of %d bytes", size, s.MaxBytes)
+	}
+
+	for len(s.entries) > 0 && s.size+size > s.MaxBytes {
+		log.WithField("dir", s.Dir).Warn("Spool full, dropping oldest message.")
+		s.remove(s.entries[0])
+		metrics.GetOrRegisterCounter("spool_dropped", s.registry).Inc(1)
+	}
+
+	entry := &spoolEntry{
+		seq:  s.nextSeq,
+		path: filepath.Join(s.Dir, fmt.Sprintf("%020d%s", s.nextSeq, spoolFileSuffix)),
+		size: size,
+		time: time.Now(),
+	}
+
+	// Write then rename, so that a crash never leaves a partial message.
+	tmp := entry.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, msg, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, entry.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.nextSeq++
+	s.entries = append(s.entries, entry)
+	s.size += size
+	s.updateDepth()
+
+	return nil
+}
+
+// head returns the oldest entry that hasn't aged out, discarding any that
+// have.
+func (s *Spool) head() *spoolEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.entries) > 0 {
+		entry := s.entries[0]
+		if s.MaxAge <= 0 || time.Since(entry.time) <= s.MaxAge {
+			return entry
+		}
+		log.WithField("file", entry.path).Warn("Discarding expired message from spool.")
+		s.remove(entry)
+		metrics.GetOrRegisterCounter("spool_expired", s.registry).Inc(1)
+	}
+
+	return nil
+}
+
+// remove deletes the head entry. The lock must be held.
+func (s *Spool) remove(entry *spoolEntry) {
+	if len(s.entries) == 0 || s.entries[0] != entry {
+		return
+	}
+	if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("file", entry.path).Error("Couldn't remove spooled message.")
+	}
+	s.entries = s.entries[1:]
+	s.size -= entry.size
+	s.updateDepth()
+}
+
+func (s *Spool) updateDepth() {
+	metrics.GetOrRegisterGauge("spool_depth", s.registry).Update(int64(len(s.entries)))
+}
+
+func (s *Spool) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// replay publishes spooled messages in order until the spool is empty, then
+// waits to be woken.
+func (s *Spool) replay() {
+	defer close(s.done)
+
+	s.BackOff.Reset()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.notify:
+		}
+
+		for entry := s.head(); entry != nil; entry = s.head() {
+			msg, err := ioutil.ReadFile(entry.path)
+			if err == nil {
+				err = s.publish(msg)
+			} else if os.IsNotExist(err) {
+				// Nothing to replay, so drop the entry.
+				err = nil
+			}
+
+			if err != nil {
+				wait := s.BackOff.NextBackOff()
+				if wait == netutil.StopBackoff {
+					s.BackOff.Reset()
+					wait = s.BackOff.NextBackOff()
+				}
+				log.WithError(err).Warnf("Couldn't replay spooled message, retrying in %s.", wait)
+
+				select {
+				case <-s.stop:
+					return
+				case <-time.After(wait):
+				}
+				continue
+			}
+
+			s.BackOff.Reset()
+			metrics.GetOrRegisterCounter("spool_replayed", s.registry).Inc(1)
+
+			s.lock.Lock()
+			s.remove(entry)
+			s.lock.Unlock()
+		}
+	}
+}
+
+type bySeq []*spoolEntry
+
+func (b bySeq) Len() int           { return len(b) }
+func (b bySeq) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bySeq) Less(i, j int) bool { return b[i].seq < b[j].seq }
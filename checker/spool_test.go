@@ -0,0 +1,175 @@
+package checker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opsee/bastion/netutil"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// testUplink records published messages and fails while down.
+type testUplink struct {
+	sync.Mutex
+	down      bool
+	published []string
+}
+
+func (u *testUplink) publish(msg []byte) error {
+	u.Lock()
+	defer u.Unlock()
+	if u.down {
+		return fmt.Errorf("uplink down")
+	}
+	u.published = append(u.published, string(msg))
+	return nil
+}
+
+func (u *testUplink) setDown(down bool) {
+	u.Lock()
+	defer u.Unlock()
+	u.down = down
+}
+
+func (u *testUplink) messages() []string {
+	u.Lock()
+	defer u.Unlock()
+	return append([]string{}, u.published...)
+}
+
+func newTestSpool(t *testing.T, dir string, uplink *testUplink) *Spool {
+	spool, err := NewSpool(dir, uplink.publish, metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.BackOff = &netutil.ExponentialBackOff{
+		InitialInterval:     time.Millisecond,
+		RandomizationFactor: 0,
+		Multiplier:          1,
+		MaxInterval:         time.Millisecond,
+		Clock:               netutil.SystemClock,
+	}
+	return spool
+}
+
+func startTestSpool(t *testing.T, dir string, uplink *testUplink) *Spool {
+	spool := newTestSpool(t, dir, uplink)
+	spool.Start()
+	return spool
+}
+
+func tempSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func waitForDepth(t *testing.T, spool *Spool, depth int) {
+	for i := 0; i < 200; i++ {
+		if spool.Depth() == depth {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("spool depth is %d, expected %d", spool.Depth(), depth)
+}
+
+func TestSpoolPublishesDirectly(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	uplink := &testUplink{}
+	spool := startTestSpool(t, dir, uplink)
+	defer spool.Stop()
+
+	assert.NoError(t, spool.Publish([]byte("a")))
+	assert.Equal(t, []string{"a"}, uplink.messages())
+	assert.Equal(t, 0, spool.Depth())
+}
+
+func TestSpoolReplaysInOrder(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	uplink := &testUplink{down: true}
+	spool := startTestSpool(t, dir, uplink)
+	defer spool.Stop()
+
+	for _, msg := range []string{"a", "b", "c"} {
+		assert.NoError(t, spool.Publish([]byte(msg)))
+	}
+	assert.Equal(t, 3, spool.Depth())
+	assert.EqualValues(t, 3, metrics.GetOrRegisterGauge("spool_depth", spool.registry).Value())
+
+	uplink.setDown(false)
+	waitForDepth(t, spool, 0)
+	assert.Equal(t, []string{"a", "b", "c"}, uplink.messages())
+	assert.EqualValues(t, 0, metrics.GetOrRegisterGauge("spool_depth", spool.registry).Value())
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	uplink := &testUplink{down: true}
+	spool := startTestSpool(t, dir, uplink)
+	assert.NoError(t, spool.Publish([]byte("a")))
+	assert.NoError(t, spool.Publish([]byte("b")))
+	spool.Stop()
+
+	uplink.setDown(false)
+	spool = startTestSpool(t, dir, uplink)
+	defer spool.Stop()
+
+	waitForDepth(t, spool, 0)
+	assert.Equal(t, []string{"a", "b"}, uplink.messages())
+}
+
+func TestSpoolBoundsSize(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	uplink := &testUplink{down: true}
+	spool := newTestSpool(t, dir, uplink)
+	spool.MaxBytes = 4
+	spool.Start()
+	defer spool.Stop()
+
+	for _, msg := range []string{"aa", "bb", "cc"} {
+		assert.NoError(t, spool.Publish([]byte(msg)))
+	}
+	assert.Equal(t, 2, spool.Depth())
+	assert.Error(t, spool.Publish([]byte("too long")))
+
+	uplink.setDown(false)
+	waitForDepth(t, spool, 0)
+	assert.Equal(t, []string{"bb", "cc"}, uplink.messages())
+	assert.EqualValues(t, 1, metrics.GetOrRegisterCounter("spool_dropped", spool.registry).Count())
+}
+
+func TestSpoolAgesOutMessages(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	uplink := &testUplink{down: true}
+	spool := newTestSpool(t, dir, uplink)
+	spool.MaxAge = 50 * time.Millisecond
+	spool.Start()
+	defer spool.Stop()
+
+	assert.NoError(t, spool.Publish([]byte("old")))
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, spool.Publish([]byte("new")))
+
+	uplink.setDown(false)
+	waitForDepth(t, spool, 0)
+	assert.Equal(t, []string{"new"}, uplink.messages())
+	assert.EqualValues(t, 1, metrics.GetOrRegisterCounter("spool_expired", spool.registry).Count())
+}
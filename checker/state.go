@@ -0,0 +1,272 @@
+package checker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/nsqio/go-nsq"
+	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// Check states, as in schema.Check.State.
+//
+//	OK         every target is passing
+//	WARN       some targets are failing, but fewer than MinFailingCount
+//	FAIL_WAIT  at least MinFailingCount targets are failing, but they have
+//	           not been failing for MinFailingTime seconds
+//	FAIL       at least MinFailingCount targets have been failing for at
+//	           least MinFailingTime seconds
+//
+// A check only reaches FAIL once it has been continuously failing for
+// MinFailingTime, so a flapping target keeps its check in WARN or FAIL_WAIT
+// instead of repeatedly failing it.
+const (
+	StateOK       = "OK"
+	StateWarn     = "WARN"
+	StateFailWait = "FAIL_WAIT"
+	StateFail     = "FAIL"
+)
+
+// CheckStateLookupFunc returns the definition of a scheduled check.
+type CheckStateLookupFunc func(checkId string) (*schema.Check, error)
+
+type checkState struct {
+	state         string
+	failingSince  time.Time
+	failingCount  int32
+	responseCount int32
+}
+
+// A StateTracker computes check state transitions from check results.
+type StateTracker struct {
+	lookup   CheckStateLookupFunc
+	registry metrics.Registry
+
+	lock   sync.Mutex
+	states map[string]*checkState
+	last   map[string]*opsee.CheckResultSummary
+}
+
+func NewStateTracker(lookup CheckStateLookupFunc) *StateTracker {
+	return &StateTracker{
+		lookup:   lookup,
+		registry: metrics.NewPrefixedChildRegistry(metricsRegistry, "state."),
+		states:   make(map[string]*checkState),
+		last:     make(map[string]*opsee.CheckResultSummary),
+	}
+}
+
+// Update applies a result to its check's state, returning the transition if
+// the state changed. Results for checks that aren't scheduled, partial results
+// and the results of test runs are ignored.
+// Results muted by a maintenance window are recorded as the check's last
+// result, but don't change its state, and muted responses in other results
+// are ignored.
+func (t *StateTracker) Update(result *schema.CheckResult) *schema.CheckStateTransition {
+	// Only the results of test runs carry a run ID.
+	if result.Partial || result.RunId != "" {
+		return nil
+	}
+
+	check, err := t.lookup(result.CheckId)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err != nil || check == nil {
+		delete(t.states, result.CheckId)
+		delete(t.last, result.CheckId)
+		return nil
+	}
+
+	t.last[check.Id] = &opsee.CheckResultSummary{
+		Timestamp:     result.Timestamp,
+		Passing:       result.FailingCount() == 0,
+		FailingCount:  int32(result.FailingCount()),
+		ResponseCount: int32(len(result.Responses)),
+		Muted:         result.Muted,
+	}
+
+	if result.Muted {
+		return nil
+	}
+
+	s, ok := t.states[check.Id]
+	if !ok {
+		s = &checkState{state: check.State}
+		if s.state == "" {
+			s.state = StateOK
+		}
+		t.states[check.Id] = s
+	}
+
+	now := time.Now()
+	if result.Timestamp != nil {
+		now = time.Unix(result.Timestamp.Seconds, int64(result.Timestamp.Nanos))
+	}
+
+	// Responses from targets in a maintenance window don't count.
+	s.failingCount, s.responseCount = 0, 0
+	for _, response := range result.Responses {
+		if response.Muted {
+			continue
+		}
+		s.responseCount++
+		if !response.Passing {
+			s.failingCount++
+		}
+	}
+
+	from := s.state
+	to := nextState(check, s, now)
+	if to == from {
+		return nil
+	}
+
+	s.state = to
+	metrics.GetOrRegisterCounter("transitions", t.registry).Inc(1)
+
+	occurredAt := &opsee_types.Timestamp{}
+	occurredAt.Scan(now)
+
+	return &schema.CheckStateTransition{
+		CheckId:    check.Id,
+		From:       from,
+		To:         to,
+		OccurredAt: occurredAt,
+	}
+}
+
+// nextState returns the state a check moves to given its current state.
+func nextState(check *schema.Check, s *checkState, now time.Time) string {
+	minFailingCount := check.MinFailingCount
+	if minFailingCount < 1 {
+		minFailingCount = 1
+	}
+
+	switch {
+	case s.failingCount == 0:
+		return StateOK
+	case s.failingCount < minFailingCount:
+		return StateWarn
+	}
+
+	switch s.state {
+	case StateFail:
+		return StateFail
+	case StateFailWait:
+	default:
+		s.failingSince = now
+	}
+
+	if now.Sub(s.failingSince) >= time.Duration(check.MinFailingTime)*time.Second {
+		return StateFail
+	}
+	return StateFailWait
+}
+
+// State returns the current state of a check and the failing and total
+// response counts of its last result, or the empty string if no results have
+// been seen for it.
+func (t *StateTracker) State(checkId string) (string, int32, int32) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s, ok := t.states[checkId]
+	if !ok {
+		return "", 0, 0
+	}
+	return s.state, s.failingCount, s.responseCount
+}
+
+// LastResult returns a summary of the last result seen for a check, or nil if
+// no results have been seen for it.
+func (t *StateTracker) LastResult(checkId string) *opsee.CheckResultSummary {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.last[checkId]
+}
+
+// NSQStateTrackerConfig configures the topics an NSQStateTracker consumes
+// results from and publishes transitions to.
+type NSQStateTrackerConfig struct {
+	ConsumerQueueName   string
+	ConsumerChannelName string
+	ProducerQueueName   string
+	NsqdHost            string
+}
+
+// NSQStateTracker feeds results from NSQ to a StateTracker and publishes the
+// resulting transitions. It runs on the bastion so that state is evaluated
+// even when the backend is unreachable.
+type NSQStateTracker struct {
+	Tracker  *StateTracker
+	consumer *nsq.Consumer
+	producer *nsq.Producer
+}
+
+func NewNSQStateTracker(tracker *StateTracker, cfg *NSQStateTrackerConfig) (*NSQStateTracker, error) {
+	consumer, err := nsq.NewConsumer(cfg.ConsumerQueueName, cfg.ConsumerChannelName, nsq.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	producer, err := nsq.NewProducer(cfg.NsqdHost, nsq.NewConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	consumer.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
+		results, err := UnmarshalResults(m.Body)
+		if err != nil {
+			log.WithError(err).Error("Error decoding check results")
+			return err
+		}
+
+		for _, result := range results {
+			transition := tracker.Update(result)
+			if transition == nil {
+				continue
+			}
+
+			log.WithFields(log.Fields{"check_id": transition.CheckId, "from": transition.From, "to": transition.To}).Info("Check state transition")
+
+			msg, err := proto.Marshal(transition)
+			if err != nil {
+				log.WithError(err).Error("Error marshaling CheckStateTransition")
+				continue
+			}
+			// The state has already moved, so redelivering the result would
+			// not produce the transition again.
+			if err := producer.Publish(cfg.ProducerQueueName, msg); err != nil {
+				log.WithError(err).Error("Error publishing CheckStateTransition")
+				metrics.GetOrRegisterCounter("publish_errors", tracker.registry).Inc(1)
+			}
+		}
+
+		return nil
+	}))
+
+	if err := consumer.ConnectToNSQD(cfg.NsqdHost); err != nil {
+		return nil, fmt.Errorf("Couldn't connect state tracker to nsqd: %s", err)
+	}
+
+	return &NSQStateTracker{
+		Tracker:  tracker,
+		consumer: consumer,
+		producer: producer,
+	}, nil
+}
+
+func (t *NSQStateTracker) Stop() {
+	t.consumer.Stop()
+	<-t.consumer.StopChan
+	t.producer.Stop()
+}
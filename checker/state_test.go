@@ -0,0 +1,146 @@
+package checker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStateTracker(checks ...*schema.Check) *StateTracker {
+	return NewStateTracker(func(checkId string) (*schema.Check, error) {
+		for _, check := range checks {
+			if check.Id == checkId {
+				return check, nil
+			}
+		}
+		return nil, fmt.Errorf("Non-existent check: %s", checkId)
+	})
+}
+
+// stateTestResult returns a result for check-id at the given number of
+// seconds, with the given number of failing and passing responses.
+func stateTestResult(seconds int64, failing, passing int) *schema.CheckResult {
+	result := &schema.CheckResult{
+		CheckId:   "check-id",
+		Timestamp: &opsee_types.Timestamp{Seconds: seconds},
+	}
+	for i := 0; i < failing; i++ {
+		result.Responses = append(result.Responses, &schema.CheckResponse{Passing: false})
+	}
+	for i := 0; i < passing; i++ {
+		result.Responses = append(result.Responses, &schema.CheckResponse{Passing: true})
+	}
+	return result
+}
+
+func TestStateTrackerTransitions(t *testing.T) {
+	check := &schema.Check{Id: "check-id", MinFailingCount: 2, MinFailingTime: 90}
+	tracker := newTestStateTracker(check)
+
+	steps := []struct {
+		result *schema.CheckResult
+		state  string
+	}{
+		{stateTestResult(0, 0, 3), StateOK},
+		{stateTestResult(30, 1, 2), StateWarn},
+		{stateTestResult(60, 2, 1), StateFailWait},
+		{stateTestResult(90, 3, 0), StateFailWait},
+		{stateTestResult(150, 2, 1), StateFail},
+		{stateTestResult(180, 3, 0), StateFail},
+		{stateTestResult(210, 1, 2), StateWarn},
+		{stateTestResult(240, 0, 3), StateOK},
+	}
+
+	from := StateOK
+	for i, step := range steps {
+		transition := tracker.Update(step.result)
+		if step.state == from {
+			assert.Nil(t, transition, "step %d", i)
+		} else if assert.NotNil(t, transition, "step %d", i) {
+			assert.Equal(t, "check-id", transition.CheckId)
+			assert.Equal(t, from, transition.From, "step %d", i)
+			assert.Equal(t, step.state, transition.To, "step %d", i)
+			assert.Equal(t, step.result.Timestamp.Seconds, transition.OccurredAt.Seconds, "step %d", i)
+		}
+		from = step.state
+
+		state, failing, responses := tracker.State("check-id")
+		assert.Equal(t, step.state, state, "step %d", i)
+		assert.EqualValues(t, step.result.FailingCount(), failing, "step %d", i)
+		assert.EqualValues(t, 3, responses, "step %d", i)
+	}
+}
+
+func TestStateTrackerIgnoresFlapping(t *testing.T) {
+	check := &schema.Check{Id: "check-id", MinFailingCount: 1, MinFailingTime: 60}
+	tracker := newTestStateTracker(check)
+
+	for i := int64(0); i < 20; i++ {
+		tracker.Update(stateTestResult(i*30, int(i%2), 1))
+		state, _, _ := tracker.State("check-id")
+		assert.NotEqual(t, StateFail, state, "result %d", i)
+	}
+}
+
+func TestStateTrackerFailsImmediatelyWithoutMinFailingTime(t *testing.T) {
+	tracker := newTestStateTracker(&schema.Check{Id: "check-id"})
+
+	transition := tracker.Update(stateTestResult(time.Now().Unix(), 1, 0))
+	if assert.NotNil(t, transition) {
+		assert.Equal(t, StateOK, transition.From)
+		assert.Equal(t, StateFail, transition.To)
+	}
+}
+
+func TestStateTrackerIgnoresUnknownChecks(t *testing.T) {
+	tracker := newTestStateTracker()
+
+	assert.Nil(t, tracker.Update(stateTestResult(0, 1, 0)))
+	state, _, _ := tracker.State("check-id")
+	assert.Equal(t, "", state)
+}
+
+func TestStateTrackerIgnoresMutedResults(t *testing.T) {
+	check := &schema.Check{Id: "check-id", MinFailingCount: 1}
+	tracker := newTestStateTracker(check)
+
+	result := stateTestResult(0, 1, 0)
+	result.Muted = true
+	assert.Nil(t, tracker.Update(result))
+	state, _, _ := tracker.State("check-id")
+	assert.Equal(t, "", state)
+}
+
+func TestStateTrackerIgnoresMutedResponses(t *testing.T) {
+	check := &schema.Check{Id: "check-id", MinFailingCount: 1}
+	tracker := newTestStateTracker(check)
+
+	result := stateTestResult(0, 1, 1)
+	result.Responses[0].Muted = true
+	assert.Nil(t, tracker.Update(result))
+	state, failing, responses := tracker.State("check-id")
+	assert.Equal(t, StateOK, state)
+	assert.Equal(t, int32(0), failing)
+	assert.Equal(t, int32(1), responses)
+}
+
+func TestStateTrackerIgnoresPartialAndTestResults(t *testing.T) {
+	check := &schema.Check{Id: "check-id", MinFailingCount: 1}
+	tracker := newTestStateTracker(check)
+
+	partial := stateTestResult(0, 1, 0)
+	partial.Partial = true
+	assert.Nil(t, tracker.Update(partial))
+
+	test := stateTestResult(0, 1, 0)
+	test.RunId = "run-id"
+	assert.Nil(t, tracker.Update(test))
+
+	state, _, _ := tracker.State("check-id")
+	assert.Equal(t, "", state)
+	assert.Nil(t, tracker.LastResult("check-id"))
+}
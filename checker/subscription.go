@@ -0,0 +1,172 @@
+package checker
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// DefaultSubscriberBuffer is how many results are buffered for each results
+// subscriber before the oldest are dropped.
+const DefaultSubscriberBuffer = 100
+
+var errNoResultBroker = errors.New("Result subscriptions are not enabled")
+
+// A ResultBroker fans check results out to subscribers. Publishing never
+// blocks: each subscriber has a buffer of BufferSize results, and when a
+// subscriber falls behind, its oldest buffered results are dropped to make
+// room for new ones.
+type ResultBroker struct {
+	BufferSize int
+
+	lock        sync.RWMutex
+	subscribers map[*ResultSubscription]struct{}
+	registry    metrics.Registry
+}
+
+// A ResultSubscription receives the published results that match its filter.
+type ResultSubscription struct {
+	checkIds map[string]bool
+	target   *schema.Target
+	results  chan *schema.CheckResult
+	dropped  int64
+	// lock serializes deliveries, so that dropping the oldest result and
+	// buffering the new one happen together.
+	lock sync.Mutex
+}
+
+func NewResultBroker() *ResultBroker {
+	return &ResultBroker{
+		BufferSize:  DefaultSubscriberBuffer,
+		subscribers: make(map[*ResultSubscription]struct{}),
+		registry:    metrics.NewPrefixedChildRegistry(metricsRegistry, "subscriptions."),
+	}
+}
+
+// Subscribe adds a subscriber for the results matching req. The subscription
+// must be removed with Unsubscribe.
+func (b *ResultBroker) Subscribe(req *opsee.SubscribeResultsRequest) *ResultSubscription {
+	size := b.BufferSize
+	if size < 1 {
+		size = 1
+	}
+
+	sub := &ResultSubscription{
+		checkIds: make(map[string]bool, len(req.CheckIds)),
+		target:   req.Target,
+		results:  make(chan *schema.CheckResult, size),
+	}
+	for _, id := range req.CheckIds {
+		sub.checkIds[id] = true
+	}
+
+	b.lock.Lock()
+	b.subscribers[sub] = struct{}{}
+	metrics.GetOrRegisterGauge("subscribers", b.registry).Update(int64(len(b.subscribers)))
+	b.lock.Unlock()
+
+	return sub
+}
+
+// Unsubscribe removes a subscriber.
+func (b *ResultBroker) Unsubscribe(sub *ResultSubscription) {
+	b.lock.Lock()
+	delete(b.subscribers, sub)
+	metrics.GetOrRegisterGauge("subscribers", b.registry).Update(int64(len(b.subscribers)))
+	b.lock.Unlock()
+}
+
+// Publish delivers a result to every subscriber whose filter it matches.
+func (b *ResultBroker) Publish(result *schema.CheckResult) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for sub := range b.subscribers {
+		if !sub.matches(result) {
+			continue
+		}
+		if !sub.deliver(result) {
+			metrics.GetOrRegisterCounter("results_dropped", b.registry).Inc(1)
+		}
+	}
+}
+
+func (s *ResultSubscription) matches(result *schema.CheckResult) bool {
+	if len(s.checkIds) > 0 && !s.checkIds[result.CheckId] {
+		return false
+	}
+	if s.target == nil || sameTarget(s.target, result.Target) {
+		return true
+	}
+	for _, resp := range result.Responses {
+		if sameTarget(s.target, resp.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver buffers a result, dropping the oldest buffered result if the buffer
+// is full. It returns false if a result was dropped.
+func (s *ResultSubscription) deliver(result *schema.CheckResult) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	select {
+	case s.results <- result:
+		return true
+	default:
+	}
+
+	select {
+	case <-s.results:
+	default:
+	}
+	atomic.AddInt64(&s.dropped, 1)
+
+	// Only deliveries fill the buffer, so there is room now.
+	s.results <- result
+	return false
+}
+
+// Results receives the subscription's results.
+func (s *ResultSubscription) Results() <-chan *schema.CheckResult {
+	return s.results
+}
+
+// Dropped returns the number of results dropped since it was last called.
+func (s *ResultSubscription) Dropped() int64 {
+	return atomic.SwapInt64(&s.dropped, 0)
+}
+
+// SubscribeResults streams check results as they arrive from the runners
+// until the client cancels the stream. A client that can't keep up misses
+// results rather than slowing down the runners; each response reports how
+// many results were dropped before it.
+func (c *Checker) SubscribeResults(req *opsee.SubscribeResultsRequest, stream opsee.Checker_SubscribeResultsServer) error {
+	if c.Runner == nil || c.Runner.Results == nil {
+		return errNoResultBroker
+	}
+
+	sub := c.Runner.Results.Subscribe(req)
+	defer c.Runner.Results.Unsubscribe(sub)
+
+	log.WithFields(log.Fields{"check_ids": req.CheckIds, "target": req.Target}).Info("Results subscriber connected.")
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			log.WithError(stream.Context().Err()).Info("Results subscriber disconnected.")
+			return nil
+		case result := <-sub.Results():
+			if err := stream.Send(&opsee.SubscribeResultsResponse{Result: result, Dropped: sub.Dropped()}); err != nil {
+				return err
+			}
+		}
+	}
+}
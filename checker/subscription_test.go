@@ -0,0 +1,119 @@
+package checker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func subscriptionResult(checkId string, targetIds ...string) *schema.CheckResult {
+	result := &schema.CheckResult{
+		CheckId: checkId,
+		Target:  &schema.Target{Type: "sg", Id: "sg-" + checkId},
+	}
+	for _, id := range targetIds {
+		result.Responses = append(result.Responses, &schema.CheckResponse{
+			Target: &schema.Target{Type: "instance", Id: id},
+		})
+	}
+	return result
+}
+
+func TestResultBrokerFilters(t *testing.T) {
+	broker := NewResultBroker()
+	all := broker.Subscribe(&opsee.SubscribeResultsRequest{})
+	byId := broker.Subscribe(&opsee.SubscribeResultsRequest{CheckIds: []string{"b"}})
+	byCheckTarget := broker.Subscribe(&opsee.SubscribeResultsRequest{Target: &schema.Target{Type: "sg", Id: "sg-a"}})
+	byInstance := broker.Subscribe(&opsee.SubscribeResultsRequest{Target: &schema.Target{Type: "instance", Id: "i-2"}})
+
+	broker.Publish(subscriptionResult("a", "i-1"))
+	broker.Publish(subscriptionResult("b", "i-1", "i-2"))
+
+	received := func(sub *ResultSubscription) []string {
+		ids := []string{}
+		for len(sub.Results()) > 0 {
+			ids = append(ids, (<-sub.Results()).CheckId)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"a", "b"}, received(all))
+	assert.Equal(t, []string{"b"}, received(byId))
+	assert.Equal(t, []string{"a"}, received(byCheckTarget))
+	assert.Equal(t, []string{"b"}, received(byInstance))
+
+	broker.Unsubscribe(all)
+	broker.Publish(subscriptionResult("c"))
+	assert.Empty(t, received(all))
+}
+
+func TestResultBrokerDropsOldest(t *testing.T) {
+	broker := NewResultBroker()
+	broker.BufferSize = 2
+	sub := broker.Subscribe(&opsee.SubscribeResultsRequest{})
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		broker.Publish(subscriptionResult(id))
+	}
+
+	assert.EqualValues(t, 2, sub.Dropped())
+	assert.EqualValues(t, 0, sub.Dropped())
+	assert.Equal(t, "c", (<-sub.Results()).CheckId)
+	assert.Equal(t, "d", (<-sub.Results()).CheckId)
+}
+
+func TestSubscribeResultsStreams(t *testing.T) {
+	checker := NewChecker(newTestResolver())
+	checker.Runner = &RemoteRunner{Results: NewResultBroker()}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	opsee.RegisterCheckerServer(server, checker)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := opsee.NewCheckerClient(conn).SubscribeResults(ctx, &opsee.SubscribeResultsRequest{CheckIds: []string{"b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the subscription to be registered before publishing.
+	for i := 0; i < 100; i++ {
+		checker.Runner.Results.lock.RLock()
+		n := len(checker.Runner.Results.subscribers)
+		checker.Runner.Results.lock.RUnlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	checker.Runner.Results.Publish(subscriptionResult("a"))
+	checker.Runner.Results.Publish(subscriptionResult("b", "i-1"))
+
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "b", resp.Result.CheckId)
+	if assert.Len(t, resp.Result.Responses, 1) {
+		assert.Equal(t, "i-1", resp.Result.Responses[0].Target.Id)
+	}
+	assert.EqualValues(t, 0, resp.Dropped)
+}
@@ -0,0 +1,182 @@
+package checker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/basic/schema"
+	"golang.org/x/net/context"
+)
+
+const (
+	tcpWorkerTaskType = "TCPRequest"
+
+	// DefaultTCPReadBytes is the number of bytes read from a TCP connection
+	// when the check doesn't ask for a specific amount.
+	DefaultTCPReadBytes = 4096
+
+	// Time to allow TCP checks to read a banner from the connection.
+	TCPReadTimeout = 5 * time.Second
+
+	// Time to allow for connecting and completing a TLS handshake.
+	TCPConnectTimeout = 15 * time.Second
+)
+
+func init() {
+	Recruiters.RegisterWorker(tcpWorkerTaskType, NewTCPWorker)
+}
+
+// latencyMetric returns a millisecond latency metric for the given duration.
+func latencyMetric(name string, d time.Duration) *schema.Metric {
+	return &schema.Metric{
+		Name:  name,
+		Value: d.Seconds() * 1000,
+		Unit:  "ms",
+	}
+}
+
+// contextDeadline returns the time timeout from now, or the context's
+// deadline if that is earlier.
+func contextDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		return dl
+	}
+	return deadline
+}
+
+type TCPRequest struct {
+	Address            string `json:"address"`
+	Host               string `json:"host"`
+	Send               string `json:"send"`
+	Expect             string `json:"expect"`
+	ReadBytes          int    `json:"read_bytes"`
+	TLS                bool   `json:"tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// Certificates are presented to servers that ask for a client
+	// certificate, and RootCAs verifies the server. The system pool is
+	// used if RootCAs is nil.
+	Certificates []tls.Certificate `json:"-"`
+	RootCAs      *x509.CertPool    `json:"-"`
+}
+
+func (r *TCPRequest) Do(ctx context.Context) <-chan *Response {
+	respChan := make(chan *Response, 1)
+
+	go func() {
+		defer close(respChan)
+		respChan <- r.do(ctx)
+	}()
+
+	return respChan
+}
+
+func (r *TCPRequest) do(ctx context.Context) *Response {
+	dialer := &net.Dialer{
+		Timeout: TCPConnectTimeout,
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		dialer.Deadline = dl
+	}
+
+	t0 := time.Now()
+	conn, err := dialer.Dial("tcp", r.Address)
+	if err != nil {
+		return &Response{Error: err}
+	}
+	defer conn.Close()
+
+	tcpResponse := &schema.TcpResponse{
+		Host: r.Host,
+		Metrics: []*schema.Metric{
+			latencyMetric("connect_latency", time.Since(t0)),
+		},
+	}
+
+	if r.TLS {
+		t1 := time.Now()
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         r.Host,
+			InsecureSkipVerify: r.InsecureSkipVerify,
+			Certificates:       r.Certificates,
+			RootCAs:            r.RootCAs,
+		})
+		tlsConn.SetDeadline(contextDeadline(ctx, TCPConnectTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return &Response{Error: err}
+		}
+		tcpResponse.Metrics = append(tcpResponse.Metrics, latencyMetric("tls_handshake_latency", time.Since(t1)))
+		conn = tlsConn
+	}
+
+	if err := conn.SetDeadline(contextDeadline(ctx, TCPReadTimeout)); err != nil {
+		return &Response{Error: err}
+	}
+
+	if r.Send != "" {
+		if _, err := conn.Write([]byte(r.Send)); err != nil {
+			return &Response{Error: err}
+		}
+	}
+
+	banner, err := r.readBanner(conn)
+	if err != nil {
+		return &Response{Error: err}
+	}
+	tcpResponse.Body = string(banner)
+	tcpResponse.Metrics = append(tcpResponse.Metrics, latencyMetric("request_latency", time.Since(t0)))
+
+	return &Response{Response: &schema.CheckResponse_TcpResponse{TcpResponse: tcpResponse}}
+}
+
+// readBanner reads at most ReadBytes from the connection. Without an Expect
+// string it returns as soon as anything has been read. Servers that don't send
+// anything are not an error, the read simply times out with an empty banner.
+func (r *TCPRequest) readBanner(conn net.Conn) ([]byte, error) {
+	limit := r.ReadBytes
+	if limit <= 0 {
+		limit = DefaultTCPReadBytes
+	}
+	if limit > MaxContentLength {
+		limit = MaxContentLength
+	}
+
+	banner := make([]byte, 0, limit)
+	buf := make([]byte, limit)
+	for len(banner) < limit {
+		n, err := conn.Read(buf[:limit-len(banner)])
+		banner = append(banner, buf[:n]...)
+
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			if err == io.EOF {
+				break
+			}
+			return banner, err
+		}
+
+		if r.Expect == "" || bytes.Contains(banner, []byte(r.Expect)) {
+			break
+		}
+	}
+
+	return banner, nil
+}
+
+func (r *TCPRequest) logFields() log.Fields {
+	return log.Fields{"address": r.Address, "tls": r.TLS}
+}
+
+func NewTCPWorker(queue chan Worker) Worker {
+	return newRequestWorker(queue, func(r Request) bool {
+		_, ok := r.(*TCPRequest)
+		return ok
+	})
+}
@@ -0,0 +1,148 @@
+package checker
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// tcpTestServer accepts a single connection, writes the banner and then
+// echoes back the first line it reads.
+func tcpTestServer(t *testing.T, banner string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(banner))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(line))
+	}()
+
+	return l
+}
+
+func TestTCPRequestReadsBanner(t *testing.T) {
+	l := tcpTestServer(t, "+OK ready\r\n")
+	defer l.Close()
+
+	request := &TCPRequest{Address: l.Addr().String()}
+	resp := checkReply(t, <-request.Do(context.Background())).GetTcpResponse()
+
+	assert.Equal(t, "+OK ready\r\n", resp.Body)
+	assert.Equal(t, "connect_latency", resp.Metrics[0].Name)
+	assert.Equal(t, "request_latency", resp.Metrics[len(resp.Metrics)-1].Name)
+}
+
+func TestTCPRequestSendAndExpect(t *testing.T) {
+	l := tcpTestServer(t, "hello ")
+	defer l.Close()
+
+	request := &TCPRequest{Address: l.Addr().String(), Send: "PING\n", Expect: "PING"}
+	resp := checkReply(t, <-request.Do(context.Background())).GetTcpResponse()
+
+	assert.Equal(t, "hello PING\n", resp.Body)
+}
+
+func TestTCPRequestBoundsRead(t *testing.T) {
+	l := tcpTestServer(t, "0123456789")
+	defer l.Close()
+
+	request := &TCPRequest{Address: l.Addr().String(), ReadBytes: 4}
+	resp := checkReply(t, <-request.Do(context.Background())).GetTcpResponse()
+
+	assert.Equal(t, "0123", resp.Body)
+}
+
+func TestTCPRequestTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer ts.Close()
+
+	request := &TCPRequest{
+		Address:            ts.Listener.Addr().String(),
+		Send:               "GET / HTTP/1.0\r\n\r\n",
+		Expect:             "OK",
+		TLS:                true,
+		InsecureSkipVerify: true,
+	}
+	resp := checkReply(t, <-request.Do(context.Background())).GetTcpResponse()
+
+	assert.Contains(t, resp.Body, "HTTP/1.0 200 OK")
+	assert.Equal(t, "tls_handshake_latency", resp.Metrics[1].Name)
+}
+
+func TestTCPRequestConnectionRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	request := &TCPRequest{Address: addr}
+	resp := <-request.Do(context.Background())
+	assert.Error(t, resp.Error)
+}
+
+func TestTCPRequestHonorsContextDeadline(t *testing.T) {
+	// The server accepts connections but never writes anything, so neither
+	// the TLS handshake nor the banner read can complete.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	for _, useTLS := range []bool{true, false} {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		request := &TCPRequest{Address: l.Addr().String(), Host: "example.com", Expect: "never", TLS: useTLS}
+		t0 := time.Now()
+		request.do(ctx)
+		cancel()
+		assert.True(t, time.Since(t0) < TCPReadTimeout, "tls: %v", useTLS)
+	}
+}
+
+func TestRunnerDispatchesTCPCheck(t *testing.T) {
+	l := tcpTestServer(t, "SSH-2.0-OpenSSH\r\n")
+	defer l.Close()
+
+	check := TestCommonStubs{}.Check()
+	check.Spec = &schema.Check_TcpCheck{TcpCheck: &schema.TcpCheck{}}
+
+	runner := NewRunner(&schema.HttpCheck{})
+	targets := []*schema.Target{&schema.Target{Id: "id", Type: "instance", Address: l.Addr().String()}}
+	responses, err := runner.RunCheck(context.Background(), check, targets)
+	assert.NoError(t, err)
+	if assert.Len(t, responses, 1) {
+		assert.Empty(t, responses[0].Error)
+		assert.NotNil(t, responses[0].GetTcpResponse())
+	}
+}
@@ -0,0 +1,167 @@
+package checker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/opsee/basic/schema"
+	opsee_types "github.com/opsee/protobuf/opseeproto/types"
+	"golang.org/x/net/context"
+)
+
+const (
+	tlsWorkerTaskType = "TLSRequest"
+)
+
+func init() {
+	Recruiters.RegisterWorker(tlsWorkerTaskType, NewTLSWorker)
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+type TLSRequest struct {
+	Address string `json:"address"`
+	Host    string `json:"host"`
+	// RootCAs is used to verify the chain. The system pool is used if nil.
+	RootCAs *x509.CertPool `json:"-"`
+	// Certificates are presented to servers that ask for a client
+	// certificate.
+	Certificates []tls.Certificate `json:"-"`
+}
+
+func (r *TLSRequest) Do(ctx context.Context) <-chan *Response {
+	respChan := make(chan *Response, 1)
+
+	go func() {
+		defer close(respChan)
+		respChan <- r.do(ctx)
+	}()
+
+	return respChan
+}
+
+func (r *TLSRequest) do(ctx context.Context) *Response {
+	dialer := &net.Dialer{
+		Timeout: TCPConnectTimeout,
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		dialer.Deadline = dl
+	}
+
+	// We verify the chain ourselves after the handshake, so that we can
+	// report on certificates even when they're invalid.
+	t0 := time.Now()
+	conn, err := tls.DialWithDialer(dialer, "tcp", r.Address, &tls.Config{
+		ServerName:         r.Host,
+		InsecureSkipVerify: true,
+		Certificates:       r.Certificates,
+	})
+	if err != nil {
+		return &Response{Error: err}
+	}
+	defer conn.Close()
+	handshakeLatency := time.Since(t0)
+
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return &Response{Error: fmt.Errorf("No certificates presented by %s", r.Address)}
+	}
+
+	now := time.Now()
+	tlsResponse := &schema.TlsResponse{
+		Host:        r.Host,
+		Protocol:    tlsVersions[state.Version],
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		Chain:       make([]*schema.TlsCertificate, 0, len(state.PeerCertificates)),
+	}
+
+	for i, cert := range state.PeerCertificates {
+		c := newTlsCertificate(cert, now)
+		tlsResponse.Chain = append(tlsResponse.Chain, c)
+		if i == 0 || c.DaysUntilExpiry < tlsResponse.ChainDaysUntilExpiry {
+			tlsResponse.ChainDaysUntilExpiry = c.DaysUntilExpiry
+		}
+	}
+
+	leaf := tlsResponse.Chain[0]
+	tlsResponse.Subject = leaf.Subject
+	tlsResponse.Issuer = leaf.Issuer
+	tlsResponse.DnsNames = leaf.DnsNames
+	tlsResponse.DaysUntilExpiry = leaf.DaysUntilExpiry
+
+	if err := r.verify(state.PeerCertificates); err != nil {
+		tlsResponse.VerifyError = err.Error()
+	} else {
+		tlsResponse.Verified = true
+	}
+
+	tlsResponse.Metrics = []*schema.Metric{
+		latencyMetric("handshake_latency", handshakeLatency),
+		&schema.Metric{
+			Name:  "days_until_expiry",
+			Value: tlsResponse.DaysUntilExpiry,
+			Unit:  "days",
+		},
+	}
+
+	return &Response{Response: &schema.CheckResponse_TlsResponse{TlsResponse: tlsResponse}}
+}
+
+// verify checks the presented chain against the root CAs. The host name is
+// only verified when we know it.
+func (r *TLSRequest) verify(certs []*x509.Certificate) error {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       r.Host,
+		Roots:         r.RootCAs,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+func newTlsCertificate(cert *x509.Certificate, now time.Time) *schema.TlsCertificate {
+	notBefore := &opsee_types.Timestamp{}
+	notBefore.Scan(cert.NotBefore)
+	notAfter := &opsee_types.Timestamp{}
+	notAfter.Scan(cert.NotAfter)
+
+	ips := make([]string, 0, len(cert.IPAddresses))
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+
+	return &schema.TlsCertificate{
+		Subject:         cert.Subject.String(),
+		Issuer:          cert.Issuer.String(),
+		DnsNames:        cert.DNSNames,
+		IpAddresses:     ips,
+		SerialNumber:    cert.SerialNumber.String(),
+		NotBefore:       notBefore,
+		NotAfter:        notAfter,
+		DaysUntilExpiry: cert.NotAfter.Sub(now).Hours() / 24,
+	}
+}
+
+func (r *TLSRequest) logFields() log.Fields {
+	return log.Fields{"address": r.Address, "host": r.Host}
+}
+
+func NewTLSWorker(queue chan Worker) Worker {
+	return newRequestWorker(queue, func(r Request) bool {
+		_, ok := r.(*TLSRequest)
+		return ok
+	})
+}
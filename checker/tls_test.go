@@ -0,0 +1,196 @@
+package checker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opsee/basic/schema"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestTLSRequestReportsCertificate(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	request := &TLSRequest{Address: ts.Listener.Addr().String(), Host: "example.com", RootCAs: roots}
+	resp := checkReply(t, <-request.Do(context.Background())).GetTlsResponse()
+
+	assert.True(t, resp.Verified, resp.VerifyError)
+	assert.Contains(t, resp.DnsNames, "example.com")
+	assert.True(t, resp.DaysUntilExpiry > 14)
+	assert.Equal(t, resp.DaysUntilExpiry, resp.ChainDaysUntilExpiry)
+	assert.Len(t, resp.Chain, 1)
+	assert.NotEmpty(t, resp.Protocol)
+	assert.NotEmpty(t, resp.CipherSuite)
+	assert.Equal(t, "days_until_expiry", resp.Metrics[1].Name)
+}
+
+func TestTLSRequestReportsVerifyError(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	request := &TLSRequest{Address: ts.Listener.Addr().String(), Host: "wrong.example.org", RootCAs: roots}
+	resp := checkReply(t, <-request.Do(context.Background())).GetTlsResponse()
+
+	assert.False(t, resp.Verified)
+	assert.Contains(t, resp.VerifyError, "wrong.example.org")
+	assert.NotEmpty(t, resp.Subject)
+}
+
+func TestTLSRequestReportsExpiry(t *testing.T) {
+	now := time.Now()
+	ca, caKey := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		NotBefore:             now.Add(-48 * time.Hour),
+		NotAfter:              now.Add(10 * 24 * time.Hour),
+	}, nil, nil)
+	leaf, leafKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotBefore:    now.Add(-48 * time.Hour),
+		NotAfter:     now.Add(-24 * time.Hour),
+	}, ca, caKey)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.Raw, ca.Raw}, PrivateKey: leafKey}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go acceptTLS(listener)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	request := &TLSRequest{Address: listener.Addr().String(), Host: "example.com", RootCAs: roots}
+	resp := checkReply(t, <-request.Do(context.Background())).GetTlsResponse()
+
+	assert.False(t, resp.Verified)
+	assert.Contains(t, resp.VerifyError, "expired")
+	assert.InDelta(t, -1, resp.DaysUntilExpiry, 0.01)
+	if assert.Len(t, resp.Chain, 2) {
+		assert.InDelta(t, 10, resp.Chain[1].DaysUntilExpiry, 0.01)
+	}
+	// The chain expires with its first certificate to expire, here the leaf.
+	assert.Equal(t, resp.DaysUntilExpiry, resp.ChainDaysUntilExpiry)
+	assert.Equal(t, resp.DaysUntilExpiry, resp.Metrics[1].Value)
+}
+
+func TestTLSRequestClientCertificate(t *testing.T) {
+	store, serverConfig, cleanup := testCredentials(t)
+	defer cleanup()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clients := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if tlsConn.Handshake() == nil {
+			clients <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+		close(clients)
+	}()
+
+	certs, pool, err := store.Credentials("client", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := &TLSRequest{Address: listener.Addr().String(), Host: "example.com", RootCAs: pool, Certificates: certs}
+	resp := checkReply(t, <-request.Do(context.Background())).GetTlsResponse()
+	assert.True(t, resp.Verified, resp.VerifyError)
+	assert.Equal(t, "client", <-clients)
+}
+
+func TestRunnerDispatchesTLSCheck(t *testing.T) {
+	store, serverConfig, cleanup := testCredentials(t)
+	defer cleanup()
+
+	serverNames := make(chan string, 2)
+	config := serverConfig.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverNames <- hello.ServerName
+		return nil, nil
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go acceptTLS(listener)
+
+	check := TestCommonStubs{}.Check()
+	spec := &schema.TlsCheck{ClientCertificate: "client", CaBundle: "root"}
+	check.Spec = &schema.Check_TlsCheck{TlsCheck: spec}
+	targets := []*schema.Target{{Id: "10.0.0.1", Type: "host", Name: "wrong.example.org", Address: listener.Addr().String()}}
+
+	runner := NewRunner(&schema.HttpCheck{})
+	runner.certs = store
+
+	// Host targets are checked against their name, unless the check
+	// overrides the server name.
+	responses, err := runner.RunCheck(context.Background(), check, targets)
+	if assert.NoError(t, err) && assert.Len(t, responses, 1) {
+		resp := responses[0].GetTlsResponse()
+		if assert.NotNil(t, resp, responses[0].Error) {
+			assert.Equal(t, "wrong.example.org", resp.Host)
+			assert.False(t, resp.Verified)
+			assert.Contains(t, resp.VerifyError, "wrong.example.org")
+		}
+		assert.Equal(t, "wrong.example.org", <-serverNames)
+	}
+
+	spec.ServerName = "example.com"
+	responses, err = runner.RunCheck(context.Background(), check, targets)
+	if assert.NoError(t, err) && assert.Len(t, responses, 1) {
+		resp := responses[0].GetTlsResponse()
+		if assert.NotNil(t, resp, responses[0].Error) {
+			assert.Equal(t, "example.com", resp.Host)
+			assert.True(t, resp.Verified, resp.VerifyError)
+		}
+		assert.Equal(t, "example.com", <-serverNames)
+	}
+}
+
+// acceptTLS completes the handshake of every connection to listener and
+// closes it.
+func acceptTLS(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}
+}
@@ -0,0 +1,369 @@
+package checker
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	"golang.org/x/net/context"
+)
+
+// httpVerbs are the request methods HTTP checks may use. An empty verb is a
+// GET.
+var httpVerbs = map[string]bool{
+	"":        true,
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"OPTIONS": true,
+}
+
+// httpHeaderName matches the token characters allowed in header names.
+var httpHeaderName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// ValidateCheckDefinition statically validates a check, returning every
+// problem found. It doesn't resolve the check's target or run it.
+func ValidateCheckDefinition(check *schema.Check) []string {
+	problems := []string{}
+	if err := normalizeCheck(check); err != nil {
+		return append(problems, err.Error())
+	}
+	if err := validateCheck(check); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// validateCheck has reported a missing or undecodable spec.
+	spec, err := checkSpec(check)
+	if err != nil {
+		return problems
+	}
+
+	problems = append(problems, validateSpec(check, spec)...)
+	problems = append(problems, validateAssertions(check.Assertions, spec)...)
+	return problems
+}
+
+func validatePort(port int32, required bool) []string {
+	if port == 0 && !required {
+		return nil
+	}
+	if port < 1 || port > 65535 {
+		return []string{fmt.Sprintf("Port out of range: %d", port)}
+	}
+	return nil
+}
+
+// validateCredentials checks the names of the TLS credentials a spec refers
+// to. Whether they exist can only be known by the runner.
+func validateCredentials(spec interface{}) []string {
+	problems := []string{}
+	clientCertificate, caBundle := specCredentials(spec)
+	if clientCertificate == "" && caBundle == "" {
+		return nil
+	}
+
+	if clientCertificate != "" && !ValidCredentialName(clientCertificate) {
+		problems = append(problems, fmt.Sprintf("Invalid client certificate name: %q", clientCertificate))
+	}
+	if caBundle != "" && !ValidCredentialName(caBundle) {
+		problems = append(problems, fmt.Sprintf("Invalid CA bundle name: %q", caBundle))
+	}
+
+	switch s := spec.(type) {
+	case *schema.TcpCheck:
+		if !s.Tls {
+			problems = append(problems, "TCP client_certificate and ca_bundle require tls")
+		}
+	case *schema.GrpcCheck:
+		if !s.Tls {
+			problems = append(problems, "gRPC client_certificate and ca_bundle require tls")
+		}
+	}
+
+	return problems
+}
+
+func validateSpec(check *schema.Check, spec interface{}) []string {
+	problems := []string{}
+
+	switch s := spec.(type) {
+	case *schema.HttpCheck:
+		if s.Protocol != "http" && s.Protocol != "https" {
+			problems = append(problems, fmt.Sprintf("Unsupported HTTP protocol: %q", s.Protocol))
+		}
+		if !httpVerbs[s.Verb] {
+			problems = append(problems, fmt.Sprintf("Unsupported HTTP verb: %q", s.Verb))
+		}
+		problems = append(problems, validatePort(s.Port, true)...)
+		if s.Path != "" && !strings.HasPrefix(s.Path, "/") {
+			problems = append(problems, fmt.Sprintf("HTTP path must begin with /: %q", s.Path))
+		} else if _, err := url.Parse(fmt.Sprintf("%s://localhost%s", s.Protocol, s.Path)); err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid HTTP path: %s", err))
+		}
+		switch s.RedirectPolicy {
+		case "", RedirectPolicyNone, RedirectPolicySameHost, RedirectPolicyAny:
+		default:
+			problems = append(problems, fmt.Sprintf("Unknown HTTP redirect policy: %q", s.RedirectPolicy))
+		}
+		if s.MaxRedirects < 0 {
+			problems = append(problems, fmt.Sprintf("HTTP max_redirects must not be negative: %d", s.MaxRedirects))
+		}
+		for _, h := range s.Headers {
+			if !httpHeaderName.MatchString(h.Name) {
+				problems = append(problems, fmt.Sprintf("Invalid HTTP header name: %q", h.Name))
+			}
+			for _, v := range h.Values {
+				if strings.ContainsAny(v, "\r\n") {
+					problems = append(problems, fmt.Sprintf("HTTP header %s has a value containing a line break", h.Name))
+				}
+			}
+		}
+
+	case *schema.TcpCheck:
+		problems = append(problems, validatePort(s.Port, true)...)
+		if s.ReadBytes < 0 || s.ReadBytes > MaxContentLength {
+			problems = append(problems, fmt.Sprintf("TCP read_bytes must be between 0 and %d: %d", MaxContentLength, s.ReadBytes))
+		}
+
+	case *schema.TlsCheck:
+		problems = append(problems, validatePort(s.Port, false)...)
+
+	case *schema.DnsCheck:
+		if _, ok := dnsRecordType(s); !ok {
+			problems = append(problems, fmt.Sprintf("Unsupported DNS record type: %s", s.RecordType))
+		}
+		if s.Server != "" {
+			if _, port, err := net.SplitHostPort(s.Server); err == nil {
+				p, err := strconv.Atoi(port)
+				if err != nil || p < 1 || p > 65535 {
+					problems = append(problems, fmt.Sprintf("Invalid DNS server port: %s", s.Server))
+				}
+			}
+		}
+
+	case *schema.GrpcCheck:
+		problems = append(problems, validatePort(s.Port, true)...)
+
+	case *schema.CloudWatchCheck:
+		if len(s.Metrics) == 0 {
+			problems = append(problems, "CloudWatch check has no metrics")
+		}
+		request := &CloudWatchRequest{Target: check.Target}
+		if request.Target == nil {
+			request.Target = &schema.Target{}
+		}
+		for _, metric := range s.Metrics {
+			if metric.Name == "" {
+				problems = append(problems, "CloudWatch metric has no name")
+			}
+			if metric.Namespace != s.Metrics[0].Namespace {
+				problems = append(problems, fmt.Sprintf("CloudWatch metrics must share a namespace: %s and %s", s.Metrics[0].Namespace, metric.Namespace))
+			}
+			if _, err := request.GetDimensions(metric); err != nil {
+				problems = append(problems, fmt.Sprintf("CloudWatch metric %s: %s", metric.Name, err))
+			}
+		}
+
+	default:
+		problems = append(problems, fmt.Sprintf("Unrecognized check type: %T", spec))
+	}
+
+	problems = append(problems, validateCredentials(spec)...)
+
+	return problems
+}
+
+// replyType returns the type of the reply for a check spec, whose JSON fields
+// may be asserted on.
+func replyType(spec interface{}) reflect.Type {
+	switch spec.(type) {
+	case *schema.HttpCheck:
+		return reflect.TypeOf(schema.HttpResponse{})
+	case *schema.CloudWatchCheck:
+		return reflect.TypeOf(schema.CloudWatchResponse{})
+	case *schema.TcpCheck:
+		return reflect.TypeOf(schema.TcpResponse{})
+	case *schema.TlsCheck:
+		return reflect.TypeOf(schema.TlsResponse{})
+	case *schema.DnsCheck:
+		return reflect.TypeOf(schema.DnsResponse{})
+	case *schema.GrpcCheck:
+		return reflect.TypeOf(schema.GrpcResponse{})
+	}
+	return nil
+}
+
+// replyFields returns the names of the JSON fields of a reply type.
+func replyFields(t reflect.Type) map[string]bool {
+	fields := map[string]bool{}
+	if t == nil {
+		return fields
+	}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func validateAssertions(assertions []*schema.Assertion, spec interface{}) []string {
+	problems := []string{}
+	fields := replyFields(replyType(spec))
+	_, isHTTP := spec.(*schema.HttpCheck)
+
+	for i, a := range assertions {
+		invalid := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf("Assertion %d: ", i)+fmt.Sprintf(format, args...))
+		}
+
+		switch a.Key {
+		case "":
+			invalid("no key")
+		case AssertionKeyHeader:
+			if !isHTTP {
+				invalid("header assertions apply only to HTTP checks")
+			}
+			if a.Value == "" {
+				invalid("header assertion has no header name")
+			}
+		case AssertionKeyJSON:
+			if !fields["body"] {
+				invalid("json assertions need a reply with a body")
+			}
+		case AssertionKeyCloudWatch, AssertionKeyMetric:
+			if a.Value == "" {
+				invalid("%s assertion has no metric name", a.Key)
+			}
+			if !fields["metrics"] {
+				invalid("%s assertions need a reply with metrics", a.Key)
+			}
+			if cw, ok := spec.(*schema.CloudWatchCheck); ok && a.Value != "" {
+				found := false
+				for _, metric := range cw.Metrics {
+					found = found || metric.Name == a.Value
+				}
+				if !found {
+					invalid("metric %s is not collected by the check", a.Value)
+				}
+			}
+		default:
+			path := strings.FieldsFunc(a.Key, func(r rune) bool { return r == '.' || r == '[' })
+			if len(path) == 0 || !fields[path[0]] {
+				invalid("unknown key: %s", a.Key)
+			}
+		}
+
+		needsOperand, ok := AssertionRelationships[a.Relationship]
+		if !ok {
+			invalid("unknown relationship: %q", a.Relationship)
+			continue
+		}
+		if !needsOperand {
+			continue
+		}
+		switch a.Relationship {
+		case "regExp":
+			if _, err := regexp.Compile(a.Operand); err != nil {
+				invalid("invalid regular expression: %s", err)
+			}
+		case "lessThan", "greaterThan":
+			if _, err := strconv.ParseFloat(a.Operand, 64); err != nil {
+				invalid("operand is not a number: %q", a.Operand)
+			}
+		}
+	}
+
+	return problems
+}
+
+// dispatchableTargets counts the resolved targets a check would actually be
+// run against, describing any that would be skipped.
+func dispatchableTargets(spec interface{}, targets []*schema.Target) (int, []string) {
+	skipped := 0
+	reason := ""
+
+	switch s := spec.(type) {
+	case *schema.HttpCheck, *schema.TcpCheck, *schema.TlsCheck, *schema.GrpcCheck:
+		reason = "have no address"
+		for _, t := range targets {
+			if t.Address == "" {
+				skipped++
+			}
+		}
+	case *schema.CloudWatchCheck:
+		reason = "have no ID"
+		for _, t := range targets {
+			if t.Id == "" {
+				skipped++
+			}
+		}
+	case *schema.DnsCheck:
+		// DNS checks query each name once.
+		if s.Name != "" {
+			if len(targets) == 0 {
+				return 0, nil
+			}
+			return 1, nil
+		}
+		reason = "have no name"
+		names := map[string]bool{}
+		for _, t := range targets {
+			if t.Name == "" || names[t.Name] {
+				skipped++
+			}
+			names[t.Name] = true
+		}
+	}
+
+	if skipped == 0 {
+		return len(targets), nil
+	}
+	return len(targets) - skipped, []string{fmt.Sprintf("%d of %d targets %s and would be skipped", skipped, len(targets), reason)}
+}
+
+// ValidateCheck validates a check definition without scheduling or running
+// it. In addition to statically validating the definition, it resolves the
+// check's target to report how many targets the check would run against.
+func (c *Checker) ValidateCheck(ctx context.Context, req *opsee.ValidateCheckRequest) (*opsee.ValidateCheckResponse, error) {
+	if req.Check == nil {
+		return nil, fmt.Errorf("Check required but missing in request")
+	}
+
+	check := req.Check
+	resp := &opsee.ValidateCheckResponse{
+		Errors: ValidateCheckDefinition(check),
+	}
+
+	if spec, err := checkSpec(check); err == nil {
+		if _, err := c.Secrets.expandSpec(spec); err != nil {
+			resp.Errors = append(resp.Errors, err.Error())
+		}
+	}
+
+	if check.Target != nil {
+		targets, err := c.resolver.Resolve(ctx, check.Target)
+		if err != nil {
+			resp.ResolveError = err.Error()
+		} else if spec, err := checkSpec(check); err == nil {
+			n, warnings := dispatchableTargets(spec, targets)
+			resp.Targets = int32(n)
+			resp.Warnings = warnings
+		} else {
+			resp.Targets = int32(len(targets))
+		}
+	}
+
+	resp.Valid = len(resp.Errors) == 0 && resp.ResolveError == "" && resp.Targets > 0
+	return resp, nil
+}
@@ -0,0 +1,187 @@
+package checker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/opsee/basic/schema"
+	opsee "github.com/opsee/basic/service"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func validateTestCheck(t *testing.T, spec interface{}) *schema.Check {
+	check := TestCommonStubs{}.PassingCheck()
+	switch s := spec.(type) {
+	case *schema.HttpCheck:
+		check.Spec = &schema.Check_HttpCheck{HttpCheck: s}
+	case *schema.CloudWatchCheck:
+		check.Spec = &schema.Check_CloudwatchCheck{CloudwatchCheck: s}
+	case *schema.TcpCheck:
+		check.Spec = &schema.Check_TcpCheck{TcpCheck: s}
+	case *schema.TlsCheck:
+		check.Spec = &schema.Check_TlsCheck{TlsCheck: s}
+	case *schema.DnsCheck:
+		check.Spec = &schema.Check_DnsCheck{DnsCheck: s}
+	case *schema.GrpcCheck:
+		check.Spec = &schema.Check_GrpcCheck{GrpcCheck: s}
+	}
+	return check
+}
+
+// assertProblems asserts that each problem contains the corresponding
+// expected substring.
+func assertProblems(t *testing.T, problems []string, expected ...string) {
+	if assert.Len(t, problems, len(expected), "%v", problems) {
+		for i, e := range expected {
+			assert.True(t, strings.Contains(problems[i], e), "%q does not contain %q", problems[i], e)
+		}
+	}
+}
+
+func TestValidateCheckDefinitionAcceptsValidChecks(t *testing.T) {
+	http := validateTestCheck(t, TestCommonStubs{}.HTTPCheck())
+	http.GetHttpCheck().RedirectPolicy = RedirectPolicySameHost
+	http.Assertions = []*schema.Assertion{
+		{Key: "code", Relationship: "equal", Operand: "200"},
+		{Key: "redirects[0].code", Relationship: "equal", Operand: "301"},
+		{Key: "header", Value: "Content-Type", Relationship: "contain", Operand: "json"},
+		{Key: "json", Value: "data.items[0]", Relationship: "notEmpty"},
+		{Key: "metric", Value: "request_latency", Relationship: "lessThan", Operand: "500"},
+	}
+	tls := validateTestCheck(t, &schema.TlsCheck{})
+	tls.Assertions = []*schema.Assertion{
+		{Key: "chain[1].days_until_expiry", Relationship: "greaterThan", Operand: "30"},
+	}
+
+	checks := []*schema.Check{
+		http,
+		tls,
+		validateTestCheck(t, &schema.TcpCheck{Port: 22}),
+		validateTestCheck(t, &schema.DnsCheck{RecordType: "a", Server: "10.0.0.2:53"}),
+		validateTestCheck(t, &schema.DnsCheck{Name: "db.internal"}),
+		validateTestCheck(t, &schema.GrpcCheck{Port: 50051}),
+		validateTestCheck(t, &schema.GrpcCheck{Port: 50051, Tls: true, ClientCertificate: "client", CaBundle: "root"}),
+	}
+	for _, check := range checks {
+		assert.Empty(t, ValidateCheckDefinition(check), "%s", check)
+	}
+}
+
+func TestValidateCheckDefinitionHTTP(t *testing.T) {
+	spec := &schema.HttpCheck{
+		Protocol: "gopher",
+		Verb:     "FETCH",
+		Port:     70000,
+		Path:     "index.html",
+		Headers: []*schema.Header{
+			{Name: "Bad Header", Values: []string{"ok"}},
+			{Name: "X-Injected", Values: []string{"a\r\nb"}},
+		},
+		RedirectPolicy: "sometimes",
+		MaxRedirects:   -1,
+	}
+	assertProblems(t, ValidateCheckDefinition(validateTestCheck(t, spec)),
+		"protocol", "verb", "Port out of range", "path", "redirect policy", "max_redirects", "header name", "line break")
+}
+
+func TestValidateCheckDefinitionTypes(t *testing.T) {
+	assertProblems(t, ValidateCheckDefinition(validateTestCheck(t, &schema.TcpCheck{ReadBytes: -1})),
+		"Port out of range", "read_bytes")
+	assertProblems(t, ValidateCheckDefinition(validateTestCheck(t, &schema.DnsCheck{RecordType: "PTR", Server: "10.0.0.2:0"})),
+		"record type", "server port")
+	assertProblems(t, ValidateCheckDefinition(validateTestCheck(t, &schema.GrpcCheck{})),
+		"Port out of range")
+	assertProblems(t, ValidateCheckDefinition(validateTestCheck(t, &schema.TcpCheck{Port: 22, ClientCertificate: "../client", CaBundle: "root"})),
+		"client certificate name", "require tls")
+	assertProblems(t, ValidateCheckDefinition(validateTestCheck(t, &schema.TlsCheck{CaBundle: "root/../../etc"})),
+		"CA bundle name")
+}
+
+func TestValidateCheckDefinitionCloudWatch(t *testing.T) {
+	check := validateTestCheck(t, &schema.CloudWatchCheck{
+		Metrics: []*schema.CloudWatchMetric{
+			{Namespace: "AWS/RDS", Name: "CPUUtilization"},
+			{Namespace: "AWS/Lambda", Name: "Errors"},
+		},
+	})
+	check.Assertions = []*schema.Assertion{
+		{Key: "cloudwatch", Value: "FreeStorageSpace", Relationship: "greaterThan", Operand: "1"},
+	}
+	assertProblems(t, ValidateCheckDefinition(check),
+		"share a namespace", "Errors", "not collected")
+}
+
+func TestValidateCheckDefinitionAssertions(t *testing.T) {
+	check := validateTestCheck(t, &schema.TcpCheck{Port: 22})
+	check.Assertions = []*schema.Assertion{
+		{Key: "", Relationship: "equal"},
+		{Key: "header", Value: "Server", Relationship: "equal", Operand: "x"},
+		{Key: "days_until_expiry", Relationship: "lessThan", Operand: "5"},
+		{Key: "body", Relationship: "matches", Operand: "x"},
+		{Key: "body", Relationship: "regExp", Operand: "("},
+		{Key: "body", Relationship: "greaterThan", Operand: "many"},
+	}
+	assertProblems(t, ValidateCheckDefinition(check),
+		"Assertion 0: no key",
+		"Assertion 1: header assertions apply only to HTTP",
+		"Assertion 2: unknown key",
+		"Assertion 3: unknown relationship",
+		"Assertion 4: invalid regular expression",
+		"Assertion 5: operand is not a number")
+}
+
+func TestValidateCheckReportsTargets(t *testing.T) {
+	resolver := newTestResolver()
+	resolver.Targets["sg"] = append(resolver.Targets["sg"], &schema.Target{Id: "i-2", Type: "instance"})
+	checker := NewChecker(resolver)
+
+	resp, err := checker.ValidateCheck(context.Background(), &opsee.ValidateCheckRequest{Check: TestCommonStubs{}.PassingCheck()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, resp.Valid)
+	assert.Empty(t, resp.Errors)
+	assert.EqualValues(t, 1, resp.Targets)
+	assertProblems(t, resp.Warnings, "1 of 2 targets have no address")
+
+	check := TestCommonStubs{}.PassingCheck()
+	check.Target = &schema.Target{Type: "sg", Id: "empty"}
+	check.Interval = 1
+	resp, err = checker.ValidateCheck(context.Background(), &opsee.ValidateCheckRequest{Check: check})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, resp.Valid)
+	assertProblems(t, resp.Errors, "interval")
+	assert.Empty(t, resp.ResolveError)
+	assert.EqualValues(t, 0, resp.Targets)
+}
+
+func TestValidateCheckReportsUnknownSecrets(t *testing.T) {
+	checker := NewChecker(newTestResolver())
+	spec := TestCommonStubs{}.HTTPCheck()
+	spec.Body = "${secret:token}"
+	check := TestCommonStubs{}.PassingCheck()
+	check.Spec = &schema.Check_HttpCheck{HttpCheck: spec}
+
+	resp, err := checker.ValidateCheck(context.Background(), &opsee.ValidateCheckRequest{Check: check})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertProblems(t, resp.Errors, "Secrets are not enabled")
+
+	checker.Secrets = testSecretStore(t, "")
+	resp, err = checker.ValidateCheck(context.Background(), &opsee.ValidateCheckRequest{Check: check})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, resp.Errors)
+
+	spec.Body = "${secret:missing}"
+	resp, err = checker.ValidateCheck(context.Background(), &opsee.ValidateCheckRequest{Check: check})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertProblems(t, resp.Errors, "Unknown secret")
+}
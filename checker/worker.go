@@ -1,8 +1,10 @@
 package checker
 
 import (
+	"fmt"
 	"sync"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/opsee/basic/schema"
 	"golang.org/x/net/context"
 )
@@ -57,8 +59,82 @@ type Task struct {
 	Response *Response
 }
 
+// logFields returns the fields that identify a task in logs. Requests and
+// responses aren't logged, since they may hold secrets, and responses are
+// only redacted once the check's assertions have been evaluated.
+func (t *Task) logFields() log.Fields {
+	fields := log.Fields{"type": t.Type}
+	if t.Target != nil {
+		fields["target_type"] = t.Target.Type
+		fields["target_id"] = t.Target.Id
+	}
+	return fields
+}
+
 type Worker interface {
 	Work(context.Context, *Task) *Task
 }
 
 type NewWorkerFunc func(chan Worker) Worker
+
+// loggedRequest is a Request that can identify itself in logs without
+// logging anything it holds for the check, such as credentials.
+type loggedRequest interface {
+	Request
+	logFields() log.Fields
+}
+
+// requestWorker runs requests that carry everything needed to run them, for
+// the check types whose workers keep no state of their own. It only runs
+// requests its accepts func is true for.
+type requestWorker struct {
+	workerQueue chan Worker
+	accepts     func(Request) bool
+}
+
+func newRequestWorker(queue chan Worker, accepts func(Request) bool) Worker {
+	return &requestWorker{
+		workerQueue: queue,
+		accepts:     accepts,
+	}
+}
+
+func (w *requestWorker) Work(ctx context.Context, task *Task) *Task {
+	defer func() {
+		w.workerQueue <- w
+	}()
+
+	if ctx.Err() != nil {
+		task.Response = &Response{
+			Error: ctx.Err(),
+		}
+		return task
+	}
+
+	if task.Request != nil && w.accepts(task.Request) {
+		fields := log.Fields{}
+		if r, ok := task.Request.(loggedRequest); ok {
+			fields = r.logFields()
+		}
+
+		log.WithFields(fields).Debugf("%s request", task.Type)
+		select {
+		case response := <-task.Request.Do(ctx):
+			if response.Error != nil {
+				log.WithFields(fields).WithError(response.Error).Error("error processing request")
+			}
+			task.Response = response
+		case <-ctx.Done():
+			task.Response = &Response{
+				Error: ctx.Err(),
+			}
+		}
+	} else {
+		task.Response = &Response{
+			Error: fmt.Errorf("Unable to process request: %T", task.Request),
+		}
+	}
+
+	log.WithFields(task.logFields()).Debug("Finished request.")
+	return task
+}
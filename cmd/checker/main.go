@@ -3,15 +3,20 @@ package main
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/nsqio/go-nsq"
+	"github.com/opsee/basic/schema"
 	opsee "github.com/opsee/basic/service"
 	"github.com/opsee/bastion/checker"
 	"github.com/opsee/bastion/config"
@@ -24,8 +29,19 @@ const (
 )
 
 var (
-	adminPort      int
-	signalsChannel = make(chan os.Signal, 1)
+	adminPort         int
+	httpAdminHost     string
+	httpAdminPort     int
+	scheduleJitter    time.Duration
+	reconcileInterval time.Duration
+	reconcileJitter   time.Duration
+	snapshotPath      string
+	maintenancePath   string
+	secretsPath       string
+	secretKeyPath     string
+	subscriberBuffer  int
+	stateConfig       = &checker.NSQStateTrackerConfig{}
+	signalsChannel    = make(chan os.Signal, 1)
 )
 
 func init() {
@@ -41,8 +57,22 @@ func main() {
 	flag.StringVar(&runnerConfig.ConsumerQueueName, "results", "results", "Result queue name.")
 	flag.StringVar(&runnerConfig.ProducerQueueName, "requests", "runner", "Requests queue name.")
 	flag.StringVar(&runnerConfig.ConsumerChannelName, "channel", "runner", "Consumer channel name.")
+	flag.StringVar(&runnerConfig.CancelQueueName, "cancels", "runner_cancel", "Streaming run cancellation queue name.")
+	flag.StringVar(&runnerConfig.PartialQueueName, "partials", "runner_partial", "Streaming run partial result queue name.")
 	flag.IntVar(&runnerConfig.MaxHandlers, "max_checks", 10, "Maximum concurrently executing checks.")
 	flag.IntVar(&adminPort, "admin_port", 4000, "Port for the admin server.")
+	flag.StringVar(&httpAdminHost, "http_admin_host", "127.0.0.1", "Address the HTTP admin server listens on. It is unauthenticated, so it only listens on localhost by default.")
+	flag.IntVar(&httpAdminPort, "http_admin_port", 4002, "Port for the HTTP admin server.")
+	flag.DurationVar(&scheduleJitter, "schedule_jitter", 0, "Maximum random delay added to each scheduled check run.")
+	flag.DurationVar(&reconcileInterval, "reconcile_interval", checker.DefaultReconcileInterval, "How often to reconcile checks with Opsee.")
+	flag.DurationVar(&reconcileJitter, "reconcile_jitter", checker.DefaultReconcileJitter, "Maximum random delay added to each reconcile interval.")
+	flag.StringVar(&snapshotPath, "snapshot", "/var/lib/opsee/checker/checks.snapshot", "File in which to persist scheduled checks. Empty to disable.")
+	flag.StringVar(&maintenancePath, "maintenance", "/var/lib/opsee/checker/maintenance", "File in which to persist maintenance windows. Empty to keep them in memory.")
+	flag.StringVar(&secretsPath, "secrets", checker.DefaultSecretsPath, "File in which the bastion's secrets are stored, encrypted.")
+	flag.StringVar(&secretKeyPath, "secret_key", checker.DefaultSecretKeyPath, "File holding the key material the secrets key is derived from. Generated if it doesn't exist.")
+	flag.IntVar(&subscriberBuffer, "subscriber_buffer", checker.DefaultSubscriberBuffer, "Results buffered for each results subscriber before the oldest are dropped.")
+	flag.StringVar(&stateConfig.ConsumerChannelName, "state_channel", "state", "Results channel consumed by the state tracker.")
+	flag.StringVar(&stateConfig.ProducerQueueName, "state_transitions", "state_transitions", "Check state transition queue name.")
 	flag.Parse()
 
 	bezosConn, err := grpc.Dial(
@@ -67,11 +97,31 @@ func main() {
 	if err != nil {
 		log.WithFields(log.Fields{"service": moduleName, "customerId": cfg.CustomerId, "event": "create runner", "error": "couldn't create runner"}).Fatal(err.Error())
 	}
+	runner.Results.BufferSize = subscriberBuffer
 	newChecker.Runner = runner
 
 	scheduler := checker.NewScheduler(resolver)
+	scheduler.Jitter = scheduleJitter
 	newChecker.Scheduler = scheduler
 
+	maintenance, err := checker.NewMaintenanceStore(maintenancePath)
+	if err != nil {
+		log.WithFields(log.Fields{"service": moduleName, "customerId": cfg.CustomerId, "event": "load maintenance windows", "error": "couldn't load maintenance windows"}).Fatal(err.Error())
+	}
+	scheduler.Maintenance = maintenance
+	newChecker.Maintenance = maintenance
+
+	secretKey, err := checker.LoadSecretKeyFile(secretKeyPath)
+	if err != nil {
+		log.WithFields(log.Fields{"service": moduleName, "customerId": cfg.CustomerId, "event": "load secret key", "error": "couldn't load secret key"}).Fatal(err.Error())
+	}
+	secrets, err := checker.NewSecretStore(secretsPath, checker.BastionSecretKey(secretKey, cfg.CustomerId, cfg.BastionId))
+	if err != nil {
+		log.WithFields(log.Fields{"service": moduleName, "customerId": cfg.CustomerId, "event": "load secrets", "error": "couldn't load secrets"}).Fatal(err.Error())
+	}
+	log.SetFormatter(secrets.LogFormatter(log.StandardLogger().Formatter))
+	newChecker.Secrets = secrets
+
 	producer, err := nsq.NewProducer(cfg.NsqdHost, nsq.NewConfig())
 	if err != nil {
 		log.WithFields(log.Fields{"service": moduleName, "customerId": cfg.CustomerId, "event": "create create producer", "error": "couldn't create producer"}).Fatal(err.Error())
@@ -80,11 +130,35 @@ func main() {
 	scheduler.Producer = producer
 	defer newChecker.Stop()
 
+	stateConfig.ConsumerQueueName = runnerConfig.ConsumerQueueName
+	stateConfig.NsqdHost = cfg.NsqdHost
+	lookup := func(checkId string) (*schema.Check, error) {
+		return scheduler.RetrieveCheck(&schema.Check{Id: checkId})
+	}
+	tracker := checker.NewStateTracker(lookup)
+	stateTracker, err := checker.NewNSQStateTracker(tracker, stateConfig)
+	if err != nil {
+		log.WithFields(log.Fields{"service": moduleName, "customerId": cfg.CustomerId, "event": "create state tracker", "error": "couldn't create state tracker"}).Fatal(err.Error())
+	}
+	defer stateTracker.Stop()
+	newChecker.States = tracker
+
 	newChecker.Port = adminPort
+	newChecker.ReconcileInterval = reconcileInterval
+	newChecker.ReconcileJitter = reconcileJitter
+	newChecker.SnapshotPath = snapshotPath
 	if err := newChecker.Start(); err != nil {
 		log.WithFields(log.Fields{"service": moduleName, "customerId": cfg.CustomerId, "event": "start checker", "error": "couldn't start checker"}).Fatal(err.Error())
 	}
 
+	go func() {
+		addr := net.JoinHostPort(httpAdminHost, fmt.Sprint(httpAdminPort))
+		for {
+			log.WithError(http.ListenAndServe(addr, newChecker.AdminHandler())).Error("HTTP admin server error. Restarting.")
+			time.Sleep(time.Second)
+		}
+	}()
+
 	portmapper.EtcdHost = cfg.EtcdHost
 	portmapper.Register(moduleName, newChecker.Port)
 	defer portmapper.Unregister(moduleName, newChecker.Port)
@@ -34,7 +34,15 @@ func main() {
 	flag.StringVar(&runnerConfig.ProducerQueueName, "results", "results", "Result queue name.")
 	flag.StringVar(&runnerConfig.ConsumerQueueName, "requests", "runner", "Requests queue name.")
 	flag.StringVar(&runnerConfig.ConsumerChannelName, "channel", "cwrunner", "Consumer channel name.")
+	flag.StringVar(&runnerConfig.CancelQueueName, "cancels", "runner_cancel", "Streaming run cancellation queue name.")
+	flag.StringVar(&runnerConfig.PartialQueueName, "partials", "runner_partial", "Streaming run partial result queue name.")
 	flag.IntVar(&runnerConfig.MaxHandlers, "max_checks", 10, "Maximum concurrently executing checks.")
+	flag.StringVar(&runnerConfig.SpoolDir, "spool", "/var/lib/opsee/"+moduleName+"/spool", "Directory in which to spool results while they can't be published. Empty to disable.")
+	flag.Int64Var(&runnerConfig.SpoolMaxBytes, "spool_max_bytes", checker.DefaultSpoolMaxBytes, "Maximum size of the result spool in bytes.")
+	flag.DurationVar(&runnerConfig.SpoolMaxAge, "spool_max_age", checker.DefaultSpoolMaxAge, "Maximum age of spooled results.")
+	flag.IntVar(&runnerConfig.BatchSize, "batch_size", 1, "Maximum number of results per published message. Results are not batched if 1.")
+	flag.DurationVar(&runnerConfig.BatchWindow, "batch_window", checker.DefaultBatchWindow, "Maximum time a result waits in a batch.")
+	flag.StringVar(&runnerConfig.BatchCompression, "batch_compression", checker.CompressionNone, "Compression of batched results, empty or gzip.")
 	flag.Parse()
 	runnerConfig.ConsumerNsqdHost = config.GetConfig().NsqdHost
 	runnerConfig.ProducerNsqdHost = config.GetConfig().NsqdHost
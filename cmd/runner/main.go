@@ -4,6 +4,7 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	log "github.com/Sirupsen/logrus"
@@ -27,18 +28,68 @@ func init() {
 }
 
 func main() {
-	var err error
+	var (
+		err                 error
+		secretsPath         string
+		secretKeyPath       string
+		redactAllowHeaders  string
+		redactDenyHeaders   string
+		redactBodyPatterns  string
+		redactBodyRegexp    string
+		redactPassingBodies bool
+	)
 
 	runnerConfig := &checker.NSQRunnerConfig{}
 	flag.StringVar(&runnerConfig.Id, "id", moduleName, "Runner identifier.")
 	flag.StringVar(&runnerConfig.ProducerQueueName, "results", "results", "Result queue name.")
 	flag.StringVar(&runnerConfig.ConsumerQueueName, "requests", "runner", "Requests queue name.")
 	flag.StringVar(&runnerConfig.ConsumerChannelName, "channel", "runner", "Consumer channel name.")
+	flag.StringVar(&runnerConfig.CancelQueueName, "cancels", "runner_cancel", "Streaming run cancellation queue name.")
+	flag.StringVar(&runnerConfig.PartialQueueName, "partials", "runner_partial", "Streaming run partial result queue name.")
 	flag.IntVar(&runnerConfig.MaxHandlers, "max_checks", 10, "Maximum concurrently executing checks.")
+	flag.StringVar(&runnerConfig.SpoolDir, "spool", "/var/lib/opsee/"+moduleName+"/spool", "Directory in which to spool results while they can't be published. Empty to disable.")
+	flag.Int64Var(&runnerConfig.SpoolMaxBytes, "spool_max_bytes", checker.DefaultSpoolMaxBytes, "Maximum size of the result spool in bytes.")
+	flag.DurationVar(&runnerConfig.SpoolMaxAge, "spool_max_age", checker.DefaultSpoolMaxAge, "Maximum age of spooled results.")
+	flag.IntVar(&runnerConfig.BatchSize, "batch_size", 1, "Maximum number of results per published message. Results are not batched if 1.")
+	flag.DurationVar(&runnerConfig.BatchWindow, "batch_window", checker.DefaultBatchWindow, "Maximum time a result waits in a batch.")
+	flag.StringVar(&runnerConfig.BatchCompression, "batch_compression", checker.CompressionNone, "Compression of batched results, empty or gzip.")
+	flag.StringVar(&secretsPath, "secrets", checker.DefaultSecretsPath, "File in which the bastion's secrets are stored, encrypted.")
+	flag.StringVar(&secretKeyPath, "secret_key", checker.DefaultSecretKeyPath, "File holding the key material the secrets key is derived from. Generated if it doesn't exist.")
+	flag.StringVar(&runnerConfig.CertsDir, "certs", checker.DefaultCertsDir, "Directory of the client certificates and CA bundles that checks refer to by name.")
+	flag.StringVar(&redactAllowHeaders, "redact_allow_headers", "", "Comma separated response headers whose values are kept. Empty to keep all but the denied headers.")
+	flag.StringVar(&redactDenyHeaders, "redact_deny_headers", strings.Join(checker.DefaultDenyHeaders, ","), "Comma separated response headers whose values are redacted.")
+	flag.StringVar(&redactBodyPatterns, "redact_body_patterns", "token", "Comma separated built-in patterns scrubbed from response bodies: token, email and card. The email and card patterns also match identifiers and timestamps, so they are off by default.")
+	flag.StringVar(&redactBodyRegexp, "redact_body_regexp", "", "Regular expression whose matches are scrubbed from response bodies.")
+	flag.BoolVar(&redactPassingBodies, "redact_passing_bodies", false, "Drop the bodies of passing responses.")
 	flag.Parse()
 	runnerConfig.ConsumerNsqdHost = config.GetConfig().NsqdHost
 	runnerConfig.ProducerNsqdHost = config.GetConfig().NsqdHost
 
+	secretKey, err := checker.LoadSecretKeyFile(secretKeyPath)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	runnerConfig.Secrets, err = checker.NewSecretStore(secretsPath, checker.BastionSecretKey(secretKey, config.GetConfig().CustomerId, config.GetConfig().BastionId))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	redaction := checker.RedactionConfig{
+		AllowHeaders:      checker.ParseRedactionList(redactAllowHeaders),
+		DenyHeaders:       checker.ParseRedactionList(redactDenyHeaders),
+		BodyPatterns:      checker.ParseRedactionList(redactBodyPatterns),
+		DropPassingBodies: redactPassingBodies,
+	}
+	if redactBodyRegexp != "" {
+		redaction.BodyRegexps = []string{redactBodyRegexp}
+	}
+	runnerConfig.Redactor, err = checker.NewRedactor(redaction)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	log.SetFormatter(runnerConfig.Secrets.LogFormatter(runnerConfig.Redactor.LogFormatter(log.StandardLogger().Formatter)))
+
 	log.Info("Starting %s...", moduleName)
 	// TODO(greg): This intialization is fucking bullshit. Kill me.
 	runner, err := checker.NewNSQRunner(checker.NewRunner(&schema.HttpCheck{}), runnerConfig)
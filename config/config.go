@@ -26,6 +26,7 @@ type Config struct {
 	LogLevel            string
 	BezosHost           string
 	ExecutionGroupId    string
+	DnsServer           string
 	AWS                 *AWSConfig
 }
 
@@ -62,6 +63,7 @@ func (this *Config) getEnv() {
 	this.EtcdHost = os.Getenv("ETCD_HOST")
 	this.BezosHost = os.Getenv("BEZOS_HOST")
 	this.ExecutionGroupId = os.Getenv("EXECUTION_GROUP_ID")
+	this.DnsServer = os.Getenv("DNS_SERVER")
 }
 
 func GetConfig() *Config {
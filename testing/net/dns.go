@@ -0,0 +1,87 @@
+package net
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// DNSServer is a stub nameserver listening on a local UDP port. Every query
+// is answered with the server's records for the question's name and type, or
+// with NXDOMAIN if there are none.
+type DNSServer struct {
+	Addr    string
+	records []dns.RR
+	conn    net.PacketConn
+	queries int32
+}
+
+// NewDNSServer starts a stub nameserver serving records, which are given in
+// zone file format, e.g. "db.internal. 60 IN A 10.0.1.5".
+func NewDNSServer(t *testing.T, records ...string) *DNSServer {
+	s := &DNSServer{}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("error in record %q: %v", record, err)
+		}
+		s.records = append(s.records, rr)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error in listen %v", err)
+	}
+	s.Addr = conn.LocalAddr().String()
+	s.conn = conn
+	go s.serve()
+
+	return s
+}
+
+func (s *DNSServer) serve() {
+	buf := make([]byte, dns.MinMsgSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		query := &dns.Msg{}
+		if err := query.Unpack(buf[:n]); err != nil || len(query.Question) == 0 {
+			continue
+		}
+		atomic.AddInt32(&s.queries, 1)
+
+		reply := &dns.Msg{}
+		reply.SetReply(query)
+		reply.RecursionAvailable = true
+		q := query.Question[0]
+		for _, rr := range s.records {
+			if rr.Header().Rrtype == q.Qtype && strings.EqualFold(rr.Header().Name, q.Name) {
+				reply.Answer = append(reply.Answer, rr)
+			}
+		}
+		if len(reply.Answer) == 0 {
+			reply.Rcode = dns.RcodeNameError
+		}
+
+		msg, err := reply.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(msg, addr)
+	}
+}
+
+// Queries returns the number of queries the server has answered.
+func (s *DNSServer) Queries() int {
+	return int(atomic.LoadInt32(&s.queries))
+}
+
+func (s *DNSServer) Close() {
+	s.conn.Close()
+}